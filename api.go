@@ -0,0 +1,280 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "net/http"
+   "strings"
+)
+
+type EventsRequest struct {
+   Enable  []string
+   Disable []string
+}
+
+type IntervalRequest struct {
+   Interval int // in ms
+}
+
+type DiscreteRequest struct {
+   Discrete bool
+}
+
+type LabelRequest struct {
+   Label string
+   Attrs map[string]string
+}
+
+type SpanRequest struct {
+   Name  string
+   Attrs map[string]string
+}
+
+type EndRequest struct {
+   Span  string // ID or name
+   Attrs map[string]string
+}
+
+type LabelReply struct {
+   Timestamp int64
+   Label     string
+   Span      string `json:",omitempty"`
+}
+
+type RecordRequest struct {
+   File string
+}
+
+type ErrorReply struct {
+   Error string
+}
+
+func apiReply(w http.ResponseWriter, status int, v interface{}) {
+   w.Header().Set("Content-Type", "application/json")
+   w.WriteHeader(status)
+
+   enc := json.NewEncoder(w)
+   enc.SetIndent("", "   ")
+
+   err := enc.Encode(v)
+   if err != nil && *debug {
+      fmt.Println("failed writing:", err)
+   }
+}
+
+func apiError(w http.ResponseWriter, err error) {
+   status := http.StatusInternalServerError
+   if e, ok := err.(*ControlError); ok {
+      status = e.Status
+   }
+
+   apiReply(w, status, ErrorReply{err.Error()})
+}
+
+// decodes request body strictly, so misspelt fields are reported
+func apiDecode(r *http.Request, v interface{}) error {
+   dec := json.NewDecoder(r.Body)
+   dec.DisallowUnknownFields()
+
+   err := dec.Decode(v)
+   if err != nil {
+      return invalid("invalid request: %v", err)
+   }
+
+   return nil
+}
+
+// checks method is one of those allowed, replying if not
+func apiMethod(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+   for _, method := range allowed {
+      if r.Method == method {
+         return true
+      }
+   }
+
+   w.Header().Set("Allow", strings.Join(allowed, ", "))
+   apiReply(w, http.StatusMethodNotAllowed, ErrorReply{fmt.Sprintf("%s not allowed, use %s", r.Method, strings.Join(allowed, " or "))})
+   return false
+}
+
+// replies with status after a successful change
+func apiResult(w http.ResponseWriter, err error) {
+   if err != nil {
+      apiError(w, err)
+      return
+   }
+
+   apiReply(w, http.StatusOK, controlStatus())
+}
+
+func api(w http.ResponseWriter, r *http.Request) {
+   if *debug {
+      fmt.Printf("api %s %s\n", r.Method, r.URL.Path)
+   }
+
+   if auth.Blocked(r) {
+      apiReply(w, http.StatusTooManyRequests, ErrorReply{"too many failed authentications"})
+      return
+   }
+
+   token := requestToken(r)
+   role := auth.Role(token)
+   if role == "" {
+      if token != "" {
+         auth.Failed(r, "invalid API token")
+      }
+
+      apiReply(w, http.StatusUnauthorized, ErrorReply{"missing or invalid token"})
+      return
+   }
+
+   // viewers may only query
+   if r.Method != "GET" && role != roleControl {
+      apiReply(w, http.StatusForbidden, ErrorReply{"token may only view"})
+      return
+   }
+
+   endpoint := strings.TrimSuffix(r.URL.Path, "/")
+
+   switch endpoint {
+   case "/api/status":
+      if apiMethod(w, r, "GET") {
+         apiReply(w, http.StatusOK, controlStatus())
+      }
+   case "/api/sensors":
+      if apiMethod(w, r, "GET") {
+         apiReply(w, http.StatusOK, controlSensors())
+      }
+   case "/api/events":
+      if !apiMethod(w, r, "POST") {
+         return
+      }
+
+      var req EventsRequest
+      err := apiDecode(r, &req)
+      if err == nil && len(req.Enable) + len(req.Disable) == 0 {
+         err = invalid("no events to enable or disable")
+      }
+      if err == nil && len(req.Enable) > 0 {
+         err = controlEvents(req.Enable, true)
+      }
+      if err == nil && len(req.Disable) > 0 {
+         err = controlEvents(req.Disable, false)
+      }
+      if err != nil {
+         apiError(w, err)
+         return
+      }
+
+      apiReply(w, http.StatusOK, controlSensors())
+   case "/api/interval":
+      if !apiMethod(w, r, "PUT") {
+         return
+      }
+
+      var req IntervalRequest
+      err := apiDecode(r, &req)
+      if err == nil {
+         err = controlInterval(req.Interval)
+      }
+
+      apiResult(w, err)
+   case "/api/discrete":
+      if !apiMethod(w, r, "PUT") {
+         return
+      }
+
+      var req DiscreteRequest
+      err := apiDecode(r, &req)
+      if err == nil {
+         err = controlDiscrete(req.Discrete)
+      }
+
+      apiResult(w, err)
+   case "/api/labels":
+      if !apiMethod(w, r, "POST") {
+         return
+      }
+
+      var req LabelRequest
+      var timestamp int64
+      err := apiDecode(r, &req)
+      if err == nil {
+         timestamp, err = controlLabel(req.Label, req.Attrs)
+      }
+      if err != nil {
+         apiError(w, err)
+         return
+      }
+
+      apiReply(w, http.StatusOK, LabelReply{Timestamp: timestamp, Label: req.Label})
+   case "/api/spans", "/api/spans/end":
+      if !apiMethod(w, r, "POST") {
+         return
+      }
+
+      var label Label
+      var err error
+
+      if endpoint == "/api/spans/end" {
+         var req EndRequest
+         err = apiDecode(r, &req)
+         if err == nil {
+            label, err = controlEnd(req.Span, req.Attrs)
+         }
+      } else {
+         var req SpanRequest
+         err = apiDecode(r, &req)
+         if err == nil {
+            label, err = controlBegin(req.Name, req.Attrs)
+         }
+      }
+
+      if err != nil {
+         apiError(w, err)
+         return
+      }
+
+      apiReply(w, http.StatusOK, LabelReply{label.Timestamp, label.Text, label.Span})
+   case "/api/recording":
+      if !apiMethod(w, r, "POST", "DELETE") {
+         return
+      }
+
+      if r.Method == "DELETE" {
+         apiResult(w, controlStop())
+         return
+      }
+
+      var req RecordRequest
+      err := apiDecode(r, &req)
+      if err == nil {
+         err = controlRecord(req.File)
+      }
+
+      apiResult(w, err)
+   case "/api/recording/rotate":
+      if apiMethod(w, r, "POST") {
+         apiResult(w, controlRotate())
+      }
+   default:
+      apiReply(w, http.StatusNotFound, ErrorReply{fmt.Sprintf("unknown endpoint %s", r.URL.Path)})
+   }
+}
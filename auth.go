@@ -0,0 +1,379 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "crypto/rand"
+   "crypto/subtle"
+   "encoding/hex"
+   "fmt"
+   "io/ioutil"
+   "net"
+   "net/http"
+   "net/url"
+   "os"
+   "strings"
+   "sync"
+   "time"
+)
+
+const (
+   maxFailures   = 5 // within failureWindow, before blocking
+   failureWindow = time.Minute
+)
+
+// roles of tokens; viewers may only watch, whereas controllers may change
+// what is sampled and mark the trace
+const (
+   roleView    = "view"
+   roleControl = "control"
+)
+
+type authToken struct {
+   value string
+   role  string
+}
+
+type failures struct {
+   count int
+   since time.Time
+}
+
+// checks tokens, passwords and origins of web clients, limiting failed attempts
+type Authenticator struct {
+   scheme    string // of HTTP authentication: "none", "basic" or "bearer"
+   tokenFile string
+   modified  time.Time // of token file when read
+   tokens    []authToken
+   generated bool
+   passwords map[string]string // user to password
+   origins   []string
+   failed    map[string]*failures // by remote address
+   mutex     sync.Mutex
+}
+
+var auth *Authenticator
+
+// reads non-empty lines, ignoring comments
+func readConfig(name string) ([]string, error) {
+   content, err := ioutil.ReadFile(name)
+   if err != nil {
+      return nil, err
+   }
+
+   var lines []string
+   for _, line := range strings.Split(string(content), "\n") {
+      line = strings.TrimSpace(line)
+      if line != "" && !strings.HasPrefix(line, "#") {
+         lines = append(lines, line)
+      }
+   }
+
+   return lines, nil
+}
+
+func randomToken() string {
+   buf := make([]byte, 16)
+   _, err := rand.Read(buf)
+   validate(err)
+
+   return hex.EncodeToString(buf)
+}
+
+func NewAuthenticator(scheme, tokenFile, passwordFile, origins string) (*Authenticator, error) {
+   a := &Authenticator{scheme: scheme, tokenFile: tokenFile, failed: make(map[string]*failures)}
+
+   switch scheme {
+   case "none", "bearer":
+   case "basic":
+      if passwordFile == "" {
+         return nil, fmt.Errorf("basic authentication needs -passwordFile")
+      }
+
+      lines, err := readConfig(passwordFile)
+      if err != nil {
+         return nil, err
+      }
+
+      a.passwords = make(map[string]string)
+      for _, line := range lines {
+         i := strings.Index(line, ":")
+         if i < 1 {
+            return nil, fmt.Errorf("%s: expected user:password", passwordFile)
+         }
+
+         a.passwords[line[:i]] = line[i+1:]
+      }
+   default:
+      return nil, fmt.Errorf("unknown authentication '%s'", scheme)
+   }
+
+   if origins != "" {
+      for _, origin := range strings.Split(origins, ",") {
+         a.origins = append(a.origins, strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+      }
+   }
+
+   // without shared secrets, a controlling and a viewing token are generated for this instance
+   if tokenFile == "" {
+      a.tokens = []authToken{{randomToken(), roleControl}, {randomToken(), roleView}}
+      a.generated = true
+      return a, nil
+   }
+
+   _, err := a.Tokens()
+   return a, err
+}
+
+// parses token file line, eg "3f9c... role=control alice"
+func parseToken(line string) (authToken, error) {
+   fields := strings.Fields(line)
+   token := authToken{fields[0], roleView}
+
+   for _, field := range fields[1:] {
+      if !strings.HasPrefix(field, "role=") {
+         continue
+      }
+
+      token.role = strings.TrimPrefix(field, "role=")
+      if token.role != roleView && token.role != roleControl {
+         return token, fmt.Errorf("unknown role '%s'", token.role)
+      }
+   }
+
+   return token, nil
+}
+
+// returns accepted tokens, rereading the token file if changed
+func (a *Authenticator) Tokens() ([]authToken, error) {
+   a.mutex.Lock()
+   defer a.mutex.Unlock()
+
+   if a.tokenFile == "" {
+      return a.tokens, nil
+   }
+
+   info, err := os.Stat(a.tokenFile)
+   if err != nil {
+      return nil, err
+   }
+
+   if !info.ModTime().Equal(a.modified) || a.tokens == nil {
+      lines, err := readConfig(a.tokenFile)
+      if err != nil {
+         return nil, err
+      }
+
+      // tokens are the first field, so lines may be annotated
+      var tokens []authToken
+      for _, line := range lines {
+         token, err := parseToken(line)
+         if err != nil {
+            return nil, fmt.Errorf("%s: %v", a.tokenFile, err)
+         }
+
+         tokens = append(tokens, token)
+      }
+
+      a.tokens = tokens
+
+      if len(a.tokens) == 0 {
+         return nil, fmt.Errorf("no tokens in %s", a.tokenFile)
+      }
+
+      a.modified = info.ModTime()
+   }
+
+   return a.tokens, nil
+}
+
+// returns role of token, or "" if not accepted; all tokens are compared
+// in constant time
+func (a *Authenticator) Role(token string) string {
+   tokens, err := a.Tokens()
+   if err != nil {
+      fmt.Println("failed reading tokens:", err)
+      return ""
+   }
+
+   role := ""
+   for _, t := range tokens {
+      if subtle.ConstantTimeCompare([]byte(t.value), []byte(token)) == 1 {
+         role = t.role
+      }
+   }
+
+   return role
+}
+
+func (a *Authenticator) Valid(token string) bool {
+   return a.Role(token) != ""
+}
+
+// generated token of role
+func (a *Authenticator) generatedToken(role string) string {
+   for _, t := range a.tokens {
+      if t.role == role {
+         return t.value
+      }
+   }
+
+   return ""
+}
+
+func remoteHost(r *http.Request) string {
+   host, _, err := net.SplitHostPort(r.RemoteAddr)
+   if err != nil {
+      return r.RemoteAddr
+   }
+
+   return host
+}
+
+// checks if address has failed too often recently
+func (a *Authenticator) Blocked(r *http.Request) bool {
+   a.mutex.Lock()
+   defer a.mutex.Unlock()
+
+   f, ok := a.failed[remoteHost(r)]
+   if !ok {
+      return false
+   }
+
+   if time.Since(f.since) > failureWindow {
+      delete(a.failed, remoteHost(r))
+      return false
+   }
+
+   return f.count >= maxFailures
+}
+
+// logs failed attempt, until the address is blocked
+func (a *Authenticator) Failed(r *http.Request, reason string) {
+   a.mutex.Lock()
+   defer a.mutex.Unlock()
+
+   host := remoteHost(r)
+   f, ok := a.failed[host]
+   if !ok || time.Since(f.since) > failureWindow {
+      f = &failures{since: time.Now()}
+      a.failed[host] = f
+   }
+
+   f.count++
+
+   switch {
+   case f.count < maxFailures:
+      fmt.Printf("authentication failed from %s: %s\n", host, reason)
+   case f.count == maxFailures:
+      fmt.Printf("authentication failed from %s: %s; blocking for %v\n", host, reason, failureWindow)
+   }
+}
+
+// checks HTTP credentials, if required
+func (a *Authenticator) credentials(r *http.Request) (bool, string) {
+   switch a.scheme {
+   case "basic":
+      user, password, ok := r.BasicAuth()
+      if !ok {
+         return false, ""
+      }
+
+      expected, known := a.passwords[user]
+      if subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 || !known {
+         return false, "wrong password for user '" + user + "'"
+      }
+   case "bearer":
+      header := r.Header.Get("Authorization")
+      if !strings.HasPrefix(header, "Bearer ") {
+         return false, ""
+      }
+
+      token := strings.TrimPrefix(header, "Bearer ")
+      if !a.Valid(token) {
+         return false, "invalid bearer token"
+      }
+   }
+
+   return true, ""
+}
+
+// requires HTTP authentication of all requests, if configured
+func (a *Authenticator) Handler(h http.Handler) http.Handler {
+   return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      if a.Blocked(r) {
+         http.Error(w, "too many failed authentications", http.StatusTooManyRequests)
+         return
+      }
+
+      ok, reason := a.credentials(r)
+      if !ok {
+         // missing credentials are prompted for rather than counted
+         if reason != "" {
+            a.Failed(r, reason)
+         }
+
+         if a.scheme == "basic" {
+            w.Header().Set("WWW-Authenticate", `Basic realm="numascope"`)
+         } else {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+         }
+
+         http.Error(w, "unauthorised", http.StatusUnauthorized)
+         return
+      }
+
+      h.ServeHTTP(w, r)
+   })
+}
+
+// token given to the REST API, as bearer token or header
+func requestToken(r *http.Request) string {
+   if token := r.Header.Get("X-Numascope-Token"); token != "" {
+      return token
+   }
+
+   if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+      return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+   }
+
+   return ""
+}
+
+// accepts websocket connections from pages served here, or listed origins;
+// clients other than browsers send no origin
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+   origin := r.Header.Get("Origin")
+   if origin == "" {
+      return true
+   }
+
+   u, err := url.Parse(origin)
+   if err == nil && strings.EqualFold(u.Host, r.Host) {
+      return true
+   }
+
+   for _, allowed := range a.origins {
+      if strings.EqualFold(allowed, origin) {
+         return true
+      }
+   }
+
+   a.Failed(r, "origin "+origin+" not allowed")
+   return false
+}
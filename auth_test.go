@@ -0,0 +1,232 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "io/ioutil"
+   "net/http"
+   "net/http/httptest"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+func TestAuthBasic(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   passwords := filepath.Join(dir, "passwords")
+   ioutil.WriteFile(passwords, []byte("# operators\nalice:s3cret\n"), 0600)
+
+   a, err := NewAuthenticator("basic", "", passwords, "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   h := a.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      w.Write([]byte("ok"))
+   }))
+
+   get := func(user, password string) int {
+      w := httptest.NewRecorder()
+      r := httptest.NewRequest("GET", "/", nil)
+      if user != "" {
+         r.SetBasicAuth(user, password)
+      }
+
+      h.ServeHTTP(w, r)
+      return w.Code
+   }
+
+   if code := get("", ""); code != 401 {
+      t.Errorf("unauthenticated request gave %d", code)
+   }
+
+   if code := get("alice", "s3cret"); code != 200 {
+      t.Errorf("authenticated request gave %d", code)
+   }
+
+   // blocked after repeated failures, even with the right password
+   for i := 0; i < maxFailures; i++ {
+      get("alice", "guess")
+   }
+
+   if code := get("alice", "s3cret"); code != http.StatusTooManyRequests {
+      t.Errorf("expected blocking, got %d", code)
+   }
+}
+
+func TestAuthMonitor(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   tokens := filepath.Join(dir, "tokens")
+   ioutil.WriteFile(tokens, []byte("first\n"), 0600)
+
+   auth, err = NewAuthenticator("none", tokens, "", "https://dashboard.example.com")
+   if err != nil {
+      t.Fatal(err)
+   }
+   upgrader.CheckOrigin = auth.CheckOrigin
+   defer func() { upgrader.CheckOrigin = nil }()
+
+   rec := testRecording(1)
+   savedPresent := present
+   defer func() { present = savedPresent }()
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+
+   server := httptest.NewServer(http.HandlerFunc(monitor))
+   defer server.Close()
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   // replies to handshake with signon, or closes
+   handshake := func(token, origin string) (bool, error) {
+      header := http.Header{}
+      if origin != "" {
+         header.Set("Origin", origin)
+      }
+
+      socket, _, err := websocket.DefaultDialer.Dial(url, header)
+      if err != nil {
+         return false, err
+      }
+      defer socket.Close()
+
+      socket.WriteMessage(websocket.TextMessage, []byte(token))
+      socket.SetReadDeadline(time.Now().Add(time.Second))
+
+      var signon SignonMessage
+      err = socket.ReadJSON(&signon)
+      return err == nil && signon.Sources["test"] == 2, err
+   }
+
+   if ok, err := handshake("first", ""); !ok {
+      t.Errorf("valid token refused: %v", err)
+   }
+
+   if ok, err := handshake("463ba1974b06", ""); ok || !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+      t.Errorf("invalid token accepted: %v", err)
+   }
+
+   if _, err := handshake("first", "http://evil.example.com"); err == nil {
+      t.Error("foreign origin accepted")
+   }
+
+   if ok, err := handshake("first", "https://dashboard.example.com"); !ok {
+      t.Errorf("listed origin refused: %v", err)
+   }
+
+   // token file is reread when changed
+   later := time.Now().Add(time.Second)
+   ioutil.WriteFile(tokens, []byte("second viewer\n"), 0600)
+   os.Chtimes(tokens, later, later)
+
+   if !auth.Valid("second") || auth.Valid("first") {
+      t.Error("token file not reread")
+   }
+}
+
+func TestRoles(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   tokens := filepath.Join(dir, "tokens")
+   ioutil.WriteFile(tokens, []byte("operator role=control\nwatcher dashboard\n"), 0600)
+
+   auth, err = NewAuthenticator("none", tokens, "", "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   rec := testRecording(1)
+   savedPresent, savedDiscrete := present, *discrete
+   defer func() { present, *discrete = savedPresent, savedDiscrete }()
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+
+   server := httptest.NewServer(http.HandlerFunc(monitor))
+   defer server.Close()
+   url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+   // changes to discrete mode, returning role and next message
+   request := func(token string) (string, map[string]interface{}) {
+      socket, _, err := websocket.DefaultDialer.Dial(url, nil)
+      if err != nil {
+         t.Fatal(err)
+      }
+      defer socket.Close()
+
+      socket.WriteMessage(websocket.TextMessage, []byte(token))
+      socket.SetReadDeadline(time.Now().Add(time.Second))
+
+      var signon SignonMessage
+      var enabled, reply map[string]interface{}
+      socket.ReadJSON(&signon)
+      socket.ReadJSON(&enabled)
+
+      socket.WriteJSON(map[string]string{"Op": "averaging", "Value": "false"})
+      socket.ReadJSON(&reply)
+      return signon.Role, reply
+   }
+
+   *discrete = false
+
+   role, reply := request("watcher")
+   if role != roleView || reply["Op"] != "error" || *discrete {
+      t.Errorf("viewer not refused: %s %v", role, reply)
+   }
+
+   // the change is broadcast back
+   role, reply = request("operator")
+   if role != roleControl || reply["Op"] != "enabled" || reply["Discrete"] != true {
+      t.Errorf("controller refused: %s %v", role, reply)
+   }
+
+   // viewers may query the API but not change anything
+   call := func(method, endpoint, token string) int {
+      w := httptest.NewRecorder()
+      r := httptest.NewRequest(method, endpoint, strings.NewReader(`{"Discrete": false}`))
+      r.Header.Set("X-Numascope-Token", token)
+      api(w, r)
+      return w.Code
+   }
+
+   if code := call("GET", "/api/status", "watcher"); code != 200 {
+      t.Errorf("viewer status gave %d", code)
+   }
+
+   if code := call("PUT", "/api/discrete", "watcher"); code != http.StatusForbidden || !*discrete {
+      t.Errorf("viewer change gave %d", code)
+   }
+
+   if _, err := parseToken("secret role=admin"); err == nil {
+      t.Error("unknown role accepted")
+   }
+}
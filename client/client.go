@@ -0,0 +1,234 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package client lets applications annotate a running numascope instance
+// through its control socket, and follow its samples over the live web
+// service.
+package client
+
+import (
+   "bufio"
+   "errors"
+   "fmt"
+   "net"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+)
+
+// where numascope listens for commands by default
+const DefaultSocket = "/run/numascope.sock"
+
+// failure reported by numascope, rather than in reaching it
+type CommandError struct {
+   Command string
+   Message string
+}
+
+// sends commands over the control socket, connecting when first needed
+// and again after failures; safe for concurrent use
+type Controller struct {
+   path    string
+   conn    net.Conn
+   replies *bufio.Scanner
+   mutex   sync.Mutex
+}
+
+// key=value metadata of labels and spans; keys and values may not contain spaces
+type Attrs map[string]string
+
+// region of the trace started by Begin, which may contain others
+type Span struct {
+   controller *Controller
+   ID         string
+   Name       string
+}
+
+var (
+   defaultController = Dial(DefaultSocket)
+)
+
+func (e *CommandError) Error() string {
+   return fmt.Sprintf("%s: %s", e.Command, e.Message)
+}
+
+// returns controller for socket path; no connection is made until used
+func Dial(path string) *Controller {
+   return &Controller{path: path}
+}
+
+func (c *Controller) connect() error {
+   conn, err := net.Dial("unix", c.path)
+   if err != nil {
+      return err
+   }
+
+   c.conn = conn
+   c.replies = bufio.NewScanner(conn)
+   return nil
+}
+
+func (c *Controller) disconnect() {
+   if c.conn != nil {
+      c.conn.Close()
+      c.conn = nil
+   }
+}
+
+// sends command and reads its reply; sent is set once the command may have been performed
+func (c *Controller) exchange(command string) (reply string, sent bool, err error) {
+   if c.conn == nil {
+      err = c.connect()
+      if err != nil {
+         return "", false, err
+      }
+   }
+
+   _, err = fmt.Fprintln(c.conn, command)
+   if err != nil {
+      return "", false, err
+   }
+
+   if !c.replies.Scan() {
+      err = c.replies.Err()
+      if err == nil {
+         err = errors.New("connection closed")
+      }
+
+      return "", true, err
+   }
+
+   return c.replies.Text(), true, nil
+}
+
+// sends a command, returning any result; reconnects once if numascope was
+// restarted, but not if the reply was lost, as labels would be added twice
+func (c *Controller) Command(command string) (string, error) {
+   if strings.ContainsAny(command, "\r\n") {
+      return "", &CommandError{command, "command spans lines"}
+   }
+
+   c.mutex.Lock()
+   defer c.mutex.Unlock()
+
+   reply, sent, err := c.exchange(command)
+   if err != nil && !sent {
+      c.disconnect()
+      reply, _, err = c.exchange(command)
+   }
+
+   if err != nil {
+      c.disconnect()
+      return "", err
+   }
+
+   switch {
+   case reply == "OK":
+      return "", nil
+   case strings.HasPrefix(reply, "OK "):
+      return reply[3:], nil
+   default:
+      return "", &CommandError{command, strings.TrimPrefix(reply, "ERR ")}
+   }
+}
+
+// formats attributes as trailing command fields
+func fields(command string, attrs []Attrs) (string, error) {
+   merged := make(Attrs)
+   for _, a := range attrs {
+      for key, val := range a {
+         merged[key] = val
+      }
+   }
+
+   keys := make([]string, 0, len(merged))
+   for key := range merged {
+      keys = append(keys, key)
+   }
+   sort.Strings(keys)
+
+   for _, key := range keys {
+      val := merged[key]
+      if key == "" || strings.ContainsAny(key, "= \t\r\n") || strings.ContainsAny(val, " \t\r\n") {
+         return "", &CommandError{command, fmt.Sprintf("invalid attribute '%s=%s'", key, val)}
+      }
+
+      command += " " + key + "=" + val
+   }
+
+   return command, nil
+}
+
+// adds label to the trace, returning its timestamp in us
+func (c *Controller) Label(text string, attrs ...Attrs) (int64, error) {
+   command, err := fields("label " + text, attrs)
+   if err != nil {
+      return 0, err
+   }
+
+   reply, err := c.Command(command)
+   if err != nil {
+      return 0, err
+   }
+
+   return strconv.ParseInt(reply, 10, 64)
+}
+
+// starts a named region, ended with End
+func (c *Controller) Begin(name string, attrs ...Attrs) (*Span, error) {
+   command, err := fields("begin " + name, attrs)
+   if err != nil {
+      return nil, err
+   }
+
+   id, err := c.Command(command)
+   if err != nil {
+      return nil, err
+   }
+
+   return &Span{c, id, name}, nil
+}
+
+// ends region, with any attributes known only at the end, eg results
+func (s *Span) End(attrs ...Attrs) error {
+   command, err := fields("end " + s.ID, attrs)
+   if err == nil {
+      _, err = s.controller.Command(command)
+   }
+
+   return err
+}
+
+func (c *Controller) Close() error {
+   c.mutex.Lock()
+   defer c.mutex.Unlock()
+
+   c.disconnect()
+   return nil
+}
+
+// adds label to the trace of the local instance
+func Label(text string, attrs ...Attrs) error {
+   _, err := defaultController.Label(text, attrs...)
+   return err
+}
+
+// starts a named region of the trace of the local instance
+func Begin(name string, attrs ...Attrs) (*Span, error) {
+   return defaultController.Begin(name, attrs...)
+}
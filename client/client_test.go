@@ -0,0 +1,205 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+   "bufio"
+   "context"
+   "fmt"
+   "io/ioutil"
+   "net"
+   "net/http"
+   "net/http/httptest"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// replies to commands like numascope, closing after each connection's first command
+func fakeSocket(t *testing.T, path string, received chan<- string) net.Listener {
+   listener, err := net.Listen("unix", path)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   go func() {
+      for {
+         conn, err := listener.Accept()
+         if err != nil {
+            return
+         }
+
+         scanner := bufio.NewScanner(conn)
+         if scanner.Scan() {
+            command := scanner.Text()
+            received <- command
+
+            switch {
+            case command == "label lost":
+               // performed, but exits before replying
+            case strings.HasPrefix(command, "label "):
+               fmt.Fprintln(conn, "OK 1234")
+            case strings.HasPrefix(command, "begin "):
+               fmt.Fprintln(conn, "OK 7")
+            case strings.HasPrefix(command, "end "):
+               fmt.Fprintln(conn, "OK")
+            default:
+               fmt.Fprintln(conn, "ERR unknown command")
+            }
+         }
+
+         conn.Close()
+      }
+   }()
+
+   return listener
+}
+
+func TestController(t *testing.T) {
+   dir, err := ioutil.TempDir("", "client")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   received := make(chan string, 10)
+   path := filepath.Join(dir, "ctl.sock")
+   listener := fakeSocket(t, path, received)
+   defer listener.Close()
+
+   c := Dial(path)
+   defer c.Close()
+
+   timestamp, err := c.Label("phase 1")
+   if err != nil || timestamp != 1234 {
+      t.Fatalf("label at %d: %v", timestamp, err)
+   }
+
+   // previous connection was closed by the server
+   span, err := c.Begin("solve", Attrs{"n": "4096", "iter": "1"})
+   if err != nil || span.ID != "7" {
+      t.Fatalf("span %+v: %v", span, err)
+   }
+
+   err = span.End(Attrs{"result": "ok"})
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if _, err = c.Label("phase", Attrs{"bad key": "1"}); err == nil {
+      t.Error("expected invalid attribute to fail")
+   }
+
+   if _, err = c.Command("frobnicate"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+      t.Errorf("expected command error, got %v", err)
+   }
+
+   if _, err = c.Label("two\nlines"); err == nil {
+      t.Error("expected multi-line label to fail")
+   }
+
+   // not resent, as it may have been performed
+   if _, err = c.Label("lost"); err == nil {
+      t.Error("expected lost reply to fail")
+   }
+
+   if _, err = c.Label("phase 2"); err != nil {
+      t.Errorf("reconnecting after lost reply: %v", err)
+   }
+
+   for _, expected := range []string{"label phase 1", "begin solve iter=1 n=4096", "end 7 result=ok", "frobnicate", "label lost", "label phase 2"} {
+      if command := <-received; command != expected {
+         t.Errorf("received '%s', expected '%s'", command, expected)
+      }
+   }
+}
+
+func TestSubscribe(t *testing.T) {
+   upgrader := websocket.Upgrader{}
+
+   server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      socket, err := upgrader.Upgrade(w, r, nil)
+      if err != nil {
+         return
+      }
+      defer socket.Close()
+
+      _, token, err := socket.ReadMessage()
+      if err != nil || string(token) != "secret" {
+         return
+      }
+
+      socket.WriteMessage(websocket.TextMessage, []byte(`{"Timestamp": 1, "Tree": {"test": ["reads"]}, "Sources": {"test": 2}, "Role": "view"}`))
+      socket.WriteMessage(websocket.TextMessage, []byte(`{"Op": "enabled", "Timestamp": 2, "Interval": 100, "Enabled": {"test": ["reads"]}}`))
+      socket.WriteMessage(websocket.TextMessage, []byte(`{"Op": "error", "Error": "'interval' needs a controlling token"}`))
+      socket.WriteMessage(websocket.TextMessage, []byte(`{"Op": "future"}`))
+      socket.WriteMessage(websocket.TextMessage, []byte(`[[3000, 10], [4000, 20]]`))
+      socket.WriteMessage(websocket.TextMessage, []byte(`{"Op": "label", "Timestamp": 5000, "Label": "phase 1"}`))
+   }))
+   defer server.Close()
+
+   ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+   defer cancel()
+
+   messages := Subscribe(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), Options{Token: "secret", Retry: 10 * time.Millisecond})
+
+   next := func() Message {
+      msg, ok := <-messages
+      if !ok {
+         t.Fatal("subscription ended")
+      }
+
+      return msg
+   }
+
+   // server disconnects after each sequence
+   for i := 0; i < 2; i++ {
+      if msg := next(); msg.Signon == nil || msg.Signon.Sources["test"] != 2 || msg.Signon.Role != "view" {
+         t.Fatalf("expected signon, got %+v", msg)
+      }
+
+      if msg := next(); msg.Change == nil || msg.Change.Interval != 100 || msg.Change.Enabled["test"][0] != "reads" {
+         t.Fatalf("expected change, got %+v", msg)
+      }
+
+      // unknown ops are skipped rather than ending the connection
+      if msg := next(); msg.Refused == nil || !strings.Contains(msg.Refused.Error, "controlling") {
+         t.Fatalf("expected refusal, got %+v", msg)
+      }
+
+      if msg := next(); len(msg.Samples) != 2 || msg.Samples[1].Timestamp != 4000 || msg.Samples[1].Values[0] != 20 {
+         t.Fatalf("expected samples, got %+v", msg)
+      }
+
+      if msg := next(); msg.Label == nil || msg.Label.Label != "phase 1" {
+         t.Fatalf("expected label, got %+v", msg)
+      }
+
+      if msg := next(); msg.Err == nil {
+         t.Fatalf("expected disconnection, got %+v", msg)
+      }
+   }
+
+   cancel()
+   for range messages {
+   }
+}
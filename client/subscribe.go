@@ -0,0 +1,264 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package client
+
+import (
+   "context"
+   "crypto/tls"
+   "encoding/json"
+   "net/http"
+   "os"
+   "time"
+
+   "github.com/gorilla/websocket"
+)
+
+// sent first after each connection, describing available events
+type SignonMessage struct {
+   Timestamp int64               // in us
+   Tree      map[string][]string // event descriptions per sensor
+   Kinds     map[string][]string // parallel to Tree
+   Units     map[string][]string // parallel to Tree
+   Sources   map[string]uint
+   Role      string // "control", or "view" when changes are refused
+}
+
+type ReplayState struct {
+   Start    int64 // first timestamp in us
+   Duration int64 // in us
+   Position int64 // from start in us
+   Speed    float64
+   Paused   bool
+   Loop     bool
+}
+
+// sent when enabled events, interval or mode change; samples follow this layout
+type ChangeMessage struct {
+   Timestamp int64
+   Interval  int // in ms
+   Discrete  bool
+   Enabled   map[string][]string // headings per sensor
+   Replay    *ReplayState
+}
+
+type LabelMessage struct {
+   Timestamp int64
+   Label     string
+   Kind      string // "begin" or "end" of a span, else a point
+   Span      string // pairs begin and end
+   Attrs     Attrs
+}
+
+// sent when a change is refused, eg as the token only allows viewing
+type ErrorMessage struct {
+   Error string
+}
+
+// values of enabled events in order of sensors, per source if discrete
+type Sample struct {
+   Timestamp int64
+   Values    []int64
+}
+
+// one of Signon, Change, Label, Replay, Refused or Samples is set, or Err
+// after a failed connection, before reconnecting
+type Message struct {
+   Signon  *SignonMessage
+   Change  *ChangeMessage
+   Label   *LabelMessage
+   Replay  *ReplayState
+   Refused *ErrorMessage
+   Samples []Sample
+   Err     error
+}
+
+type Options struct {
+   Token  string        // as printed by numascope or in its token file; defaults to $NUMASCOPE_TOKEN
+   Header http.Header   // added to the upgrade request, eg for authentication
+   Retry  time.Duration // initial delay before reconnecting, doubling to a minute
+   TLS    *tls.Config   // for wss:// urls, eg trusting a self-signed certificate
+}
+
+// decodes one message following signon; messages from newer versions
+// aren't known, so are skipped
+func decode(data []byte) (msg Message, known bool, err error) {
+   // sample epochs are sent as arrays
+   if len(data) > 0 && data[0] == '[' {
+      var epochs [][]int64
+      err = json.Unmarshal(data, &epochs)
+      if err != nil {
+         return msg, false, err
+      }
+
+      for _, epoch := range epochs {
+         if len(epoch) > 0 {
+            msg.Samples = append(msg.Samples, Sample{epoch[0], epoch[1:]})
+         }
+      }
+
+      return msg, true, nil
+   }
+
+   var op struct {
+      Op string
+   }
+
+   err = json.Unmarshal(data, &op)
+   if err != nil {
+      return msg, false, err
+   }
+
+   known = true
+
+   switch op.Op {
+   case "enabled":
+      msg.Change = &ChangeMessage{}
+      err = json.Unmarshal(data, msg.Change)
+   case "label":
+      msg.Label = &LabelMessage{}
+      err = json.Unmarshal(data, msg.Label)
+   case "replay":
+      var replay struct {
+         Replay *ReplayState
+      }
+
+      err = json.Unmarshal(data, &replay)
+      msg.Replay = replay.Replay
+   case "error":
+      msg.Refused = &ErrorMessage{}
+      err = json.Unmarshal(data, msg.Refused)
+   default:
+      known = false
+   }
+
+   return msg, known, err
+}
+
+// connects and forwards messages until the connection fails or ctx is done
+func session(ctx context.Context, url string, opts Options, messages chan<- Message) error {
+   dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second, TLSClientConfig: opts.TLS}
+
+   socket, _, err := dialer.DialContext(ctx, url, opts.Header)
+   if err != nil {
+      return err
+   }
+   defer socket.Close()
+
+   // unblock reads when cancelled
+   done := make(chan struct{})
+   defer close(done)
+
+   go func() {
+      select {
+      case <-ctx.Done():
+         socket.Close()
+      case <-done:
+      }
+   }()
+
+   err = socket.WriteMessage(websocket.TextMessage, []byte(opts.Token))
+   if err != nil {
+      return err
+   }
+
+   signedon := false
+
+   for {
+      _, data, err := socket.ReadMessage()
+      if err != nil {
+         return err
+      }
+
+      var msg Message
+      known := true
+
+      if !signedon {
+         msg.Signon = &SignonMessage{}
+         err = json.Unmarshal(data, msg.Signon)
+         signedon = true
+      } else {
+         msg, known, err = decode(data)
+      }
+
+      if err != nil {
+         return err
+      }
+
+      if !known {
+         continue
+      }
+
+      select {
+      case messages <- msg:
+      case <-ctx.Done():
+         return ctx.Err()
+      }
+   }
+}
+
+// follows the live web service at url, eg "wss://host/monitor", reconnecting
+// after failures; the channel is closed when ctx is done
+func Subscribe(ctx context.Context, url string, opts Options) <-chan Message {
+   if opts.Token == "" {
+      opts.Token = os.Getenv("NUMASCOPE_TOKEN")
+   }
+
+   if opts.Retry <= 0 {
+      opts.Retry = time.Second
+   }
+
+   messages := make(chan Message, 16)
+
+   go func() {
+      defer close(messages)
+      delay := opts.Retry
+
+      for {
+         start := time.Now()
+         err := session(ctx, url, opts, messages)
+
+         if ctx.Err() != nil {
+            return
+         }
+
+         // reset backoff after a working connection
+         if time.Since(start) > time.Minute {
+            delay = opts.Retry
+         }
+
+         select {
+         case messages <- Message{Err: err}:
+         case <-ctx.Done():
+            return
+         }
+
+         select {
+         case <-time.After(delay):
+         case <-ctx.Done():
+            return
+         }
+
+         delay *= 2
+         if delay > time.Minute {
+            delay = time.Minute
+         }
+      }
+   }()
+
+   return messages
+}
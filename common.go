@@ -25,11 +25,43 @@ import (
    "syscall"
 )
 
+type Kind int
+
+const (
+   Counter Kind = iota // monotonic, reported as rate per second
+   Gauge               // instantaneous, reported as absolute value
+   Ratio               // reported as rate relative to Rate()
+)
+
 type Event struct {
    index    int16 // -1 means unindexed
    mnemonic string
    desc     string
    enabled  bool
+   kind     Kind
+   unit     string // units of gauges, eg pages or kB
+}
+
+func (k Kind) String() string {
+   switch k {
+   case Gauge:
+      return "gauge"
+   case Ratio:
+      return "ratio"
+   default:
+      return "counter"
+   }
+}
+
+func parseKind(s string) Kind {
+   switch s {
+   case "gauge":
+      return Gauge
+   case "ratio":
+      return Ratio
+   default:
+      return Counter
+   }
 }
 
 type Sensor interface {
@@ -75,3 +107,30 @@ func validateNonblock(err error) {
       os.Exit(1)
    }
 }
+
+// metadata of each heading, as events may have multiple headings when discrete
+func headingEvents(sensor Sensor) []Event {
+   var enabled []Event
+
+   for _, event := range sensor.Events() {
+      if event.enabled {
+         enabled = append(enabled, event)
+      }
+   }
+
+   headings := sensor.Headings(true)
+   if len(enabled) == 0 {
+      return nil
+   }
+
+   perEvent := len(headings) / len(enabled)
+   events := make([]Event, 0, len(headings))
+
+   for _, event := range enabled {
+      for i := 0; i < perEvent; i++ {
+         events = append(events, event)
+      }
+   }
+
+   return events
+}
@@ -0,0 +1,151 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "bytes"
+   "compress/gzip"
+   "io"
+   "os"
+   "path"
+   "strings"
+   "time"
+
+   "github.com/klauspost/compress/zstd"
+)
+
+const flushInterval = time.Second
+
+var (
+   gzipMagic = []byte{0x1f, 0x8b}
+   zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type flushWriteCloser interface {
+   io.WriteCloser
+   Flush() error
+}
+
+// compresses a stream, flushing periodically so an interrupted recording
+// decompresses up to the last flush
+type compressedWriter struct {
+   file      *os.File
+   z         flushWriteCloser
+   lastFlush time.Time
+}
+
+// returns compression extension of name, if any
+func compression(name string) string {
+   switch ext := path.Ext(name); ext {
+   case ".gz", ".zst":
+      return ext
+   }
+
+   return ""
+}
+
+// returns extension including any compression, eg .json.gz
+func extension(name string) string {
+   ext := compression(name)
+   return path.Ext(strings.TrimSuffix(name, ext)) + ext
+}
+
+// wraps file with compression by extension
+func newCompressedWriter(name string, f *os.File) (io.Writer, error) {
+   var z flushWriteCloser
+   var err error
+
+   switch compression(name) {
+   case ".gz":
+      z = gzip.NewWriter(f)
+   case ".zst":
+      z, err = zstd.NewWriter(f)
+   default:
+      return f, nil
+   }
+
+   return &compressedWriter{file: f, z: z, lastFlush: time.Now()}, err
+}
+
+func (c *compressedWriter) Write(p []byte) (int, error) {
+   n, err := c.z.Write(p)
+   if err != nil {
+      return n, err
+   }
+
+   if time.Since(c.lastFlush) > flushInterval {
+      c.lastFlush = time.Now()
+      err = c.z.Flush()
+   }
+
+   return n, err
+}
+
+func (c *compressedWriter) Sync() error {
+   err := c.z.Flush()
+   if err != nil {
+      return err
+   }
+
+   c.lastFlush = time.Now()
+   return c.file.Sync()
+}
+
+// completes the stream, without closing the file
+func (c *compressedWriter) Close() error {
+   return c.z.Close()
+}
+
+// treats a truncated compressed stream as ending at the last complete block
+type tolerantReader struct {
+   r io.Reader
+}
+
+func (t tolerantReader) Read(p []byte) (int, error) {
+   n, err := t.r.Read(p)
+   if err == io.ErrUnexpectedEOF {
+      err = io.EOF
+   }
+
+   return n, err
+}
+
+// transparently decompresses by content
+func decompressed(reader *bufio.Reader) (*bufio.Reader, error) {
+   magic, _ := reader.Peek(4)
+
+   switch {
+   case bytes.HasPrefix(magic, gzipMagic):
+      z, err := gzip.NewReader(reader)
+      if err != nil {
+         return nil, err
+      }
+
+      return bufio.NewReader(tolerantReader{z}), nil
+   case bytes.HasPrefix(magic, zstdMagic):
+      z, err := zstd.NewReader(reader)
+      if err != nil {
+         return nil, err
+      }
+
+      return bufio.NewReader(tolerantReader{z.IOReadCloser()}), nil
+   }
+
+   return reader, nil
+}
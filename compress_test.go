@@ -0,0 +1,69 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "io/ioutil"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+)
+
+func TestRecordingCompressed(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   for _, leaf := range []string{"trace.json.gz", "trace.jsonl.zst", "trace.nsb.gz"} {
+      name := recordSynthetic(t, dir, 3)
+      rec, err := loadRecording(name)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      // same content in compressed format
+      *recordFile = filepath.Join(dir, leaf)
+      err = saveRecording(rec, *recordFile)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      content, err := ioutil.ReadFile(*recordFile)
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      if !strings.HasPrefix(string(content), "\x1f\x8b") && !strings.HasPrefix(string(content), "\x28\xb5\x2f\xfd") {
+         t.Errorf("%s not compressed", leaf)
+      }
+
+      out, err := loadRecording(*recordFile)
+      if err != nil {
+         t.Fatalf("%s: %v", leaf, err)
+      }
+
+      if len(out.Samples) != 3 || len(out.Labels) != 1 {
+         t.Errorf("%s: %d samples and %d labels", leaf, len(out.Samples), len(out.Labels))
+      }
+
+      os.Remove(name)
+   }
+}
@@ -0,0 +1,407 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "net/http"
+   "os"
+   "path"
+   "path/filepath"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+// failure of a control operation, with the matching HTTP status
+type ControlError struct {
+   Status  int
+   Message string
+}
+
+type EventStatus struct {
+   Mnemonic string
+   Desc     string
+   Kind     string
+   Unit     string
+   Enabled  bool
+}
+
+type SensorStatus struct {
+   Name    string
+   Sources uint
+   Rate    uint
+   Events  []EventStatus
+}
+
+type Status struct {
+   Version   string
+   Mode      string
+   Hostname  string
+   Started   time.Time
+   Interval  int // in ms
+   Discrete  bool
+   Recording string `json:",omitempty"` // current file
+   Segment   int    `json:",omitempty"`
+   Paused    bool   `json:",omitempty"`
+   Samples   uint64
+   Clients   int
+}
+
+var (
+   // serialises control operations with sampling
+   controlMutex sync.Mutex
+   started = time.Now()
+   paused bool // samples not recorded
+   spans []Label // open, in order begun
+   spanID int
+   generation int // incremented when events or mode change
+)
+
+func (e *ControlError) Error() string {
+   return e.Message
+}
+
+func invalid(format string, args ...interface{}) error {
+   return &ControlError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+   return &ControlError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...interface{}) error {
+   return &ControlError{http.StatusConflict, fmt.Sprintf(format, args...)}
+}
+
+// notifies web clients of enabled events, interval and mode; called with controlMutex held
+func changed() {
+   generation++
+   msg := changeMessage()
+
+   for _, c := range clients() {
+      writeChange(c, msg)
+   }
+}
+
+// sampling interval, which may change through the API or control socket
+func currentInterval() time.Duration {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   return time.Duration(*interval) * time.Millisecond
+}
+
+func controlSensors() []SensorStatus {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   var sensors []SensorStatus
+
+   for _, sensor := range present {
+      s := SensorStatus{Name: sensor.Name(), Sources: sensor.Sources(), Rate: sensor.Rate()}
+
+      for _, event := range sensor.Events() {
+         s.Events = append(s.Events, EventStatus{event.mnemonic, event.desc, event.kind.String(), event.unit, event.enabled})
+      }
+
+      sensors = append(sensors, s)
+   }
+
+   return sensors
+}
+
+func controlStatus() Status {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   hostname, _ := os.Hostname()
+   metrics.mutex.Lock()
+   samples := metrics.samples
+   metrics.mutex.Unlock()
+
+   status := Status{
+      Version: version,
+      Mode: mode,
+      Hostname: hostname,
+      Started: started,
+      Interval: *interval,
+      Discrete: *discrete,
+      Samples: samples,
+      Clients: clientCount(),
+   }
+
+   if output != nil {
+      status.Recording = fileName
+      status.Segment = segment
+      status.Paused = paused
+   }
+
+   return status
+}
+
+// enables or disables events by mnemonic or description, or 'all'
+func controlEvents(names []string, enabled bool) error {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   if output != nil {
+      return conflict("events can't change while recording to %s", fileName)
+   }
+
+   // check all before changing any
+   for _, name := range names {
+      found := name == "all"
+
+      for _, sensor := range present {
+         for _, event := range sensor.Events() {
+            found = found || event.mnemonic == name || event.desc == name
+         }
+      }
+
+      if !found {
+         return notFound("unknown event '%s'", name)
+      }
+   }
+
+   for _, sensor := range present {
+      events := sensor.Events()
+      sensor.Lock()
+
+      for i := range events {
+         for _, name := range names {
+            if name == "all" || events[i].mnemonic == name || events[i].desc == name {
+               events[i].enabled = enabled
+            }
+         }
+      }
+
+      sensor.Enable(*discrete)
+      sensor.Unlock()
+
+      // discard values to initialise last
+      sensor.Sample()
+   }
+
+   changed()
+   return nil
+}
+
+func controlInterval(ms int) error {
+   if ms < 1 || ms > 60000 {
+      return invalid("interval %dms not between 1ms and 60000ms", ms)
+   }
+
+   // clients aren't notified, as that clears their graphs
+   controlMutex.Lock()
+   *interval = ms
+   controlMutex.Unlock()
+
+   return nil
+}
+
+func controlDiscrete(enabled bool) error {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   if output != nil && enabled != *discrete {
+      return conflict("discrete mode can't change while recording to %s", fileName)
+   }
+
+   *discrete = enabled
+   Activate()
+
+   changed()
+   return nil
+}
+
+// records label, notifying clients; called with controlMutex held
+func annotate(label Label) (Label, error) {
+   label.Timestamp = time.Now().UnixNano() / 1e3
+
+   if output != nil {
+      // label starts new segment
+      if label.Kind == "" && rotatePattern != nil && rotatePattern.MatchString(label.Text) {
+         previous = path.Base(fileName)
+         segment++
+
+         err := fileOpen()
+         if err != nil {
+            return label, err
+         }
+      }
+
+      err := output.Label(label)
+      if err != nil {
+         return label, err
+      }
+   }
+
+   if mode == "stat" {
+      fmt.Printf("- %s -\n", label)
+   }
+
+   broadcastLabel(label)
+   return label, nil
+}
+
+// returns timestamp of label
+func controlLabel(text string, attrs map[string]string) (int64, error) {
+   if text == "" {
+      return 0, invalid("empty label")
+   }
+
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   label, err := annotate(Label{Text: text, Attrs: attrs})
+   return label.Timestamp, err
+}
+
+// starts a span, which may be nested or overlap others
+func controlBegin(name string, attrs map[string]string) (Label, error) {
+   if name == "" {
+      return Label{}, invalid("empty span name")
+   }
+
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   spanID++
+   label, err := annotate(Label{Text: name, Kind: spanBegin, Span: strconv.Itoa(spanID), Attrs: attrs})
+   if err == nil {
+      spans = append(spans, label)
+   }
+
+   return label, err
+}
+
+// ends span by ID, or the last begun with name
+func controlEnd(ref string, attrs map[string]string) (Label, error) {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   for i := len(spans)-1; i >= 0; i-- {
+      if spans[i].Span != ref && spans[i].Text != ref {
+         continue
+      }
+
+      label, err := annotate(Label{Text: spans[i].Text, Kind: spanEnd, Span: spans[i].Span, Attrs: attrs})
+      if err == nil {
+         spans = append(spans[:i], spans[i+1:]...)
+      }
+
+      return label, err
+   }
+
+   return Label{}, notFound("no open span '%s'", ref)
+}
+
+// directory clients record to
+func recordingDir() string {
+   if *recordDir != "" {
+      return *recordDir
+   }
+
+   return filepath.Dir(*recordFile)
+}
+
+// starts recording to name, or switches to it if already recording; clients
+// only name the file, so can't have it written elsewhere
+func controlRecord(name string) error {
+   if name == "" {
+      return invalid("empty filename")
+   }
+
+   if strings.ContainsRune(name, os.PathSeparator) || name == "." || name == ".." {
+      return invalid("filename '%s' may not contain a directory, as recordings are in %s", name, recordingDir())
+   }
+
+   if player != nil {
+      return conflict("can't record when replaying")
+   }
+
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   saved := *recordFile
+   *recordFile = filepath.Join(recordingDir(), name)
+   previous = ""
+   segment = 0
+
+   err := fileOpen()
+   if err != nil {
+      *recordFile = saved
+      return err
+   }
+
+   paused = false
+   return nil
+}
+
+func controlStop() error {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   if output == nil {
+      return conflict("not recording")
+   }
+
+   fileStop()
+   paused = false
+   return nil
+}
+
+// suspends or resumes writing samples to the recording
+func controlPause(enabled bool) error {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   if output == nil {
+      return conflict("not recording")
+   }
+
+   paused = enabled
+   return nil
+}
+
+func controlRotate() error {
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
+
+   return controlRotateLocked()
+}
+
+func controlRotateLocked() error {
+   if output == nil {
+      return conflict("not recording")
+   }
+
+   saved := previous
+   previous = path.Base(fileName)
+   segment++
+
+   err := fileOpen()
+   if err != nil {
+      previous = saved
+      segment--
+   }
+
+   return err
+}
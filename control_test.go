@@ -0,0 +1,282 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "fmt"
+   "io/ioutil"
+   "net"
+   "net/http/httptest"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+
+   "golang.org/x/sys/unix"
+)
+
+func TestControlAPI(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   rec := testRecording(1)
+   savedPresent, savedFile := present, *recordFile
+   defer func() { present, *recordFile = savedPresent, savedFile }()
+
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+
+   auth, err = NewAuthenticator("none", "", "", "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   call := func(method, endpoint, body string) *httptest.ResponseRecorder {
+      w := httptest.NewRecorder()
+      r := httptest.NewRequest(method, endpoint, strings.NewReader(body))
+      r.Header.Set("Authorization", "Bearer "+auth.generatedToken(roleControl))
+      api(w, r)
+      return w
+   }
+
+   if w := call("GET", "/api/status", ""); w.Code != 200 || !strings.Contains(w.Body.String(), `"Interval"`) {
+      t.Errorf("unexpected status %d %s", w.Code, w.Body.String())
+   }
+
+   if w := call("POST", "/api/events", `{"Enable": ["reads", "missing"]}`); w.Code != 404 || present[0].Events()[0].enabled {
+      t.Errorf("expected unknown event to fail without change, got %d", w.Code)
+   }
+
+   if w := call("POST", "/api/events", `{"Enable": ["reads"]}`); w.Code != 200 || !present[0].Events()[0].enabled {
+      t.Errorf("failed enabling event: %d %s", w.Code, w.Body.String())
+   }
+
+   if w := call("PUT", "/api/interval", `{"Interval": 0}`); w.Code != 400 {
+      t.Errorf("expected invalid interval to fail, got %d", w.Code)
+   }
+
+   if w := call("GET", "/api/labels", ""); w.Code != 405 || w.Header().Get("Allow") != "POST" {
+      t.Errorf("expected method not allowed, got %d", w.Code)
+   }
+
+   // only named, so root can't be made to write elsewhere
+   if w := call("POST", "/api/recording", `{"File": "/etc/numascope.json"}`); w.Code != 400 {
+      t.Errorf("expected path to be refused, got %d", w.Code)
+   }
+
+   *recordFile = filepath.Join(dir, "output.json")
+   name := filepath.Join(dir, "api.jsonl")
+   if w := call("POST", "/api/recording", `{"File": "api.jsonl"}`); w.Code != 200 || !strings.Contains(w.Body.String(), name) {
+      t.Fatalf("failed starting recording: %d %s", w.Code, w.Body.String())
+   }
+
+   if w := call("POST", "/api/labels", `{"Label": "phase 2"}`); w.Code != 200 {
+      t.Errorf("failed labelling: %d %s", w.Code, w.Body.String())
+   }
+
+   if w := call("POST", "/api/events", `{"Disable": ["all"]}`); w.Code != 409 {
+      t.Errorf("expected conflict changing events while recording, got %d", w.Code)
+   }
+
+   if w := call("DELETE", "/api/recording", ""); w.Code != 200 || strings.Contains(w.Body.String(), name) {
+      t.Errorf("failed stopping recording: %d %s", w.Code, w.Body.String())
+   }
+
+   loaded, err := loadRecording(name)
+   if err != nil || len(loaded.Labels) != 1 || loaded.Labels[0].Text != "phase 2" {
+      t.Errorf("unexpected recording %+v: %v", loaded, err)
+   }
+}
+
+// run with -race: sampling loops and clients read state that control operations change
+func TestControlConcurrent(t *testing.T) {
+   rec := testRecording(1)
+   savedPresent, savedInterval, savedDiscrete := present, *interval, *discrete
+   defer func() { present, *interval, *discrete = savedPresent, savedInterval, savedDiscrete }()
+
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+   p := NewPlayer(rec)
+   p.loop = true
+   done := make(chan struct{})
+
+   go func() {
+      defer close(done)
+
+      for i := 0; i < 100; i++ {
+         validate(controlInterval(i % 10 + 1))
+         validate(controlDiscrete(i % 2 == 0))
+         validate(controlEvents([]string{"reads"}, i % 3 != 0))
+      }
+   }()
+
+   for {
+      select {
+      case <-done:
+         return
+      default:
+      }
+
+      if currentInterval() <= 0 {
+         t.Fatal("unexpected interval")
+      }
+
+      controlMutex.Lock()
+      msg := changeMessage()
+      controlMutex.Unlock()
+
+      if len(msg.Enabled) != 1 {
+         t.Fatalf("unexpected change %+v", msg)
+      }
+
+      p.step(false, currentInterval())
+      validate(metrics.Write(ioutil.Discard))
+   }
+}
+
+func TestControlSocket(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   rec := testRecording(1)
+   savedPresent, savedFile, savedInterval := present, *recordFile, *interval
+   defer func() { present, *recordFile, *interval = savedPresent, savedFile, savedInterval }()
+
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+
+   name := filepath.Join(dir, "ctl.sock")
+   listener := listenControl(name)
+   defer listener.Close()
+
+   info, err := os.Stat(name)
+   if err != nil || info.Mode().Perm() != 0600 {
+      t.Fatalf("unexpected socket %v: %v", info, err)
+   }
+
+   conn, err := net.Dial("unix", name)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer conn.Close()
+
+   replies := bufio.NewScanner(conn)
+   file := filepath.Join(dir, "ctl.jsonl")
+   *recordFile = filepath.Join(dir, "output.json")
+
+   // replies are in order of commands sent together
+   commands := []struct {
+      command, reply string
+   }{
+      {"enable missing", "ERR unknown event 'missing'"},
+      {"enable reads", "OK"},
+      {"interval 50ms", "OK"},
+      {"frobnicate", "ERR unknown command 'frobnicate'"},
+      {"pause", "ERR not recording"},
+      {"record ../ctl.jsonl", "ERR filename '../ctl.jsonl' may not contain a directory"},
+      {"record ctl.jsonl", "OK"},
+      {"pause", "OK"},
+      {"status", `OK {"Version"`},
+      {"resume", "OK"},
+      {"label phase 2", "OK "},
+      {"stop", "OK"},
+   }
+
+   for _, c := range commands {
+      fmt.Fprintln(conn, c.command)
+   }
+
+   for _, c := range commands {
+      if !replies.Scan() {
+         t.Fatalf("no reply to '%s'", c.command)
+      }
+
+      reply := replies.Text()
+      if !strings.HasPrefix(reply, c.reply) || (c.reply == "OK" && reply != "OK") {
+         t.Errorf("'%s' replied '%s', expected '%s'", c.command, reply, c.reply)
+      }
+
+      if c.command == "status" && !strings.Contains(reply, `"Paused":true`) {
+         t.Errorf("status not paused: %s", reply)
+      }
+   }
+
+   if *interval != 50 || !present[0].Events()[0].enabled {
+      t.Errorf("commands not applied, interval %dms", *interval)
+   }
+
+   loaded, err := loadRecording(file)
+   if err != nil || len(loaded.Labels) != 1 || loaded.Labels[0].Text != "phase 2" {
+      t.Errorf("unexpected recording %+v: %v", loaded, err)
+   }
+}
+
+// any user may write to the FIFO, so only labels are performed
+func TestFifo(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   rec := testRecording(1)
+   savedPresent, savedFile, savedFifo := present, *recordFile, fifo
+   defer func() { present, *recordFile, fifo = savedPresent, savedFile, savedFifo }()
+
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+   *recordFile = filepath.Join(dir, "output.json")
+
+   var fds [2]int
+   err = unix.Pipe2(fds[:], unix.O_NONBLOCK)
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer unix.Close(fds[0])
+   defer unix.Close(fds[1])
+   fifo = fds[0]
+
+   err = controlRecord("fifo.jsonl")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   unix.Write(fds[1], []byte("stop\nlabel from rank 3\nrecord other.jsonl\n"))
+   pollFifo(make([]byte, 256))
+
+   controlMutex.Lock()
+   name := fileName
+   fileStop()
+   controlMutex.Unlock()
+
+   loaded, err := loadRecording(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(loaded.Labels) != 1 || loaded.Labels[0].Text != "from rank 3" || !strings.HasSuffix(name, "fifo.jsonl") {
+      t.Errorf("unexpected labels %+v in %s", loaded.Labels, name)
+   }
+
+   if _, err := os.Stat(filepath.Join(dir, "other.jsonl")); err == nil {
+      t.Error("recording started from FIFO")
+   }
+}
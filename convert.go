@@ -0,0 +1,237 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "encoding/csv"
+   "fmt"
+   "io"
+   "os"
+   "regexp"
+   "strconv"
+)
+
+// a row per sample or label, for spreadsheets
+type csvWriter struct {
+   w        *csv.Writer
+   nColumns int
+}
+
+// as described by Label.String
+var spanLabel = regexp.MustCompile(`^(begin|end) (.*) #(\S+)$`)
+
+// checks for the heading row
+func isCSV(reader *bufio.Reader) bool {
+   heading, err := reader.Peek(len("timestamp,"))
+   return err == nil && string(heading) == "timestamp,"
+}
+
+func parseLabel(timestamp int64, s string) Label {
+   text, attrs := parseAttrs(s)
+   label := Label{Timestamp: timestamp, Text: text, Attrs: attrs}
+
+   if m := spanLabel.FindStringSubmatch(text); m != nil {
+      label.Kind, label.Text, label.Span = m[1], m[2], m[3]
+   }
+
+   return label
+}
+
+// reads rows written by csvWriter; as the sensors and kinds of events are
+// lost, the columns are read as counters of one sensor
+func readCSV(reader *bufio.Reader) (*Recording, error) {
+   r := csv.NewReader(reader)
+
+   heading, err := r.Read()
+   if err != nil {
+      return nil, err
+   }
+
+   if len(heading) < 2 || heading[len(heading)-1] != "label" {
+      return nil, fmt.Errorf("CSV heading lacks label column")
+   }
+
+   headings := heading[1:len(heading)-1]
+   rec := &Recording{Header: Header{
+      Format: formatVersion,
+      Sensors: []SensorHeader{{Name: "CSV", Sources: 1, Headings: headings}},
+   }}
+
+   for {
+      row, err := r.Read()
+      if err == io.EOF {
+         break
+      }
+
+      if err != nil {
+         return nil, err
+      }
+
+      timestamp, err := strconv.ParseInt(row[0], 10, 64)
+      if err != nil {
+         return nil, err
+      }
+
+      // labels have empty values
+      if text := row[len(row)-1]; text != "" {
+         rec.Labels = append(rec.Labels, parseLabel(timestamp, text))
+         continue
+      }
+
+      values := make([]int64, len(headings))
+      for i := range values {
+         values[i], err = strconv.ParseInt(row[i+1], 10, 64)
+         if err != nil {
+            return nil, err
+         }
+      }
+
+      rec.Samples = append(rec.Samples, Sample{timestamp, values})
+   }
+
+   return rec, nil
+}
+
+func newCSVWriter(w io.Writer) *csvWriter {
+   return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) Header(h Header) error {
+   headings, _ := h.Headings()
+   c.nColumns = len(headings)
+
+   row := append([]string{"timestamp"}, headings...)
+   return c.w.Write(append(row, "label"))
+}
+
+func (c *csvWriter) Sample(timestamp int64, values []int64) error {
+   row := make([]string, 0, len(values) + 2)
+   row = append(row, strconv.FormatInt(timestamp, 10))
+
+   for _, val := range values {
+      row = append(row, strconv.FormatInt(val, 10))
+   }
+
+   return c.w.Write(append(row, ""))
+}
+
+func (c *csvWriter) Label(label Label) error {
+   row := make([]string, c.nColumns + 2)
+   row[0] = strconv.FormatInt(label.Timestamp, 10)
+   row[len(row)-1] = label.String()
+
+   return c.w.Write(row)
+}
+
+func (c *csvWriter) Close() error {
+   c.w.Flush()
+   return c.w.Error()
+}
+
+// writes recording in timestamp order
+func writeRecording(rec *Recording, w TraceWriter) error {
+   header := rec.Header
+   header.Format = formatVersion
+
+   err := w.Header(header)
+   if err != nil {
+      return err
+   }
+
+   labels := rec.Labels
+
+   for _, sample := range rec.Samples {
+      for len(labels) > 0 && labels[0].Timestamp <= sample.Timestamp {
+         err = w.Label(labels[0])
+         if err != nil {
+            return err
+         }
+
+         labels = labels[1:]
+      }
+
+      err = w.Sample(sample.Timestamp, sample.Values)
+      if err != nil {
+         return err
+      }
+   }
+
+   for _, label := range labels {
+      err = w.Label(label)
+      if err != nil {
+         return err
+      }
+   }
+
+   return w.Close()
+}
+
+// writes recording in format and compression of name
+func saveRecording(rec *Recording, name string) error {
+   flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+   if !*overwrite {
+      flags |= os.O_EXCL
+   }
+
+   f, err := os.OpenFile(name, flags, 0444)
+   if err != nil {
+      return err
+   }
+   defer f.Close()
+
+   w, err := newCompressedWriter(name, f)
+   if err != nil {
+      return err
+   }
+
+   err = writeRecording(rec, newTraceWriter(name, w))
+   if err != nil {
+      return err
+   }
+
+   if c, ok := w.(*compressedWriter); ok {
+      err = c.Close()
+      if err != nil {
+         return err
+      }
+   }
+
+   return f.Close()
+}
+
+// converts between recording formats, selected by extension or -format
+func convert(args []string) {
+   if len(args) != 2 {
+      fmt.Println("syntax: convert <input> <output>")
+      os.Exit(1)
+   }
+
+   rec, err := loadRecording(args[0])
+   validate(err)
+
+   if *selection != "" {
+      rec, err = selectRecording(rec, *selection)
+      validate(err)
+   }
+
+   err = saveRecording(rec, args[1])
+   validate(err)
+
+   fmt.Printf("converted %d samples and %d labels to %s\n", len(rec.Samples), len(rec.Labels), args[1])
+}
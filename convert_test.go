@@ -0,0 +1,55 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "strings"
+   "testing"
+)
+
+func TestRecordingCSVLabels(t *testing.T) {
+   rec := testRecording(1)
+   rec.Labels = []Label{
+      {Timestamp: 1000000, Text: "solve", Kind: spanBegin, Span: "1", Attrs: map[string]string{"n": "4096"}},
+      {Timestamp: 3000000, Text: "phase 1, with comma"},
+      {Timestamp: 5000000, Text: "solve", Kind: spanEnd, Span: "1"},
+   }
+
+   var buf strings.Builder
+   err := writeRecording(rec, newCSVWriter(&buf))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   out, err := readRecording(strings.NewReader(buf.String()))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if fmt.Sprint(out.Labels) != fmt.Sprint(rec.Labels) || len(out.Samples) != len(rec.Samples) {
+      t.Errorf("unexpected labels %+v", out.Labels)
+   }
+
+   for _, corrupt := range []string{"timestamp,reads\n1,2\n", "timestamp,reads,label\n1,x,\n", "timestamp,reads,label\n1,2\n"} {
+      _, err = readRecording(strings.NewReader(corrupt))
+      if err == nil {
+         t.Errorf("corrupt CSV %q read", corrupt)
+      }
+   }
+}
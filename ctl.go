@@ -0,0 +1,274 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/json"
+   "fmt"
+   "io"
+   "net"
+   "os"
+   "os/user"
+   "strconv"
+   "strings"
+
+   "golang.org/x/sys/unix"
+)
+
+const ctlUsage = "status, enable <event>.., disable <event>.., interval <n>[ms], discrete on|off, label <text> [key=value].., begin <name> [key=value].., end <span|name> [key=value].., record <filename>, stop, rotate, pause, resume"
+
+// parses interval in ms, with optional suffix
+func parseInterval(input string) (int, error) {
+   ms, err := strconv.Atoi(strings.TrimSuffix(input, "ms"))
+   if err != nil {
+      return 0, invalid("unknown interval '%s'", input)
+   }
+
+   return ms, nil
+}
+
+// performs one control command, returning any reply text
+func controlCommand(line string) (string, error) {
+   fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+   arg := ""
+   if len(fields) == 2 {
+      arg = strings.TrimSpace(fields[1])
+   }
+
+   // check arguments are given only where needed
+   switch fields[0] {
+   case "status", "stop", "rotate", "pause", "resume", "help":
+      if arg != "" {
+         return "", invalid("syntax: %s", fields[0])
+      }
+   case "enable", "disable", "interval", "discrete", "label", "begin", "end", "record":
+      if arg == "" {
+         return "", invalid("syntax: %s <argument>", fields[0])
+      }
+   }
+
+   switch fields[0] {
+   case "status":
+      status, err := json.Marshal(controlStatus())
+      return string(status), err
+   case "enable", "disable":
+      names := strings.FieldsFunc(arg, func(r rune) bool {
+         return r == ',' || r == ' '
+      })
+
+      return "", controlEvents(names, fields[0] == "enable")
+   case "interval":
+      ms, err := parseInterval(arg)
+      if err == nil {
+         err = controlInterval(ms)
+      }
+
+      return "", err
+   case "discrete":
+      if arg != "on" && arg != "off" {
+         return "", invalid("syntax: discrete on|off")
+      }
+
+      return "", controlDiscrete(arg == "on")
+   case "label":
+      timestamp, err := controlLabel(parseAttrs(arg))
+      return strconv.FormatInt(timestamp, 10), err
+   case "begin":
+      label, err := controlBegin(parseAttrs(arg))
+      return label.Span, err
+   case "end":
+      _, err := controlEnd(parseAttrs(arg))
+      return "", err
+   case "record":
+      return "", controlRecord(arg)
+   case "stop":
+      return "", controlStop()
+   case "rotate":
+      return "", controlRotate()
+   case "pause":
+      return "", controlPause(true)
+   case "resume":
+      return "", controlPause(false)
+   case "help":
+      return ctlUsage, nil
+   }
+
+   return "", notFound("unknown command '%s'", fields[0])
+}
+
+// replies to each command on a connection in order
+func converse(conn io.ReadWriteCloser) {
+   defer conn.Close()
+   scanner := bufio.NewScanner(conn)
+
+   for scanner.Scan() {
+      line := strings.TrimSpace(scanner.Text())
+      if line == "" {
+         continue
+      }
+
+      reply, err := controlCommand(line)
+      if err != nil {
+         reply = "ERR " + strings.Replace(err.Error(), "\n", " ", -1)
+      } else if reply != "" {
+         reply = "OK " + reply
+      } else {
+         reply = "OK"
+      }
+
+      if *debug {
+         fmt.Printf("control '%s': %s\n", line, reply)
+      }
+
+      _, err = fmt.Fprintln(conn, reply)
+      if err != nil {
+         return
+      }
+   }
+}
+
+func serveControl(listener net.Listener) {
+   for {
+      conn, err := listener.Accept()
+      if err != nil {
+         if *debug {
+            fmt.Println("failed accepting:", err)
+         }
+         return
+      }
+
+      go converse(conn)
+   }
+}
+
+// listens on socket path, with access controlled by its permissions
+func listenControl(name string) net.Listener {
+   // any previous instance has exited
+   os.Remove(name)
+
+   // no access until permissions are set
+   umask := unix.Umask(0177)
+   listener, err := net.Listen("unix", name)
+   unix.Umask(umask)
+   validate(err)
+
+   restrict(name)
+
+   go serveControl(listener)
+   return listener
+}
+
+// applies control socket permissions and group to name
+func restrict(name string) {
+   perm, err := strconv.ParseUint(*socketMode, 8, 32)
+   validate(err)
+
+   err = os.Chmod(name, os.FileMode(perm))
+   validate(err)
+
+   if *socketGroup != "" {
+      group, err := user.LookupGroup(*socketGroup)
+      validate(err)
+
+      gid, err := strconv.Atoi(group.Gid)
+      validate(err)
+
+      err = os.Chown(name, -1, gid)
+      validate(err)
+   }
+}
+
+// adds labels written to the FIFO, without replies; as any user may write
+// to it, other commands are only accepted on the control socket
+func pollFifo(buf []byte) {
+   if fifo < 0 {
+      return
+   }
+
+   n, err := unix.Read(fifo, buf)
+   validateNonblock(err)
+
+   if n <= 0 {
+      return
+   }
+
+   for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+      line = bytes.TrimSpace(line)
+      if len(line) == 0 {
+         continue
+      }
+
+      if !bytes.HasPrefix(line, []byte("label ")) {
+         fmt.Printf("ignoring '%s' from %s; only labels are accepted there\n", line, fifoPath)
+         continue
+      }
+
+      reply, err := controlCommand(string(line))
+      if err != nil {
+         fmt.Println(err)
+      } else if *debug {
+         fmt.Println(reply)
+      }
+   }
+}
+
+// sends command arguments, or each line of stdin, returning on the first failure
+func ctl(args []string) {
+   conn, err := net.Dial("unix", *socketPath)
+   validate(err)
+   defer conn.Close()
+
+   var commands []string
+   if len(args) > 0 {
+      commands = []string{strings.Join(args, " ")}
+   } else {
+      input := bufio.NewScanner(os.Stdin)
+      for input.Scan() {
+         commands = append(commands, input.Text())
+      }
+   }
+
+   replies := bufio.NewScanner(conn)
+
+   for _, command := range commands {
+      if strings.TrimSpace(command) == "" {
+         continue
+      }
+
+      _, err = fmt.Fprintln(conn, command)
+      validate(err)
+
+      if !replies.Scan() {
+         fmt.Println("connection closed")
+         os.Exit(1)
+      }
+
+      reply := replies.Text()
+
+      switch {
+      case reply == "OK":
+      case strings.HasPrefix(reply, "OK "):
+         fmt.Println(reply[3:])
+      default:
+         fmt.Fprintln(os.Stderr, strings.TrimPrefix(reply, "ERR "))
+         os.Exit(1)
+      }
+   }
+}
@@ -0,0 +1,455 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/csv"
+   "encoding/json"
+   "fmt"
+   "io"
+   "math"
+   "os"
+   "strconv"
+   "text/tabwriter"
+)
+
+// change of a series between two recordings over aligned phases
+type Difference struct {
+   Phase       string
+   Name        string
+   Mnemonic    string
+   Kind        string
+   Unit        string
+   TotalA      float64
+   TotalB      float64
+   TotalDelta  float64
+   TotalChange *float64 `json:",omitempty"` // relative, absent when A is zero
+   MeanA       float64
+   MeanB       float64
+   MeanDelta   float64
+   MeanChange  *float64 `json:",omitempty"`
+   T           float64 // Welch's t statistic of per-interval values
+   Significant bool    // at 95% confidence
+   source      int     // -1 for whole events, summed or single-source
+}
+
+type Comparison struct {
+   Align       string
+   Notes       []string // what could not be compared
+   Differences []Difference
+}
+
+// phase of each recording covering the same part of the workload
+type alignedPhase struct {
+   name string
+   a, b Phase
+}
+
+// the whole of each recording, optionally truncated to the shorter duration, plus phases with matching labels
+func alignPhases(a, b *Recording, align string) ([]alignedPhase, []string, error) {
+   all := Phase{Name: "all", Start: math.MinInt64, End: math.MaxInt64}
+   var notes []string
+
+   switch align {
+   case "start":
+      if len(a.Samples) == 0 || len(b.Samples) == 0 {
+         return []alignedPhase{{"all", all, all}}, nil, nil
+      }
+
+      startA, startB := a.Samples[0].Timestamp, b.Samples[0].Timestamp
+      duration := a.Samples[len(a.Samples)-1].Timestamp - startA
+      if d := b.Samples[len(b.Samples)-1].Timestamp - startB; d < duration {
+         duration = d
+      }
+
+      return []alignedPhase{{"all", Phase{Name: "all", Start: startA, End: startA + duration + 1}, Phase{Name: "all", Start: startB, End: startB + duration + 1}}}, nil, nil
+   case "labels":
+      aligned := []alignedPhase{{"all", all, all}}
+      phasesA, phasesB := phasesOf(a), phasesOf(b)
+
+      // repeated labels are matched by occurrence
+      key := func(phases []Phase, i int) string {
+         n := 0
+         for _, phase := range phases[:i] {
+            if phase.Name == phases[i].Name {
+               n++
+            }
+         }
+
+         if n == 0 {
+            return phases[i].Name
+         }
+
+         return fmt.Sprintf("%s #%d", phases[i].Name, n+1)
+      }
+
+      matched := make(map[string]bool)
+
+      for i := range phasesA {
+         name := key(phasesA, i)
+
+         for j := range phasesB {
+            if key(phasesB, j) == name {
+               aligned = append(aligned, alignedPhase{name, phasesA[i], phasesB[j]})
+               matched[name] = true
+               break
+            }
+         }
+
+         if !matched[name] {
+            notes = append(notes, fmt.Sprintf("phase '%s' only in first recording", name))
+         }
+      }
+
+      for j := range phasesB {
+         if name := key(phasesB, j); !matched[name] {
+            notes = append(notes, fmt.Sprintf("phase '%s' only in second recording", name))
+         }
+      }
+
+      return aligned, notes, nil
+   }
+
+   return nil, nil, fmt.Errorf("unknown alignment '%s'", align)
+}
+
+func valuesIn(rec *Recording, s *Series, phase Phase) []float64 {
+   var values []float64
+
+   // first sample covers an unknown interval
+   for i := 1; i < len(rec.Samples); i++ {
+      ts := rec.Samples[i].Timestamp
+      if ts >= phase.Start && ts < phase.End {
+         values = append(values, s.Values[i])
+      }
+   }
+
+   return values
+}
+
+func meanVariance(values []float64) (mean, variance float64) {
+   for _, val := range values {
+      mean += val
+   }
+   mean /= float64(len(values))
+
+   for _, val := range values {
+      variance += (val - mean) * (val - mean)
+   }
+   variance /= float64(len(values) - 1)
+
+   return
+}
+
+// two-sided Welch's t-test at 95% confidence
+func welch(a, b []float64) (t float64, significant bool) {
+   if len(a) < 2 || len(b) < 2 {
+      return 0, false
+   }
+
+   meanA, varA := meanVariance(a)
+   meanB, varB := meanVariance(b)
+   va, vb := varA / float64(len(a)), varB / float64(len(b))
+
+   if va + vb == 0 {
+      if meanA == meanB {
+         return 0, false
+      }
+
+      return math.Copysign(math.Inf(1), meanB - meanA), true
+   }
+
+   t = (meanB - meanA) / math.Sqrt(va + vb)
+
+   // Welch-Satterthwaite degrees of freedom
+   df := (va + vb) * (va + vb) / (va * va / float64(len(a) - 1) + vb * vb / float64(len(b) - 1))
+
+   // Cornish-Fisher expansion of the t quantile from the normal quantile
+   const z = 1.959964
+   critical := z + (z * z * z + z) / (4 * df) + (5 * math.Pow(z, 5) + 16 * z * z * z + 3 * z) / (96 * df * df)
+
+   return t, math.Abs(t) > critical
+}
+
+func relative(a, b float64) *float64 {
+   if a == 0 {
+      return nil
+   }
+
+   change := (b - a) / math.Abs(a)
+   return &change
+}
+
+// notes sensors and events which cannot be compared
+func compatibility(a, b *Recording) []string {
+   var notes []string
+
+   sensorsB := make(map[string]*SensorHeader)
+   for i := range b.Header.Sensors {
+      sensorsB[b.Header.Sensors[i].Name] = &b.Header.Sensors[i]
+   }
+
+   for i := range a.Header.Sensors {
+      sa := &a.Header.Sensors[i]
+      sb, ok := sensorsB[sa.Name]
+      if !ok {
+         notes = append(notes, fmt.Sprintf("sensor %s only in first recording", sa.Name))
+         continue
+      }
+
+      delete(sensorsB, sa.Name)
+
+      if sa.Sources != sb.Sources {
+         notes = append(notes, fmt.Sprintf("sensor %s has %d sources in first and %d in second recording; only common sources and totals are compared", sa.Name, sa.Sources, sb.Sources))
+      }
+
+      eventsB := make(map[string]bool)
+      for _, event := range sb.Events {
+         eventsB[event.Mnemonic] = true
+      }
+
+      for _, event := range sa.Events {
+         if !eventsB[event.Mnemonic] {
+            notes = append(notes, fmt.Sprintf("event %s only in first recording", event.Mnemonic))
+         }
+
+         delete(eventsB, event.Mnemonic)
+      }
+
+      for _, event := range sb.Events {
+         if eventsB[event.Mnemonic] {
+            notes = append(notes, fmt.Sprintf("event %s only in second recording", event.Mnemonic))
+         }
+      }
+   }
+
+   for _, sensor := range b.Header.Sensors {
+      if _, ok := sensorsB[sensor.Name]; ok {
+         notes = append(notes, fmt.Sprintf("sensor %s only in second recording", sensor.Name))
+      }
+   }
+
+   if a.Header.Interval != b.Header.Interval {
+      notes = append(notes, fmt.Sprintf("sample interval %dms in first and %dms in second recording", a.Header.Interval, b.Header.Interval))
+   }
+
+   return notes
+}
+
+// appends differences of series with the same name over each phase
+func differ(cmp *Comparison, a, b *Recording, phases []alignedPhase) {
+   seriesA, seriesB := seriesOf(a), seriesOf(b)
+
+   byName := make(map[string]*Series)
+   for i := range seriesB {
+      byName[seriesB[i].Name] = &seriesB[i]
+   }
+
+   for _, phase := range phases {
+      for i := range seriesA {
+         sa := &seriesA[i]
+         sb, ok := byName[sa.Name]
+         if !ok {
+            continue
+         }
+
+         inf := math.Inf(1)
+         stA := summarise(a, sa, phase.a, inf)
+         stB := summarise(b, sb, phase.b, inf)
+
+         d := Difference{
+            Phase: phase.name,
+            Name: sa.Name,
+            Mnemonic: sa.Event.Mnemonic,
+            source: sa.Source,
+            Kind: sa.Event.Kind,
+            Unit: sa.Event.Unit,
+            TotalA: stA.Total,
+            TotalB: stB.Total,
+            TotalDelta: stB.Total - stA.Total,
+            TotalChange: relative(stA.Total, stB.Total),
+            MeanA: stA.Mean,
+            MeanB: stB.Mean,
+            MeanDelta: stB.Mean - stA.Mean,
+            MeanChange: relative(stA.Mean, stB.Mean),
+         }
+
+         d.T, d.Significant = welch(valuesIn(a, sa, phase.a), valuesIn(b, sb, phase.b))
+         if math.IsInf(d.T, 0) {
+            // unencodable in JSON
+            d.T = math.Copysign(math.MaxFloat64, d.T)
+         }
+
+         cmp.Differences = append(cmp.Differences, d)
+      }
+   }
+}
+
+// compares series with the same name over aligned phases, or only those matching any selection
+func compare(a, b *Recording, align string, selection string) (*Comparison, error) {
+   var err error
+
+   // whole recordings are aligned, so select their data first
+   if selection != "" && align == "start" {
+      a, err = selectRecording(a, selection)
+      if err == nil {
+         b, err = selectRecording(b, selection)
+      }
+      if err != nil {
+         return nil, err
+      }
+   }
+
+   phases, notes, err := alignPhases(a, b, align)
+   if err != nil {
+      return nil, err
+   }
+
+   cmp := &Comparison{Align: align, Notes: append(compatibility(a, b), notes...)}
+
+   if selection != "" && align != "start" {
+      var selected []alignedPhase
+      for _, phase := range phases {
+         if phase.name != "all" && phase.a.Matches(selection) {
+            selected = append(selected, phase)
+         }
+      }
+
+      if len(selected) == 0 {
+         return nil, fmt.Errorf("no aligned spans or labels match '%s'", selection)
+      }
+
+      // "all" covers only the selected data
+      selA, err := selectRecording(a, selection)
+      if err != nil {
+         return nil, err
+      }
+
+      selB, err := selectRecording(b, selection)
+      if err != nil {
+         return nil, err
+      }
+
+      all := Phase{Name: "all", Start: math.MinInt64, End: math.MaxInt64}
+      differ(cmp, selA, selB, []alignedPhase{{"all", all, all}})
+
+      phases = selected
+   }
+
+   differ(cmp, a, b, phases)
+
+   return cmp, nil
+}
+
+func formatChange(change *float64) string {
+   if change == nil {
+      return "-"
+   }
+
+   return fmt.Sprintf("%+.1f%%", *change * 100)
+}
+
+func writeComparison(w io.Writer, cmp *Comparison, output string) error {
+   switch output {
+   case "json":
+      enc := json.NewEncoder(w)
+      enc.SetIndent("", "   ")
+      return enc.Encode(cmp)
+   case "csv":
+      for _, note := range cmp.Notes {
+         fmt.Fprintln(os.Stderr, note)
+      }
+
+      c := csv.NewWriter(w)
+      c.Write([]string{"phase", "name", "mnemonic", "kind", "unit", "totalA", "totalB", "totalDelta", "totalChange", "meanA", "meanB", "meanDelta", "meanChange", "t", "significant"})
+
+      change := func(val *float64) string {
+         if val == nil {
+            return ""
+         }
+
+         return formatFloat(*val)
+      }
+
+      for _, d := range cmp.Differences {
+         c.Write([]string{d.Phase, d.Name, d.Mnemonic, d.Kind, d.Unit,
+            formatFloat(d.TotalA), formatFloat(d.TotalB), formatFloat(d.TotalDelta), change(d.TotalChange),
+            formatFloat(d.MeanA), formatFloat(d.MeanB), formatFloat(d.MeanDelta), change(d.MeanChange),
+            formatFloat(d.T), strconv.FormatBool(d.Significant)})
+      }
+
+      c.Flush()
+      return c.Error()
+   case "text":
+      for _, note := range cmp.Notes {
+         fmt.Fprintf(w, "note: %s\n", note)
+      }
+
+      tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+      phase := ""
+
+      for _, d := range cmp.Differences {
+         if d.Phase != phase {
+            phase = d.Phase
+            tw.Flush()
+            fmt.Fprintf(w, "\nphase '%s'\n", phase)
+            fmt.Fprintln(tw, "event\ttotal A\ttotal B\tchange\tmean A\tmean B\tchange\t\t")
+         }
+
+         totalA, totalB, totalChange := "-", "-", "-"
+         if d.Kind == Counter.String() {
+            totalA = fmt.Sprintf("%.0f", d.TotalA)
+            totalB = fmt.Sprintf("%.0f", d.TotalB)
+            totalChange = formatChange(d.TotalChange)
+         }
+
+         mark := ""
+         if d.Significant {
+            mark = "*"
+         }
+
+         fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.4g\t%.4g\t%s\t%s\t\n",
+            d.Name, totalA, totalB, totalChange, d.MeanA, d.MeanB, formatChange(d.MeanChange), mark)
+      }
+
+      err := tw.Flush()
+      fmt.Fprintln(w, "\n* significant at 95% confidence")
+      return err
+   }
+
+   return fmt.Errorf("unknown output '%s'", output)
+}
+
+func diff(args []string) {
+   if len(args) != 2 {
+      fmt.Println("syntax: diff <first> <second>")
+      os.Exit(1)
+   }
+
+   a, err := loadRecording(args[0])
+   validate(err)
+
+   b, err := loadRecording(args[1])
+   validate(err)
+
+   cmp, err := compare(a, b, *align, *selection)
+   validate(err)
+
+   err = writeComparison(os.Stdout, cmp, *outputFormat)
+   validate(err)
+}
@@ -0,0 +1,95 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "strings"
+   "testing"
+)
+
+func TestDiff(t *testing.T) {
+   a := testRecording(1)
+   b := testRecording(2)
+   for i := range b.Samples {
+      b.Samples[i].Values[2] += 10
+   }
+
+   cmp, err := compare(a, b, "labels", "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   find := func(cmp *Comparison, phase, name string) *Difference {
+      for i := range cmp.Differences {
+         if cmp.Differences[i].Phase == phase && cmp.Differences[i].Name == name {
+            return &cmp.Differences[i]
+         }
+      }
+
+      return nil
+   }
+
+   d := find(cmp, "all", "reads:0")
+   if d == nil || d.TotalA != 150 || d.TotalB != 300 || d.TotalChange == nil || *d.TotalChange != 1 {
+      t.Errorf("unexpected reads:0 %+v", d)
+   }
+
+   d = find(cmp, "phase 1", "free:0")
+   if d == nil || d.MeanDelta != 10 || !d.Significant {
+      t.Errorf("unexpected free:0 %+v", d)
+   }
+
+   d = find(cmp, "all", "% busy:0")
+   if d == nil || d.MeanChange == nil || *d.MeanChange != 0 || d.Significant {
+      t.Errorf("unexpected busy:0 %+v", d)
+   }
+
+   // fewer sources and an extra event in the second recording
+   c := testRecording(1)
+   sensor := &c.Header.Sensors[0]
+   sensor.Sources = 1
+   sensor.Headings = []string{"reads:0", "free:0", "% busy:0", "misses:0"}
+   sensor.Events = append(sensor.Events, EventHeader{"misses", "misses", "counter", ""})
+   c.Labels = nil
+   for i := range c.Samples {
+      v := c.Samples[i].Values
+      c.Samples[i].Values = []int64{v[0], v[2], v[4], 1}
+   }
+
+   cmp, err = compare(a, c, "start", "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if find(cmp, "all", "reads:1") != nil || find(cmp, "all", "misses") != nil || find(cmp, "all", "reads") == nil {
+      t.Errorf("unexpected series compared %+v", cmp.Differences)
+   }
+
+   if len(cmp.Notes) != 2 {
+      t.Errorf("expected notes on sources and event, got %q", cmp.Notes)
+   }
+
+   for _, output := range []string{"text", "csv", "json"} {
+      var buf bytes.Buffer
+      err = writeComparison(&buf, cmp, output)
+      if err != nil || !strings.Contains(buf.String(), "reads:0") {
+         t.Errorf("%s output failed: %v", output, err)
+      }
+   }
+}
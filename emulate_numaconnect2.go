@@ -0,0 +1,180 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "math/rand"
+   "time"
+)
+
+// models a ring of Numachip2 cards, so the sensor can be exercised without hardware
+type Emulator struct {
+   cards []*EmulatedCard
+   hts   uint32
+   // nil means time advances only via Advance()
+   clock func() time.Time
+}
+
+type EmulatedCard struct {
+   emulator *Emulator
+   pos      uint32
+   next     uint32
+   regs     [mapLen / 4]uint32
+   stats    [statsLen / 8]uint64
+   rates    [statsLen / 8]uint64 // events per 1000 cycles
+   started  time.Time
+}
+
+const (
+   ringEnd     = 0xfff
+   ctrlEnable  = 1 << 0 // clear to reset block
+   ctrlCount   = 1 << 2
+   ringBase    = 0x3f0000000000
+   cycleLength = 5 * time.Nanosecond // 200MHz
+)
+
+// creates a ring of cards counting in real time with random event rates
+func NewEmulator(nCards int) *Emulator {
+   e := &Emulator{hts: 1, clock: time.Now}
+
+   for i := 0; i < nCards; i++ {
+      card := &EmulatedCard{emulator: e, pos: uint32(i), next: uint32(i+1)}
+
+      for j := 1; j < len(card.rates); j++ {
+         card.rates[j] = uint64(rand.Intn(1000))
+      }
+
+      e.cards = append(e.cards, card)
+   }
+
+   e.cards[nCards-1].next = ringEnd
+   return e
+}
+
+func (e *Emulator) Map(base int64) (Registers, error) {
+   // local card
+   if base == mapBase {
+      return e.cards[0], nil
+   }
+
+   pos := uint32(base >> 28) & 0xfff
+   hts := uint32(base >> 15) & 0x1f
+
+   if base & ringBase != ringBase || hts != 23+e.hts {
+      return nil, fmt.Errorf("no card at %#x", base)
+   }
+
+   for _, card := range e.cards {
+      if card.pos == pos {
+         return card, nil
+      }
+   }
+
+   return nil, fmt.Errorf("no card at ring position %#x", pos)
+}
+
+func (e *Emulator) Unmap(regs Registers) error {
+   return nil
+}
+
+// advances all counting cards by cycles
+func (e *Emulator) Advance(cycles uint64) {
+   for _, card := range e.cards {
+      if card.regs[statCtrl] & ctrlCount != 0 {
+         card.advance(cycles)
+      }
+   }
+}
+
+// sets the rate of counter at index in events per 1000 cycles
+func (e *Emulator) SetRate(card int, index int16, rate uint64) {
+   e.cards[card].rates[index] = rate
+}
+
+// presets counter at index, eg to exercise wrapping
+func (e *Emulator) Preset(card int, index int16, val uint64) {
+   e.cards[card].stats[index] = val & wrapLimit
+}
+
+func (c *EmulatedCard) advance(cycles uint64) {
+   c.stats[statElapsed] = (c.stats[statElapsed] + cycles) & wrapLimit
+
+   for i := 1; i < len(c.stats); i++ {
+      c.stats[i] = (c.stats[i] + cycles * c.rates[i] / 1000) & wrapLimit
+   }
+}
+
+// accumulate counts since counting was last enabled
+func (c *EmulatedCard) update() {
+   if c.emulator.clock == nil || c.regs[statCtrl] & ctrlCount == 0 {
+      return
+   }
+
+   now := c.emulator.clock()
+   cycles := uint64(now.Sub(c.started) / cycleLength)
+   c.started = c.started.Add(time.Duration(cycles) * cycleLength)
+   c.advance(cycles)
+}
+
+func (c *EmulatedCard) Read(reg uint) uint32 {
+   switch {
+   case reg == venDev:
+      return venDevId
+   case reg == info+5:
+      return c.emulator.cards[0].pos << 4
+   case reg == info+6:
+      return c.emulator.hts << 12 | c.next
+   case reg >= statCounters && reg < statCounters + statsLen/4:
+      c.update()
+      val := c.stats[(reg-statCounters)/2]
+
+      // little-endian halves
+      if (reg-statCounters) % 2 == 1 {
+         return uint32(val >> 32)
+      }
+
+      return uint32(val)
+   }
+
+   return c.regs[reg]
+}
+
+func (c *EmulatedCard) Write(reg uint, val uint32) {
+   if reg != statCtrl {
+      c.regs[reg] = val
+      return
+   }
+
+   c.update()
+
+   if val & ctrlEnable == 0 {
+      c.stats = [statsLen / 8]uint64{}
+   }
+
+   if val & ctrlCount != 0 && c.regs[statCtrl] & ctrlCount == 0 && c.emulator.clock != nil {
+      c.started = c.emulator.clock()
+   }
+
+   c.regs[statCtrl] = val
+}
+
+func (c *EmulatedCard) Stat(index int16) uint64 {
+   c.update()
+   return c.stats[index]
+}
@@ -18,6 +18,7 @@
 package main
 
 import (
+   "io/ioutil"
    "os"
    "strconv"
    "strings"
@@ -26,7 +27,9 @@ import (
 )
 
 type Kernel struct {
-   events      []Event
+   curated     []Event // descriptions of known fields
+   events      []Event // fields this kernel provides
+   path        string
    file        *os.File
    last        []uint64
    lastElapsed time.Time
@@ -36,138 +39,210 @@ type Kernel struct {
 
 func NewKernel() *Kernel {
    return &Kernel{
-      events: []Event{
+      path: "/proc/vmstat",
+      curated: []Event{
          // include/linux/mmzone.h
-         {-1, "nr_free_pages", "unallocated pages", false},
-         {-1, "nr_zone_inactive_anon", "zone inactive anonymous pages", false},
-         {-1, "nr_zone_active_anon", "zone activate anonymous pages", false},
-         {-1, "nr_zone_inactive_file", "zone inactive file-backed pages", false},
-         {-1, "nr_zone_active_file", "zone active file-backed pages", false},
-         {-1, "nr_zone_unevictable", "zone unevictable pages", false},
-         {-1, "nr_zone_write_pending", "zone write pending pages", false},
-         {-1, "nr_mlock", "locked pages", false},
-         {-1, "nr_page_table_pages", "page table pages", false},
-         {-1, "nr_kernel_stack", "kernel stack kilobytes", false},
-         {-1, "nr_bounce", "low-memory pages allocated for DMA", false},
-         {-1, "nr_free_cma", "free Contig Mem Alloc pages", false},
-         {-1, "numa_hit", "allocated in intended node", false},
-         {-1, "numa_miss", "allocated in non-intended node", false},
-         {-1, "numa_foreign", "was intended here, hit elsewhere", false},
-         {-1, "numa_interleave", "interleaver preferred this zone", false},
-         {-1, "numa_local", "allocation from local node", false},
-         {-1, "numa_other", "allocation from non-local node", false},
-         {-1, "nr_inactive_anon", "inactive anonymous pages", false},
-         {-1, "nr_active_anon", "active anonymous pages", false},
-         {-1, "nr_inactive_file", "inactive file-backed pages", false},
-         {-1, "nr_active_file", "active file-backed pages", false},
-         {-1, "nr_unevictable", "unevictable Pages", false},
-         {-1, "nr_slab_reclaimable", "unused bytes allocated to slab", false},
-         {-1, "nr_slab_unreclaimable", "used bytes allocated to slab", false},
-         {-1, "nr_isolated_anon", "temporary anonymous isolated pages", false},
-         {-1, "nr_isolated_file", "temporary file-backed isolated pages", false},
-         {-1, "workingset_refault", "refaults of previously evicted pages", false},
-         {-1, "workingset_activate", "refaulted pages that were immediately activated", false},
-         {-1, "workingset_nodereclaim", "times a shadow node has been reclaimed", false},
-         {-1, "nr_anon_pages", "non file-backed memory-mapped pages", false},
-         {-1, "nr_mapped", "file-backed memory-mapped pages", false},
-         {-1, "nr_file_pages", "pagecache pages", false},
-         {-1, "nr_dirty", "dirty pagecache pages", false},
-         {-1, "nr_writeback", "pagecache pages pending writeback", false},
-         {-1, "nr_writeback_temp", "pagecache pages pending writeback using temporary buffers", false},
-         {-1, "nr_shmem", "shared memory pages including tmpfs and GEM pages", false},
-         {-1, "nr_shmem_hugepages", "shared memory 2MB or larger pages", false},
-         {-1, "nr_shmem_pmdmapped", "shared memory pages mapped via middle directory", false},
-         {-1, "nr_anon_transparent_hugepages", "non file-backed 2MB or larger pages", false},
-         {-1, "nr_unstable", "uncommitted dirty network filesystem pages", false},
-         {-1, "nr_vmscan_write", "pages paged out", false},
-         {-1, "nr_vmscan_immediate_reclaim", "pages ready to be reclaimed", false},
-         {-1, "nr_dirtied", "pages dirtied", false},
-         {-1, "nr_written", "pages written to", false},
-         {-1, "nr_dirty_threshold", "synchronous writeback threshold bytes", false},
-         {-1, "nr_dirty_background_threshold", "asynchronous writeback threshold bytes", false},
+         {-1, "nr_free_pages", "unallocated pages", false, Gauge, "pages"},
+         {-1, "nr_zone_inactive_anon", "zone inactive anonymous pages", false, Gauge, "pages"},
+         {-1, "nr_zone_active_anon", "zone activate anonymous pages", false, Gauge, "pages"},
+         {-1, "nr_zone_inactive_file", "zone inactive file-backed pages", false, Gauge, "pages"},
+         {-1, "nr_zone_active_file", "zone active file-backed pages", false, Gauge, "pages"},
+         {-1, "nr_zone_unevictable", "zone unevictable pages", false, Gauge, "pages"},
+         {-1, "nr_zone_write_pending", "zone write pending pages", false, Gauge, "pages"},
+         {-1, "nr_mlock", "locked pages", false, Gauge, "pages"},
+         {-1, "nr_page_table_pages", "page table pages", false, Gauge, "pages"},
+         {-1, "nr_kernel_stack", "kernel stack kilobytes", false, Gauge, "kB"},
+         {-1, "nr_bounce", "low-memory pages allocated for DMA", false, Gauge, "pages"},
+         {-1, "nr_free_cma", "free Contig Mem Alloc pages", false, Gauge, "pages"},
+         {-1, "numa_hit", "allocated in intended node", false, Counter, ""},
+         {-1, "numa_miss", "allocated in non-intended node", false, Counter, ""},
+         {-1, "numa_foreign", "was intended here, hit elsewhere", false, Counter, ""},
+         {-1, "numa_interleave", "interleaver preferred this zone", false, Counter, ""},
+         {-1, "numa_local", "allocation from local node", false, Counter, ""},
+         {-1, "numa_other", "allocation from non-local node", false, Counter, ""},
+         {-1, "nr_inactive_anon", "inactive anonymous pages", false, Gauge, "pages"},
+         {-1, "nr_active_anon", "active anonymous pages", false, Gauge, "pages"},
+         {-1, "nr_inactive_file", "inactive file-backed pages", false, Gauge, "pages"},
+         {-1, "nr_active_file", "active file-backed pages", false, Gauge, "pages"},
+         {-1, "nr_unevictable", "unevictable Pages", false, Gauge, "pages"},
+         {-1, "nr_slab_reclaimable", "reclaimable slab pages", false, Gauge, "pages"},
+         {-1, "nr_slab_unreclaimable", "unreclaimable slab pages", false, Gauge, "pages"},
+         {-1, "nr_isolated_anon", "temporary anonymous isolated pages", false, Gauge, "pages"},
+         {-1, "nr_isolated_file", "temporary file-backed isolated pages", false, Gauge, "pages"},
+         {-1, "workingset_refault", "refaults of previously evicted pages", false, Counter, ""},
+         {-1, "workingset_activate", "refaulted pages that were immediately activated", false, Counter, ""},
+         {-1, "workingset_nodereclaim", "times a shadow node has been reclaimed", false, Counter, ""},
+         {-1, "nr_anon_pages", "non file-backed memory-mapped pages", false, Gauge, "pages"},
+         {-1, "nr_mapped", "file-backed memory-mapped pages", false, Gauge, "pages"},
+         {-1, "nr_file_pages", "pagecache pages", false, Gauge, "pages"},
+         {-1, "nr_dirty", "dirty pagecache pages", false, Gauge, "pages"},
+         {-1, "nr_writeback", "pagecache pages pending writeback", false, Gauge, "pages"},
+         {-1, "nr_writeback_temp", "pagecache pages pending writeback using temporary buffers", false, Gauge, "pages"},
+         {-1, "nr_shmem", "shared memory pages including tmpfs and GEM pages", false, Gauge, "pages"},
+         {-1, "nr_shmem_hugepages", "shared memory 2MB or larger pages", false, Gauge, "pages"},
+         {-1, "nr_shmem_pmdmapped", "shared memory pages mapped via middle directory", false, Gauge, "pages"},
+         {-1, "nr_anon_transparent_hugepages", "non file-backed 2MB or larger pages", false, Gauge, "pages"},
+         {-1, "nr_unstable", "uncommitted dirty network filesystem pages", false, Gauge, "pages"},
+         {-1, "nr_vmscan_write", "pages paged out", false, Counter, ""},
+         {-1, "nr_vmscan_immediate_reclaim", "pages ready to be reclaimed", false, Counter, ""},
+         {-1, "nr_dirtied", "pages dirtied", false, Counter, ""},
+         {-1, "nr_written", "pages written to", false, Counter, ""},
+         {-1, "nr_dirty_threshold", "synchronous writeback threshold pages", false, Gauge, "pages"},
+         {-1, "nr_dirty_background_threshold", "asynchronous writeback threshold pages", false, Gauge, "pages"},
+         {-1, "pgpromote_success", "pages promoted to a faster memory tier", false, Counter, ""},
+         {-1, "pgpromote_candidate", "pages considered for promotion", false, Counter, ""},
+         {-1, "pgdemote_kswapd", "pages demoted to a slower memory tier by kswapd", false, Counter, ""},
+         {-1, "pgdemote_direct", "pages demoted to a slower memory tier by direct reclaim", false, Counter, ""},
+         {-1, "pgdemote_khugepaged", "pages demoted to a slower memory tier by khugepaged", false, Counter, ""},
          // include/linux/vm_event_item.h
-         {-1, "pgpgin", "pageins", false},
-         {-1, "pgpgout", "pageouts", false},
-         {-1, "pswpin", "pages swapped in", false},
-         {-1, "pswpout", "pages swapped out", false},
-         {-1, "pgalloc_dma32", "page allocations, DMA32 zone", false},
-         {-1, "pgalloc_normal", "page allocations per zone, normal zone", false},
-         {-1, "pgalloc_movable", "page allocations per zone, movable zone", false},
-         {-1, "allocstall_dma32", "direct reclaim calls, DMA32 zone", false},
-         {-1, "allocstall_normal", "direct reclaim calls, normal zone", false},
-         {-1, "allocstall_movable", "direct reclaim calls, movable zone", false},
-         {-1, "pgskip_dma32", "pages unscannable, DMA32 zone", false},
-         {-1, "pgskip_normal", "pages unscannable, normal zone", false},
-         {-1, "pgskip_movable", "pages unscannable, movable zone", false},
-         {-1, "pgfree", "pages freed", false},
-         {-1, "pgactivate", "pages marked frequently used", false},
-         {-1, "pgdeactivate", "pages marked infrequently used", false},
-         {-1, "pglazyfree", "pages pending asynchronous freeing", false},
-         {-1, "pgfault", "pagefaults not causing IO", false},
-         {-1, "pgmajfault", "pagefaults causing IO", false},
-         {-1, "pglazyfreed", "pages freed asynchronously", false},
-         {-1, "pgrefill", "page refills", false},
-         {-1, "pgsteal_kswapd", "page steals by kswapd", false},
-         {-1, "pgsteal_direct", "page steals on allocation path", false},
-         {-1, "pgscan_kswapd", "pages scanned by the kswapd daemon", false},
-         {-1, "pgscan_direct", "pages scanned in process context", false},
-         {-1, "pgscan_direct_throttle", "pages scanned in throttled process context", false},
-         {-1, "zone_reclaim_failed", "reclaim failures", false},
-         {-1, "pginodesteal", "pages reclaimed via inode freeing", false},
-         {-1, "slabs_scanned", "slab objects scanned", false},
-         {-1, "kswapd_inodesteal", "pages reclaimed by kswapd via inode freeing", false},
-         {-1, "kswapd_low_wmark_hit_quickly", "times kswapd reached low watermark quickly", false},
-         {-1, "kswapd_high_wmark_hit_quickly", "times kswapd reached high watermark quickly", false},
-         {-1, "pageoutrun", "kswapd calls to page reclaim", false},
-         {-1, "pgrotated", "pages reused after IO", false},
-         {-1, "drop_pagecache", "pagecache flushes", false},
-         {-1, "drop_slab", "slab flushes", false},
-         {-1, "oom_kill", "out of memory kills", false},
-         {-1, "pgmigrate_success", "pages migrated", false},
-         {-1, "pgmigrate_fail", "pages failed migration", false},
-         {-1, "compact_migrate_scanned", "compactable pages marked for migration in process context", false},
-         {-1, "compact_free_scanned", "compactable free pages scanned in process context", false},
-         {-1, "compact_isolated", "compactable pages isolated in process context", false},
-         {-1, "compact_stall", "page compaction stalls in process context", false},
-         {-1, "compact_fail", "page compaction failures in process context", false},
-         {-1, "compact_success", "compaction daemon succeeded runs", false},
-         {-1, "compact_daemon_wake", "times compaction daemon was woken", false},
-         {-1, "compact_daemon_migrate_scanned", "pages marked for migration by compaction daemon", false},
-         {-1, "compact_daemon_free_scanned", "free pages scanned by compaction daemon", false},
-         {-1, "htlb_buddy_alloc_success", "2MB or larger pages allocated", false},
-         {-1, "htlb_buddy_alloc_fail", "2MB or larger pages failed allocation", false},
-         {-1, "unevictable_pgs_culled", "pages which became unevictable", false},
-         {-1, "unevictable_pgs_scanned", "unevictable pages scanned", false},
-         {-1, "unevictable_pgs_rescued", "unevictable pages became evictable", false},
-         {-1, "unevictable_pgs_mlocked", "unevictable pages locked", false},
-         {-1, "unevictable_pgs_munlocked", "unevictable pages unlocked", false},
-         {-1, "unevictable_pgs_cleared", "unevictable pages zeroed", false},
-         {-1, "unevictable_pgs_stranded", "unevictable pages which couldn't be isolated", false},
-         {-1, "thp_fault_alloc", "2MB or larger pages page-faulted", false},
-         {-1, "thp_fault_fallback", "2MB or larger pages reused", false},
-         {-1, "thp_collapse_alloc", "2MB or larger pages from merging", false},
-         {-1, "thp_collapse_alloc_failed", "2MB or larger page merge failure", false},
-         {-1, "thp_file_alloc", "2MB or larger file-backed pages allocated", false},
-         {-1, "thp_file_mapped", "2MB or larger pagefaults", false},
-         {-1, "thp_split_page", "2MB or larger pages split to normal pages", false},
-         {-1, "thp_split_page_failed", "2MB or larger pages split failures", false},
-         {-1, "thp_deferred_split_page", "2MB or larger pages with deferred split", false},
-         {-1, "thp_split_pmd", "2MB or larger pages split from middle directory", false},
-         {-1, "thp_split_pud", "2MB or larger pages split from upper directory", false},
-         {-1, "thp_zero_page_alloc", "2MB or larger zero pages allocated", false},
-         {-1, "thp_zero_page_alloc_failed", "2MB or larger zero page allocation failures", false},
-         {-1, "thp_swpout", "2MB or larger pages swapped out", false},
-         {-1, "thp_swpout_fallback", "2MB or larger pages swapped out as normal pages", false},
-         {-1, "balloon_inflate", "pages added to page balloon", false},
-         {-1, "balloon_deflate", "pages removed from page balloon", false},
-         {-1, "swap_ra", "pages swapped in due to readahead", false},
-         {-1, "swap_ra_hit", "pages returned from swap cache due to readahead", false},
+         {-1, "pgpgin", "pageins", false, Counter, ""},
+         {-1, "pgpgout", "pageouts", false, Counter, ""},
+         {-1, "pswpin", "pages swapped in", false, Counter, ""},
+         {-1, "pswpout", "pages swapped out", false, Counter, ""},
+         {-1, "pgalloc_dma32", "page allocations, DMA32 zone", false, Counter, ""},
+         {-1, "pgalloc_normal", "page allocations per zone, normal zone", false, Counter, ""},
+         {-1, "pgalloc_movable", "page allocations per zone, movable zone", false, Counter, ""},
+         {-1, "allocstall_dma32", "direct reclaim calls, DMA32 zone", false, Counter, ""},
+         {-1, "allocstall_normal", "direct reclaim calls, normal zone", false, Counter, ""},
+         {-1, "allocstall_movable", "direct reclaim calls, movable zone", false, Counter, ""},
+         {-1, "pgskip_dma32", "pages unscannable, DMA32 zone", false, Counter, ""},
+         {-1, "pgskip_normal", "pages unscannable, normal zone", false, Counter, ""},
+         {-1, "pgskip_movable", "pages unscannable, movable zone", false, Counter, ""},
+         {-1, "pgfree", "pages freed", false, Counter, ""},
+         {-1, "pgactivate", "pages marked frequently used", false, Counter, ""},
+         {-1, "pgdeactivate", "pages marked infrequently used", false, Counter, ""},
+         {-1, "pglazyfree", "pages pending asynchronous freeing", false, Counter, ""},
+         {-1, "pgfault", "pagefaults not causing IO", false, Counter, ""},
+         {-1, "pgmajfault", "pagefaults causing IO", false, Counter, ""},
+         {-1, "pglazyfreed", "pages freed asynchronously", false, Counter, ""},
+         {-1, "pgrefill", "page refills", false, Counter, ""},
+         {-1, "pgsteal_kswapd", "page steals by kswapd", false, Counter, ""},
+         {-1, "pgsteal_direct", "page steals on allocation path", false, Counter, ""},
+         {-1, "pgscan_kswapd", "pages scanned by the kswapd daemon", false, Counter, ""},
+         {-1, "pgscan_direct", "pages scanned in process context", false, Counter, ""},
+         {-1, "pgscan_direct_throttle", "pages scanned in throttled process context", false, Counter, ""},
+         {-1, "zone_reclaim_failed", "reclaim failures", false, Counter, ""},
+         {-1, "pginodesteal", "pages reclaimed via inode freeing", false, Counter, ""},
+         {-1, "slabs_scanned", "slab objects scanned", false, Counter, ""},
+         {-1, "kswapd_inodesteal", "pages reclaimed by kswapd via inode freeing", false, Counter, ""},
+         {-1, "kswapd_low_wmark_hit_quickly", "times kswapd reached low watermark quickly", false, Counter, ""},
+         {-1, "kswapd_high_wmark_hit_quickly", "times kswapd reached high watermark quickly", false, Counter, ""},
+         {-1, "pageoutrun", "kswapd calls to page reclaim", false, Counter, ""},
+         {-1, "pgrotated", "pages reused after IO", false, Counter, ""},
+         {-1, "drop_pagecache", "pagecache flushes", false, Counter, ""},
+         {-1, "drop_slab", "slab flushes", false, Counter, ""},
+         {-1, "oom_kill", "out of memory kills", false, Counter, ""},
+         {-1, "numa_pte_updates", "PTEs marked for NUMA hinting faults", false, Counter, ""},
+         {-1, "numa_huge_pte_updates", "2MB or larger PTEs marked for NUMA hinting faults", false, Counter, ""},
+         {-1, "numa_hint_faults", "NUMA hinting faults", false, Counter, ""},
+         {-1, "numa_hint_faults_local", "NUMA hinting faults on the local node", false, Counter, ""},
+         {-1, "numa_pages_migrated", "pages migrated by NUMA balancing", false, Counter, ""},
+         {-1, "pgmigrate_success", "pages migrated", false, Counter, ""},
+         {-1, "pgmigrate_fail", "pages failed migration", false, Counter, ""},
+         {-1, "compact_migrate_scanned", "compactable pages marked for migration in process context", false, Counter, ""},
+         {-1, "compact_free_scanned", "compactable free pages scanned in process context", false, Counter, ""},
+         {-1, "compact_isolated", "compactable pages isolated in process context", false, Counter, ""},
+         {-1, "compact_stall", "page compaction stalls in process context", false, Counter, ""},
+         {-1, "compact_fail", "page compaction failures in process context", false, Counter, ""},
+         {-1, "compact_success", "compaction daemon succeeded runs", false, Counter, ""},
+         {-1, "compact_daemon_wake", "times compaction daemon was woken", false, Counter, ""},
+         {-1, "compact_daemon_migrate_scanned", "pages marked for migration by compaction daemon", false, Counter, ""},
+         {-1, "compact_daemon_free_scanned", "free pages scanned by compaction daemon", false, Counter, ""},
+         {-1, "htlb_buddy_alloc_success", "2MB or larger pages allocated", false, Counter, ""},
+         {-1, "htlb_buddy_alloc_fail", "2MB or larger pages failed allocation", false, Counter, ""},
+         {-1, "unevictable_pgs_culled", "pages which became unevictable", false, Counter, ""},
+         {-1, "unevictable_pgs_scanned", "unevictable pages scanned", false, Counter, ""},
+         {-1, "unevictable_pgs_rescued", "unevictable pages became evictable", false, Counter, ""},
+         {-1, "unevictable_pgs_mlocked", "unevictable pages locked", false, Counter, ""},
+         {-1, "unevictable_pgs_munlocked", "unevictable pages unlocked", false, Counter, ""},
+         {-1, "unevictable_pgs_cleared", "unevictable pages zeroed", false, Counter, ""},
+         {-1, "unevictable_pgs_stranded", "unevictable pages which couldn't be isolated", false, Counter, ""},
+         {-1, "thp_fault_alloc", "2MB or larger pages page-faulted", false, Counter, ""},
+         {-1, "thp_fault_fallback", "2MB or larger pages reused", false, Counter, ""},
+         {-1, "thp_collapse_alloc", "2MB or larger pages from merging", false, Counter, ""},
+         {-1, "thp_collapse_alloc_failed", "2MB or larger page merge failure", false, Counter, ""},
+         {-1, "thp_file_alloc", "2MB or larger file-backed pages allocated", false, Counter, ""},
+         {-1, "thp_file_mapped", "2MB or larger pagefaults", false, Counter, ""},
+         {-1, "thp_split_page", "2MB or larger pages split to normal pages", false, Counter, ""},
+         {-1, "thp_split_page_failed", "2MB or larger pages split failures", false, Counter, ""},
+         {-1, "thp_deferred_split_page", "2MB or larger pages with deferred split", false, Counter, ""},
+         {-1, "thp_split_pmd", "2MB or larger pages split from middle directory", false, Counter, ""},
+         {-1, "thp_split_pud", "2MB or larger pages split from upper directory", false, Counter, ""},
+         {-1, "thp_zero_page_alloc", "2MB or larger zero pages allocated", false, Counter, ""},
+         {-1, "thp_zero_page_alloc_failed", "2MB or larger zero page allocation failures", false, Counter, ""},
+         {-1, "thp_swpout", "2MB or larger pages swapped out", false, Counter, ""},
+         {-1, "thp_swpout_fallback", "2MB or larger pages swapped out as normal pages", false, Counter, ""},
+         {-1, "balloon_inflate", "pages added to page balloon", false, Counter, ""},
+         {-1, "balloon_deflate", "pages removed from page balloon", false, Counter, ""},
+         {-1, "swap_ra", "pages swapped in due to readahead", false, Counter, ""},
+         {-1, "swap_ra_hit", "pages returned from swap cache due to readahead", false, Counter, ""},
       },
    }
 }
 
+// parses 'name value' lines
+func parseCounters(buf []byte) (names []string, counts map[string]uint64) {
+   counts = make(map[string]uint64)
+
+   for _, line := range strings.Split(string(buf), "\n") {
+      parts := strings.Fields(line)
+      if len(parts) != 2 {
+         continue
+      }
+
+      count, err := strconv.ParseUint(parts[1], 10, 64)
+      if err != nil {
+         continue
+      }
+
+      if _, ok := counts[parts[0]]; !ok {
+         names = append(names, parts[0])
+      }
+
+      counts[parts[0]] = count
+   }
+
+   return
+}
+
+// classifies fields absent from the curated table; most nr_ fields are page counts
+func guessKind(mnemonic string) (Kind, string) {
+   if strings.HasPrefix(mnemonic, "nr_") && !strings.HasSuffix(mnemonic, "ed") && !strings.HasSuffix(mnemonic, "_write") {
+      return Gauge, "pages"
+   }
+
+   return Counter, ""
+}
+
+// discovers fields this kernel provides, keeping unknown fields
 func (d *Kernel) Present() bool {
-   return true
+   buf, err := ioutil.ReadFile(d.path)
+   if err != nil {
+      return false
+   }
+
+   known := make(map[string]Event)
+   for _, event := range d.curated {
+      known[event.mnemonic] = event
+   }
+
+   names, _ := parseCounters(buf)
+   d.events = nil
+
+   for _, name := range names {
+      event, ok := known[name]
+      if !ok {
+         event = Event{-1, name, "undocumented "+name, false, Counter, ""}
+         event.kind, event.unit = guessKind(name)
+      }
+
+      d.events = append(d.events, event)
+   }
+
+   d.file, err = os.Open(d.path)
+   validate(err)
+
+   return len(d.events) > 0
 }
 
 func (d *Kernel) Sources() uint {
@@ -192,10 +267,6 @@ func (d *Kernel) Enable(discrete bool) {
    }
 
    d.last = make([]uint64, d.nEnabled)
-
-   var err error
-   d.file, err = os.Open("/proc/vmstat")
-   validate(err)
 }
 
 func (d *Kernel) Headings(mnemonics bool) []string {
@@ -226,30 +297,20 @@ func (d *Kernel) Unlock() {
 }
 
 func (d *Kernel) Sample() []int64 {
-   buf := make([]byte, 8192)
+   d.Lock()
+   defer d.Unlock()
 
    current := time.Now()
    delta := uint64(current.Sub(d.lastElapsed) / time.Nanosecond)
    d.lastElapsed = current
 
-   // get EOF with SeekAt
-   d.file.Seek(0, 0)
-   n, err := d.file.Read(buf)
+   // reread from start, as length varies
+   _, err := d.file.Seek(0, 0)
+   validate(err)
+   buf, err := ioutil.ReadAll(d.file)
    validate(err)
 
-   // parse strings into map for O(n) total cost
-   m := make(map[string]uint64)
-   bufs := string(buf[:n-1]) // trim trailing newline
-   lines := strings.Split(bufs, "\n")
-
-   for _, line := range lines {
-      parts := strings.Split(line, " ")
-      count, err := strconv.ParseUint(parts[1], 10, 64)
-      validate(err)
-      m[parts[0]] = count
-   }
-
-   d.Lock()
+   _, m := parseCounters(buf)
 
    samples := make([]int64, d.nEnabled)
    i := 0
@@ -260,12 +321,17 @@ func (d *Kernel) Sample() []int64 {
       }
 
       val := m[event.mnemonic]
-      samples[i] = (int64(val) - int64(d.last[i])) * 1000000000 / int64(delta)
+
+      if event.kind == Gauge {
+         samples[i] = int64(val)
+      } else {
+         samples[i] = (int64(val) - int64(d.last[i])) * 1000000000 / int64(delta)
+      }
+
       d.last[i] = val
       i++
    }
 
-   d.Unlock()
    return samples
 }
 
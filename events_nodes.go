@@ -0,0 +1,243 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "io/ioutil"
+   "path/filepath"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+// per-node memory statistics from sysfs
+type Nodes struct {
+   events      []Event
+   root        string
+   nodes       []int
+   last        [][]uint64
+   lastElapsed time.Time
+   discrete    bool
+   nEnabled    int
+   mutex       sync.Mutex
+}
+
+const nodePrefix = "node_"
+
+// numastat fields with differing names in vmstat
+var numastatAliases = map[string]string{
+   "interleave_hit": "numa_interleave",
+   "local_node":     "numa_local",
+   "other_node":     "numa_other",
+}
+
+func NewNodes() *Nodes {
+   return &Nodes{root: "/sys/devices/system/node"}
+}
+
+// reads numastat and vmstat for a node
+func (d *Nodes) read(node int) (names []string, counts map[string]uint64) {
+   dir := filepath.Join(d.root, fmt.Sprintf("node%d", node))
+   counts = make(map[string]uint64)
+
+   for _, leaf := range []string{"numastat", "vmstat"} {
+      buf, err := ioutil.ReadFile(filepath.Join(dir, leaf))
+      if err != nil {
+         continue
+      }
+
+      fileNames, fileCounts := parseCounters(buf)
+
+      for _, name := range fileNames {
+         count := fileCounts[name]
+         if alias, ok := numastatAliases[name]; ok {
+            name = alias
+         }
+
+         if _, ok := counts[name]; !ok {
+            names = append(names, name)
+            counts[name] = count
+         }
+      }
+   }
+
+   return
+}
+
+func (d *Nodes) Present() bool {
+   dirs, err := filepath.Glob(filepath.Join(d.root, "node[0-9]*"))
+   if err != nil || len(dirs) == 0 {
+      return false
+   }
+
+   for _, dir := range dirs {
+      node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+      if err == nil {
+         d.nodes = append(d.nodes, node)
+      }
+   }
+
+   sort.Ints(d.nodes)
+
+   // use kernel descriptions where known
+   known := make(map[string]Event)
+   for _, event := range NewKernel().curated {
+      known[event.mnemonic] = event
+   }
+
+   names, _ := d.read(d.nodes[0])
+   if len(names) == 0 {
+      return false
+   }
+
+   for _, name := range names {
+      event, ok := known[name]
+      if !ok {
+         event.desc = name
+         event.kind, event.unit = guessKind(name)
+      }
+
+      d.events = append(d.events, Event{-1, nodePrefix+name, "node "+event.desc, false, event.kind, event.unit})
+   }
+
+   return true
+}
+
+func (d *Nodes) Sources() uint {
+   return uint(len(d.nodes))
+}
+
+func (d *Nodes) Name() string {
+   return "NUMA nodes"
+}
+
+func (d *Nodes) Rate() uint {
+   return 0
+}
+
+func (d *Nodes) Lock() {
+   d.mutex.Lock()
+}
+
+func (d *Nodes) Unlock() {
+   d.mutex.Unlock()
+}
+
+func (d *Nodes) Enable(discrete bool) {
+   d.discrete = discrete
+   d.nEnabled = 0
+
+   for _, event := range d.events {
+      if event.enabled {
+         d.nEnabled++
+      }
+   }
+
+   d.last = make([][]uint64, len(d.nodes))
+   for i := range d.last {
+      d.last[i] = make([]uint64, d.nEnabled)
+   }
+}
+
+// discrete headings are suffixed with the node number
+func (d *Nodes) Headings(mnemonics bool) []string {
+   var headings []string
+
+   for _, event := range d.events {
+      if !event.enabled {
+         continue
+      }
+
+      var name string
+      if mnemonics {
+         name = event.mnemonic
+      } else {
+         name = event.desc
+      }
+
+      if d.discrete {
+         for _, node := range d.nodes {
+            heading := fmt.Sprintf("%s:%d", name, node)
+            headings = append(headings, heading)
+         }
+      } else {
+         headings = append(headings, name)
+      }
+   }
+
+   return headings
+}
+
+func (d *Nodes) Sample() []int64 {
+   var samples []int64
+
+   d.Lock()
+   defer d.Unlock()
+
+   current := time.Now()
+   delta := int64(current.Sub(d.lastElapsed) / time.Nanosecond)
+   d.lastElapsed = current
+
+   nNodes := len(d.nodes)
+
+   if d.discrete {
+      samples = make([]int64, d.nEnabled * nNodes)
+   } else {
+      samples = make([]int64, d.nEnabled)
+   }
+
+   for n, node := range d.nodes {
+      _, counts := d.read(node)
+      i := 0
+
+      for _, event := range d.events {
+         if !event.enabled {
+            continue
+         }
+
+         val := counts[strings.TrimPrefix(event.mnemonic, nodePrefix)]
+         var sample int64
+
+         if event.kind == Gauge {
+            sample = int64(val)
+         } else {
+            sample = (int64(val) - int64(d.last[n][i])) * 1000000000 / delta
+         }
+
+         d.last[n][i] = val
+
+         if d.discrete {
+            samples[i*nNodes+n] = sample
+         } else {
+            // sum all nodes
+            samples[i] += sample
+         }
+
+         i++
+      }
+   }
+
+   return samples
+}
+
+func (d *Nodes) Events() []Event {
+   return d.events
+}
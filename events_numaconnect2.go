@@ -24,9 +24,24 @@ import (
    "golang.org/x/sys/unix"
 )
 
+// access to a Numachip2 register file and statistics block
+type Registers interface {
+   // reads 32-bit register at word index
+   Read(reg uint) uint32
+   // writes 32-bit register at word index
+   Write(reg uint, val uint32)
+   // reads 64-bit statistics counter at index
+   Stat(index int16) uint64
+}
+
+// maps the register file at a physical address
+type Mapper interface {
+   Map(base int64) (Registers, error)
+   Unmap(regs Registers) error
+}
+
 type Numachip2 struct {
-   regs        *[mapLen / 4]uint32
-   stats       *[statsLen / 8]uint64
+   regs        Registers
    last        []uint64
    lastElapsed uint64
 }
@@ -34,11 +49,24 @@ type Numachip2 struct {
 type Numaconnect2 struct {
    events   []Event
    cards    []Numachip2
+   mapper   Mapper
    discrete bool
    nEnabled int
    mutex    sync.Mutex
 }
 
+// hardware registers mapped via /dev/mem
+type DevMem struct {
+   fd     int
+   opened bool
+}
+
+type mappedRegs struct {
+   data  []byte
+   regs  *[mapLen / 4]uint32
+   stats *[statsLen / 8]uint64
+}
+
 const (
    mapBase        = 0xf0000000
    mapLen         = 0x4000
@@ -56,177 +84,220 @@ const (
 )
 
 func NewNumaconnect2() *Numaconnect2 {
+   return NewNumaconnect2With(&DevMem{})
+}
+
+// uses alternate register access, eg an emulator
+func NewNumaconnect2With(mapper Mapper) *Numaconnect2 {
    return &Numaconnect2{
+      mapper: mapper,
       events: []Event{
-//         {0x000/8, "n2Cyc", "% cycles", false},
-         {0x008/8, "n2CycRmpeHalf", "% cycles at least half of the available RMPE contexts were in use", false},
-         {0x010/8, "n2CycRmpe0freeS", "% cycles the RMPE had free contexts for SIU accesses", false},
-         {0x030/8, "n2CycRmpe0freeP", "% cycles the RMPE had free contexts for PIU accesses", false},
-         {0x050/8, "n2ReqPiuRmpe", "requests from PIU to RMPE", false},
-         {0x058/8, "n2ValidCycReqPiuRmpe", "% valid cycles acked for requests from PIU to RMPE", false},
-         {0x060/8, "n2WaitCycReqPiuRmpe", "% wait cycles for requests from PIU to RMPE", false},
-         {0x068/8, "n2ResPiuRmpe", "responses from PIU to RMPE", false},
-         {0x070/8, "n2ValidCycResPiuRmpe", "% valid cycles acked for responses from PIU to RMPE", false},
-         {0x078/8, "n2WaitCycResPiuRmpe", "% wait cycles for responses from PIU to RMPE", false},
-         {0x080/8, "n2ReqSiuRmpe", "requests from SIU to RMPE", false},
-         {0x088/8, "n2CycReqSiuRmpe", "% valid cycles acked for requests from SIU to RMPE", false},
-         {0x090/8, "n2WaitCycReqSiuRmpe", "% wait cycles for requests from SIU to RMPE", false},
-         {0x098/8, "n2RespSiuRmpe", "responses from SIU to RMPE", false},
-         {0x0A0/8, "n2ValidCycAckRespSiuRmpe", "% valid cycles acked for responses from SIU to RMPE", false},
-         {0x0A8/8, "n2WaitCycRespSiuRmpe", "% wait cycles for responses from SIU to RMPE", false},
-
-         {0x0B0/8, "n2CycHalfLmpeUsed", "% cycles at least half of the available LMPE contexts were in use", false},
-         {0x0B8/8, "n2CycLmpeFreePiu", "% cycles the LMPE had free contexts for SIU accesses", false},
-         {0x0D8/8, "n2CycLmpeFreeSiu", "% cycles the LMPE had free contexts for PIU accesses", false},
-         {0x0F8/8, "n2ReqPiuLmpe", "requests from PIU to LMPE", false},
-         {0x100/8, "n2WaitcycReqPiuLmpe", "% wait cycles for requests from PIU to LMPE", false},
-         {0x108/8, "n2RespPiuLmpe", "responses from PIU to LMPE", false},
-         {0x110/8, "n2ValidCycResPiuLmpe", "% valid cycles acked for responses from PIU to LMPE", false},
-         {0x118/8, "n2WaitCycRespPiuLmpe", "% wait cycles for responses from PIU to LMPE", false},
-         {0x120/8, "n2ReqSiuLmpe", "requests from SIU to LMPE", false},
-         {0x128/8, "n2ValidCycAckReqSiuLmpe", "% valid cycles acked for requests from SIU to LMPE", false},
-         {0x130/8, "n2WaitCycReqSiuLmpe", "% wait cycles for requests from SIU to LMPE", false},
-         {0x138/8, "n2RespSiuLmpe", "responses from SIU to LMPE", false},
-         {0x140/8, "n2ValidCycAckRespSiuLmpe", "% valid cycles acked for responses from SIU to LMPE", false},
-         {0x148/8, "n2WaitCycRespSiuLmpe", "% wait cycles for responses from SIU to LMPE", false},
-
-         {0x210/8, "n2VicBlkXRecv", "VicBlk and VicBlkClean commands received", false},
-         {0x218/8, "n2RdBlkXRecv", "RdBlk and RdBlkS commands received", false},
-         {0x220/8, "n2RdBlkModRecv", "RdBlkMod commands received", false},
-         {0x228/8, "n2ChangeToDirtyRecv", "ChangeToDirty commands received", false},
-         {0x230/8, "n2RdSizedRecv", "RdSized commands received", false},
-         {0x238/8, "n2WrSizedRecv", "WrSized commands received", false},
-         {0x240/8, "n2DirPrbRecv", "directed Probe commands received", false},
-         {0x248/8, "n2BcastPrbRecv", "broadcast Probe commands received", false},
-         {0x250/8, "n2BcastCmdRecv", "Broadcast commands received", false},
-         {0x258/8, "n2RdRespCmdRecv", "RdResponse commands received", false},
-         {0x260/8, "n2PrbRespCmdRecv", "ProbeResponse commands received", false},
-         {0x268/8, "n2CachelinesRecv", "data packets with full cachelines of data received", false},
-         {0x270/8, "n2PartCachelinesRecv", "data packets with less than a full cache line received", false},
-
-         {0x278/8, "n2VicBlkXSent", "VicBlk and VicBlkClean commands sent", false},
-         {0x280/8, "n2RdBlkXSent", "RdBlk and RdBlkS commands sent", false},
-         {0x288/8, "n2RdBlkModSent", "RdBlkMod commands sent", false},
-         {0x290/8, "n2ChangeToDirtySent", "ChangeToDirty commands sent", false},
-         {0x298/8, "n2RdSizedSent", "RdSized commands sent", false},
-         {0x2A0/8, "n2WrSizedSent", "WrSized commands sent", false},
-         {0x2A8/8, "n2BcastProbeCmdSent", "broadcast Probe commands sent", false},
-         {0x2B0/8, "n2BcastCmdSent", "broadcast commands sent", false},
-         {0x2B8/8, "n2RdRespSent", "RdResponse commands sent", false},
-         {0x2C0/8, "n2ProbeRespSent", "ProbeResponse commands sent", false},
-         {0x2C8/8, "n2CachelinesSent", "data packets with full cachelines of data sent", false},
-         {0x2D0/8, "n2LessCachelinesSent", "data packets with less than a full cache line sent", false},
-
-         {0x2D8/8, "n2CacheReadHitRmpe", "nCache read hits on RMPE", false},
-         {0x2E0/8, "n2CacheStoreHitRmpe", "nCache store hits on RMPE", false},
-         {0x2E8/8, "n2CacheStoreMissRmpe", "nCache store misses on RMPE", false},
-         {0x2F0/8, "n2CacheRolloutRmpe", "nCache roll outs on RMPE", false},
-         {0x2F8/8, "n2CacheInvalidatesRmpe", "nCache invalidates on RMPE", false},
-
-         {0x378/8, "n2CycOneFreeHreqPiu", "% cycles with at least one free Hreq context in PIU", false},
-         {0x380/8, "n2CycOneFreePprb", "% cycles with at least one free Pprb context in PIU", false},
-         {0x388/8, "n2CycOneFreeHprb", "% cycles with at least one free Hprb context in PIU", false},
-         {0x390/8, "n2CycOneFreePreq", "% cycles with at least one free Preq context in PIU", false},
-
-         {0x398/8, "n2CacheTag0Accesses", "accesses to Ctag cache 0", false},
-         {0x3A0/8, "n2CacheTag0WriteHit", "write hit accesses to Ctag cache 0", false},
-         {0x3A8/8, "n2CacheTag0ReadHit", "read hit accesses to Ctag cache 0", false},
-         {0x3B0/8, "n2CacheTag0WriteWriteback", "write accesses with writebacks to Ctag cache 0", false},
-         {0x3B8/8, "n2CacheTag0ReadWriteback", "read accesses with writebacks to Ctag cache 0", false},
-         {0x3C0/8, "n2CacheTag0WriteMiss", "write miss accesses to Ctag cache 0", false},
-         {0x3C8/8, "n2CacheTag0ReadMiss", "read miss accesses to Ctag cache 0", false},
-
-         {0x3D0/8, "n2CacheTag1Accesses", "accesses to Ctag cache 1", false},
-         {0x3D8/8, "n2CacheTag1WriteHit", "write hit accesses to Ctag cache 1", false},
-         {0x3E0/8, "n2CacheTag1ReadHit", "read hit accesses to Ctag cache 1", false},
-         {0x3E8/8, "n2CacheTag1WriteWriteback", "write accesses with writebacks to Ctag cache 1", false},
-         {0x3F0/8, "n2CacheTag1ReadWriteback", "read accesses with writebacks to Ctag cache 1", false},
-         {0x3F8/8, "n2CacheTag1WriteMiss", "write miss accesses to Ctag cache 1", false},
-         {0x400/8, "n2CacheTag1ReadMiss", "read miss accesses to Ctag cache 1", false},
-
-         {0x408/8, "n2CacheTag2Accesses", "accesses to Ctag cache 2", false},
-         {0x410/8, "n2CacheTag2WriteHit", "write hit accesses to Ctag cache 2", false},
-         {0x418/8, "n2CacheTag2ReadHit", "read hit accesses to Ctag cache 2", false},
-         {0x420/8, "n2CacheTag2WriteWriteback", "write accesses with writebacks to Ctag cache 2", false},
-         {0x428/8, "n2CacheTag2ReadWriteback", "read accesses with writebacks to Ctag cache 2", false},
-         {0x430/8, "n2CacheTag2WriteMiss", "write miss accesses to Ctag cache 2", false},
-         {0x438/8, "n2CacheTag2ReadMiss", "read miss accesses to Ctag cache 2", false},
-
-         {0x440/8, "n2CacheTag3Accesses", "accesses to Ctag cache 3", false},
-         {0x448/8, "n2CacheTag3WriteHit", "write hit accesses to Ctag cache 3", false},
-         {0x450/8, "n2CacheTag3ReadHit", "read hit accesses to Ctag cache 3", false},
-         {0x458/8, "n2CacheTag3WriteWriteback", "write accesses with writebacks to Ctag cache 3", false},
-         {0x460/8, "n2CacheTag3ReadWriteback", "read accesses with writebacks to Ctag cache 3", false},
-         {0x468/8, "n2CacheTag3WriteMiss", "write miss accesses to Ctag cache 3", false},
-         {0x470/8, "n2CacheTag3ReadMiss", "read miss accesses to Ctag cache 3", false},
-
-         {0x478/8, "n2MainTag0Access", "accesses to Mtag cache 0", false},
-         {0x480/8, "n2MainTag0WriteHit", "write hit accesses to Mtag cache 0", false},
-         {0x488/8, "n2MainTag0ReadHit", "read hit accesses to Mtag cache 0", false},
-         {0x490/8, "n2MainTag0WriteWriteback", "write accesses with writebacks to Mtag cache 0", false},
-         {0x498/8, "n2MainTag0ReadWriteback", "read accesses with writebacks to Mtag cache 0", false},
-         {0x4A0/8, "n2MainTag0WriteMiss", "write miss accesses to Mtag cache 0", false},
-         {0x4A8/8, "n2MainTag0ReadMiss", "read miss accesses to Mtag cache 0", false},
-
-         {0x4B0/8, "n2MainTag1Access", "accesses to Mtag cache 1", false},
-         {0x4B8/8, "n2MainTag1WriteHit", "write hit accesses to Mtag cache 1", false},
-         {0x4C0/8, "n2MainTag1ReadHit", "read hit accesses to Mtag cache 1", false},
-         {0x4C8/8, "n2MainTag1WriteWriteback", "write accesses with writebacks to Mtag cache 1", false},
-         {0x4D0/8, "n2MainTag1ReadWriteback", "read accesses with writebacks to Mtag cache 1", false},
-         {0x4D8/8, "n2MainTag1WriteMiss", "write miss accesses to Mtag cache 1", false},
-         {0x4E0/8, "n2MainTag1ReadMiss", "read miss accesses to Mtag cache 1", false},
-
-         {0x4E8/8, "n2MainTag2Access", "accesses to Mtag cache 2", false},
-         {0x4F0/8, "n2MainTag2WriteHit", "write hit accesses to Mtag cache 2", false},
-         {0x4F8/8, "n2MainTag2ReadHit", "read hit accesses to Mtag cache 2", false},
-         {0x500/8, "n2MainTag2WriteWriteback", "write accesses with writebacks to Mtag cache 2", false},
-         {0x508/8, "n2MainTag2ReadWriteback", "read accesses with writebacks to Mtag cache 2", false},
-         {0x510/8, "n2MainTag2WriteMiss", "write miss accesses to Mtag cache 2", false},
-         {0x518/8, "n2MainTag2ReadMiss", "read miss accesses to Mtag cache 2", false},
-
-         {0x520/8, "n2MainTag3Access", "accesses to Mtag cache 3", false},
-         {0x528/8, "n2MainTag3WriteHit", "write hit accesses to Mtag cache 3", false},
-         {0x530/8, "n2MainTag3ReadHit", "read hit accesses to Mtag cache 3", false},
-         {0x538/8, "n2MainTag3WriteAccess", "write accesses with writebacks to Mtag cache 3", false},
-         {0x540/8, "n2MainTag3ReadAccess", "read accesses with writebacks to Mtag cache 3", false},
-         {0x548/8, "n2MainTag3WriteMiss", "write miss accesses to Mtag cache 3", false},
-         {0x550/8, "n2MainTag3ReadMiss", "read miss accesses to Mtag cache 3", false},
+//         {0x000/8, "n2Cyc", "% cycles", false, Ratio, "%"},
+         {0x008/8, "n2CycRmpeHalf", "% cycles at least half of the available RMPE contexts were in use", false, Ratio, "%"},
+         {0x010/8, "n2CycRmpe0freeS", "% cycles the RMPE had free contexts for SIU accesses", false, Ratio, "%"},
+         {0x030/8, "n2CycRmpe0freeP", "% cycles the RMPE had free contexts for PIU accesses", false, Ratio, "%"},
+         {0x050/8, "n2ReqPiuRmpe", "requests from PIU to RMPE", false, Counter, ""},
+         {0x058/8, "n2ValidCycReqPiuRmpe", "% valid cycles acked for requests from PIU to RMPE", false, Ratio, "%"},
+         {0x060/8, "n2WaitCycReqPiuRmpe", "% wait cycles for requests from PIU to RMPE", false, Ratio, "%"},
+         {0x068/8, "n2ResPiuRmpe", "responses from PIU to RMPE", false, Counter, ""},
+         {0x070/8, "n2ValidCycResPiuRmpe", "% valid cycles acked for responses from PIU to RMPE", false, Ratio, "%"},
+         {0x078/8, "n2WaitCycResPiuRmpe", "% wait cycles for responses from PIU to RMPE", false, Ratio, "%"},
+         {0x080/8, "n2ReqSiuRmpe", "requests from SIU to RMPE", false, Counter, ""},
+         {0x088/8, "n2CycReqSiuRmpe", "% valid cycles acked for requests from SIU to RMPE", false, Ratio, "%"},
+         {0x090/8, "n2WaitCycReqSiuRmpe", "% wait cycles for requests from SIU to RMPE", false, Ratio, "%"},
+         {0x098/8, "n2RespSiuRmpe", "responses from SIU to RMPE", false, Counter, ""},
+         {0x0A0/8, "n2ValidCycAckRespSiuRmpe", "% valid cycles acked for responses from SIU to RMPE", false, Ratio, "%"},
+         {0x0A8/8, "n2WaitCycRespSiuRmpe", "% wait cycles for responses from SIU to RMPE", false, Ratio, "%"},
+
+         {0x0B0/8, "n2CycHalfLmpeUsed", "% cycles at least half of the available LMPE contexts were in use", false, Ratio, "%"},
+         {0x0B8/8, "n2CycLmpeFreePiu", "% cycles the LMPE had free contexts for SIU accesses", false, Ratio, "%"},
+         {0x0D8/8, "n2CycLmpeFreeSiu", "% cycles the LMPE had free contexts for PIU accesses", false, Ratio, "%"},
+         {0x0F8/8, "n2ReqPiuLmpe", "requests from PIU to LMPE", false, Counter, ""},
+         {0x100/8, "n2WaitcycReqPiuLmpe", "% wait cycles for requests from PIU to LMPE", false, Ratio, "%"},
+         {0x108/8, "n2RespPiuLmpe", "responses from PIU to LMPE", false, Counter, ""},
+         {0x110/8, "n2ValidCycResPiuLmpe", "% valid cycles acked for responses from PIU to LMPE", false, Ratio, "%"},
+         {0x118/8, "n2WaitCycRespPiuLmpe", "% wait cycles for responses from PIU to LMPE", false, Ratio, "%"},
+         {0x120/8, "n2ReqSiuLmpe", "requests from SIU to LMPE", false, Counter, ""},
+         {0x128/8, "n2ValidCycAckReqSiuLmpe", "% valid cycles acked for requests from SIU to LMPE", false, Ratio, "%"},
+         {0x130/8, "n2WaitCycReqSiuLmpe", "% wait cycles for requests from SIU to LMPE", false, Ratio, "%"},
+         {0x138/8, "n2RespSiuLmpe", "responses from SIU to LMPE", false, Counter, ""},
+         {0x140/8, "n2ValidCycAckRespSiuLmpe", "% valid cycles acked for responses from SIU to LMPE", false, Ratio, "%"},
+         {0x148/8, "n2WaitCycRespSiuLmpe", "% wait cycles for responses from SIU to LMPE", false, Ratio, "%"},
+
+         {0x210/8, "n2VicBlkXRecv", "VicBlk and VicBlkClean commands received", false, Counter, ""},
+         {0x218/8, "n2RdBlkXRecv", "RdBlk and RdBlkS commands received", false, Counter, ""},
+         {0x220/8, "n2RdBlkModRecv", "RdBlkMod commands received", false, Counter, ""},
+         {0x228/8, "n2ChangeToDirtyRecv", "ChangeToDirty commands received", false, Counter, ""},
+         {0x230/8, "n2RdSizedRecv", "RdSized commands received", false, Counter, ""},
+         {0x238/8, "n2WrSizedRecv", "WrSized commands received", false, Counter, ""},
+         {0x240/8, "n2DirPrbRecv", "directed Probe commands received", false, Counter, ""},
+         {0x248/8, "n2BcastPrbRecv", "broadcast Probe commands received", false, Counter, ""},
+         {0x250/8, "n2BcastCmdRecv", "Broadcast commands received", false, Counter, ""},
+         {0x258/8, "n2RdRespCmdRecv", "RdResponse commands received", false, Counter, ""},
+         {0x260/8, "n2PrbRespCmdRecv", "ProbeResponse commands received", false, Counter, ""},
+         {0x268/8, "n2CachelinesRecv", "data packets with full cachelines of data received", false, Counter, ""},
+         {0x270/8, "n2PartCachelinesRecv", "data packets with less than a full cache line received", false, Counter, ""},
+
+         {0x278/8, "n2VicBlkXSent", "VicBlk and VicBlkClean commands sent", false, Counter, ""},
+         {0x280/8, "n2RdBlkXSent", "RdBlk and RdBlkS commands sent", false, Counter, ""},
+         {0x288/8, "n2RdBlkModSent", "RdBlkMod commands sent", false, Counter, ""},
+         {0x290/8, "n2ChangeToDirtySent", "ChangeToDirty commands sent", false, Counter, ""},
+         {0x298/8, "n2RdSizedSent", "RdSized commands sent", false, Counter, ""},
+         {0x2A0/8, "n2WrSizedSent", "WrSized commands sent", false, Counter, ""},
+         {0x2A8/8, "n2BcastProbeCmdSent", "broadcast Probe commands sent", false, Counter, ""},
+         {0x2B0/8, "n2BcastCmdSent", "broadcast commands sent", false, Counter, ""},
+         {0x2B8/8, "n2RdRespSent", "RdResponse commands sent", false, Counter, ""},
+         {0x2C0/8, "n2ProbeRespSent", "ProbeResponse commands sent", false, Counter, ""},
+         {0x2C8/8, "n2CachelinesSent", "data packets with full cachelines of data sent", false, Counter, ""},
+         {0x2D0/8, "n2LessCachelinesSent", "data packets with less than a full cache line sent", false, Counter, ""},
+
+         {0x2D8/8, "n2CacheReadHitRmpe", "nCache read hits on RMPE", false, Counter, ""},
+         {0x2E0/8, "n2CacheStoreHitRmpe", "nCache store hits on RMPE", false, Counter, ""},
+         {0x2E8/8, "n2CacheStoreMissRmpe", "nCache store misses on RMPE", false, Counter, ""},
+         {0x2F0/8, "n2CacheRolloutRmpe", "nCache roll outs on RMPE", false, Counter, ""},
+         {0x2F8/8, "n2CacheInvalidatesRmpe", "nCache invalidates on RMPE", false, Counter, ""},
+
+         {0x378/8, "n2CycOneFreeHreqPiu", "% cycles with at least one free Hreq context in PIU", false, Ratio, "%"},
+         {0x380/8, "n2CycOneFreePprb", "% cycles with at least one free Pprb context in PIU", false, Ratio, "%"},
+         {0x388/8, "n2CycOneFreeHprb", "% cycles with at least one free Hprb context in PIU", false, Ratio, "%"},
+         {0x390/8, "n2CycOneFreePreq", "% cycles with at least one free Preq context in PIU", false, Ratio, "%"},
+
+         {0x398/8, "n2CacheTag0Accesses", "accesses to Ctag cache 0", false, Counter, ""},
+         {0x3A0/8, "n2CacheTag0WriteHit", "write hit accesses to Ctag cache 0", false, Counter, ""},
+         {0x3A8/8, "n2CacheTag0ReadHit", "read hit accesses to Ctag cache 0", false, Counter, ""},
+         {0x3B0/8, "n2CacheTag0WriteWriteback", "write accesses with writebacks to Ctag cache 0", false, Counter, ""},
+         {0x3B8/8, "n2CacheTag0ReadWriteback", "read accesses with writebacks to Ctag cache 0", false, Counter, ""},
+         {0x3C0/8, "n2CacheTag0WriteMiss", "write miss accesses to Ctag cache 0", false, Counter, ""},
+         {0x3C8/8, "n2CacheTag0ReadMiss", "read miss accesses to Ctag cache 0", false, Counter, ""},
+
+         {0x3D0/8, "n2CacheTag1Accesses", "accesses to Ctag cache 1", false, Counter, ""},
+         {0x3D8/8, "n2CacheTag1WriteHit", "write hit accesses to Ctag cache 1", false, Counter, ""},
+         {0x3E0/8, "n2CacheTag1ReadHit", "read hit accesses to Ctag cache 1", false, Counter, ""},
+         {0x3E8/8, "n2CacheTag1WriteWriteback", "write accesses with writebacks to Ctag cache 1", false, Counter, ""},
+         {0x3F0/8, "n2CacheTag1ReadWriteback", "read accesses with writebacks to Ctag cache 1", false, Counter, ""},
+         {0x3F8/8, "n2CacheTag1WriteMiss", "write miss accesses to Ctag cache 1", false, Counter, ""},
+         {0x400/8, "n2CacheTag1ReadMiss", "read miss accesses to Ctag cache 1", false, Counter, ""},
+
+         {0x408/8, "n2CacheTag2Accesses", "accesses to Ctag cache 2", false, Counter, ""},
+         {0x410/8, "n2CacheTag2WriteHit", "write hit accesses to Ctag cache 2", false, Counter, ""},
+         {0x418/8, "n2CacheTag2ReadHit", "read hit accesses to Ctag cache 2", false, Counter, ""},
+         {0x420/8, "n2CacheTag2WriteWriteback", "write accesses with writebacks to Ctag cache 2", false, Counter, ""},
+         {0x428/8, "n2CacheTag2ReadWriteback", "read accesses with writebacks to Ctag cache 2", false, Counter, ""},
+         {0x430/8, "n2CacheTag2WriteMiss", "write miss accesses to Ctag cache 2", false, Counter, ""},
+         {0x438/8, "n2CacheTag2ReadMiss", "read miss accesses to Ctag cache 2", false, Counter, ""},
+
+         {0x440/8, "n2CacheTag3Accesses", "accesses to Ctag cache 3", false, Counter, ""},
+         {0x448/8, "n2CacheTag3WriteHit", "write hit accesses to Ctag cache 3", false, Counter, ""},
+         {0x450/8, "n2CacheTag3ReadHit", "read hit accesses to Ctag cache 3", false, Counter, ""},
+         {0x458/8, "n2CacheTag3WriteWriteback", "write accesses with writebacks to Ctag cache 3", false, Counter, ""},
+         {0x460/8, "n2CacheTag3ReadWriteback", "read accesses with writebacks to Ctag cache 3", false, Counter, ""},
+         {0x468/8, "n2CacheTag3WriteMiss", "write miss accesses to Ctag cache 3", false, Counter, ""},
+         {0x470/8, "n2CacheTag3ReadMiss", "read miss accesses to Ctag cache 3", false, Counter, ""},
+
+         {0x478/8, "n2MainTag0Access", "accesses to Mtag cache 0", false, Counter, ""},
+         {0x480/8, "n2MainTag0WriteHit", "write hit accesses to Mtag cache 0", false, Counter, ""},
+         {0x488/8, "n2MainTag0ReadHit", "read hit accesses to Mtag cache 0", false, Counter, ""},
+         {0x490/8, "n2MainTag0WriteWriteback", "write accesses with writebacks to Mtag cache 0", false, Counter, ""},
+         {0x498/8, "n2MainTag0ReadWriteback", "read accesses with writebacks to Mtag cache 0", false, Counter, ""},
+         {0x4A0/8, "n2MainTag0WriteMiss", "write miss accesses to Mtag cache 0", false, Counter, ""},
+         {0x4A8/8, "n2MainTag0ReadMiss", "read miss accesses to Mtag cache 0", false, Counter, ""},
+
+         {0x4B0/8, "n2MainTag1Access", "accesses to Mtag cache 1", false, Counter, ""},
+         {0x4B8/8, "n2MainTag1WriteHit", "write hit accesses to Mtag cache 1", false, Counter, ""},
+         {0x4C0/8, "n2MainTag1ReadHit", "read hit accesses to Mtag cache 1", false, Counter, ""},
+         {0x4C8/8, "n2MainTag1WriteWriteback", "write accesses with writebacks to Mtag cache 1", false, Counter, ""},
+         {0x4D0/8, "n2MainTag1ReadWriteback", "read accesses with writebacks to Mtag cache 1", false, Counter, ""},
+         {0x4D8/8, "n2MainTag1WriteMiss", "write miss accesses to Mtag cache 1", false, Counter, ""},
+         {0x4E0/8, "n2MainTag1ReadMiss", "read miss accesses to Mtag cache 1", false, Counter, ""},
+
+         {0x4E8/8, "n2MainTag2Access", "accesses to Mtag cache 2", false, Counter, ""},
+         {0x4F0/8, "n2MainTag2WriteHit", "write hit accesses to Mtag cache 2", false, Counter, ""},
+         {0x4F8/8, "n2MainTag2ReadHit", "read hit accesses to Mtag cache 2", false, Counter, ""},
+         {0x500/8, "n2MainTag2WriteWriteback", "write accesses with writebacks to Mtag cache 2", false, Counter, ""},
+         {0x508/8, "n2MainTag2ReadWriteback", "read accesses with writebacks to Mtag cache 2", false, Counter, ""},
+         {0x510/8, "n2MainTag2WriteMiss", "write miss accesses to Mtag cache 2", false, Counter, ""},
+         {0x518/8, "n2MainTag2ReadMiss", "read miss accesses to Mtag cache 2", false, Counter, ""},
+
+         {0x520/8, "n2MainTag3Access", "accesses to Mtag cache 3", false, Counter, ""},
+         {0x528/8, "n2MainTag3WriteHit", "write hit accesses to Mtag cache 3", false, Counter, ""},
+         {0x530/8, "n2MainTag3ReadHit", "read hit accesses to Mtag cache 3", false, Counter, ""},
+         {0x538/8, "n2MainTag3WriteAccess", "write accesses with writebacks to Mtag cache 3", false, Counter, ""},
+         {0x540/8, "n2MainTag3ReadAccess", "read accesses with writebacks to Mtag cache 3", false, Counter, ""},
+         {0x548/8, "n2MainTag3WriteMiss", "write miss accesses to Mtag cache 3", false, Counter, ""},
+         {0x550/8, "n2MainTag3ReadMiss", "read miss accesses to Mtag cache 3", false, Counter, ""},
       },
    }
 }
 
-func (d *Numaconnect2) Present() bool {
-   fd, err := unix.Open("/dev/mem", unix.O_RDWR, 0)
-   validate(err)
+func (m *DevMem) Map(base int64) (Registers, error) {
+   if !m.opened {
+      fd, err := unix.Open("/dev/mem", unix.O_RDWR, 0)
+      if err != nil {
+         return nil, err
+      }
 
-   data, err := unix.Mmap(fd, mapBase, mapLen, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_FILE)
-   validate(err)
-   defer unix.Munmap(data)
+      m.fd = fd
+      m.opened = true
+   }
+
+   data, err := unix.Mmap(m.fd, base, mapLen, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_FILE)
+   if err != nil {
+      return nil, err
+   }
 
    regs := (*[mapLen/4]uint32)(unsafe.Pointer(&data[0]))
-   if regs[venDev] != venDevId {
+   stats := (*[statsLen / 8]uint64)(unsafe.Pointer(&regs[statCounters]))
+
+   return &mappedRegs{data: data, regs: regs, stats: stats}, nil
+}
+
+func (m *DevMem) Unmap(regs Registers) error {
+   return unix.Munmap(regs.(*mappedRegs).data)
+}
+
+func (r *mappedRegs) Read(reg uint) uint32 {
+   return r.regs[reg]
+}
+
+func (r *mappedRegs) Write(reg uint, val uint32) {
+   r.regs[reg] = val
+}
+
+func (r *mappedRegs) Stat(index int16) uint64 {
+   return r.stats[index]
+}
+
+func (d *Numaconnect2) Present() bool {
+   // no access to physical memory means no hardware
+   regs, err := d.mapper.Map(mapBase)
+   if err != nil {
+      return false
+   }
+
+   // only needed to find the ring
+   defer d.mapper.Unmap(regs)
+
+   if regs.Read(venDev) != venDevId {
       return false
    }
 
-   master := (regs[info+5] >> 4) & 0xfff
-   hts := (regs[info+6] >> 12) & 7
+   master := (regs.Read(info+5) >> 4) & 0xfff
+   hts := (regs.Read(info+6) >> 12) & 7
 
    for pos := master; pos != 0xfff; {
       base := 0x3f0000000000 | (int64(pos) << 28) | ((23+int64(hts)) << 15)
 
-      data, err := unix.Mmap(fd, base, mapLen, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_FILE)
+      regs, err := d.mapper.Map(base)
       validate(err)
 
-      regs := (*[mapLen/4]uint32)(unsafe.Pointer(&data[0]))
-      if regs[venDev] != venDevId {
-         fmt.Printf("vendev %08x\n", regs[venDev])
+      if regs.Read(venDev) != venDevId {
+         fmt.Printf("vendev %08x\n", regs.Read(venDev))
          panic("mismatching vendev")
       }
 
-      stats := (*[statsLen / 8]uint64)(unsafe.Pointer(&regs[statCounters]))
-      d.cards = append(d.cards, Numachip2{regs: regs, stats: stats})
+      d.cards = append(d.cards, Numachip2{regs: regs})
 
-      pos = regs[info+6] & 0xfff
+      pos = regs.Read(info+6) & 0xfff
    }
 
    return true
@@ -263,9 +334,10 @@ func (d *Numaconnect2) Enable(discrete bool) {
    }
 
    for i := range d.cards {
-      d.cards[i].regs[statCtrl] = 0            // reset block
-      d.cards[i].regs[statCtrl] = 1 | (1 << 2) // enable counting
+      d.cards[i].regs.Write(statCtrl, 0)            // reset block
+      d.cards[i].regs.Write(statCtrl, 1 | (1 << 2)) // enable counting
       d.cards[i].last = make([]uint64, d.nEnabled)
+      d.cards[i].lastElapsed = 0
    }
 }
 
@@ -312,14 +384,14 @@ func (d *Numaconnect2) Sample() []int64 {
    nCards := len(d.cards)
 
    for n := range d.cards {
-      d.cards[n].regs[statCtrl] = 1 // disable counting
+      d.cards[n].regs.Write(statCtrl, 1) // disable counting
 
-      val := d.cards[n].stats[statElapsed]
+      val := d.cards[n].regs.Stat(statElapsed)
       var interval uint64 // in units of 5ns
 
       // if wrapped, add remainder
       if val < d.cards[n].lastElapsed {
-         interval = val + (wrapLimit - val)
+         interval = val + (wrapLimit - d.cards[n].lastElapsed) + 1
       } else {
          interval = val - d.cards[n].lastElapsed
       }
@@ -332,12 +404,12 @@ func (d *Numaconnect2) Sample() []int64 {
             continue
          }
 
-         val = d.cards[n].stats[event.index]
+         val = d.cards[n].regs.Stat(event.index)
          var delta uint64
 
          // if wrapped, add remainder
          if val < d.cards[n].last[i] {
-            delta = val + (wrapLimit - val)
+            delta = val + (wrapLimit - d.cards[n].last[i]) + 1
          } else {
             delta = val - d.cards[n].last[i]
          }
@@ -355,7 +427,7 @@ func (d *Numaconnect2) Sample() []int64 {
          i++
       }
 
-      d.cards[n].regs[statCtrl] = 1 | (1 << 2) // reenable counting
+      d.cards[n].regs.Write(statCtrl, 1 | (1 << 2)) // reenable counting
    }
 
    return samples
@@ -0,0 +1,315 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "io/ioutil"
+   "math"
+   "math/rand"
+   "strings"
+   "sync"
+   "time"
+)
+
+// generates traffic from a scenario, for demonstrating and developing without hardware
+type Synthetic struct {
+   scenario Scenario
+   events   []Event
+   phases   []time.Duration
+   period   time.Duration
+   discrete bool
+   nEnabled int
+   started  time.Time
+   random   *rand.Rand
+   clock    func() time.Time
+   mutex    sync.Mutex
+}
+
+type Scenario struct {
+   Name    string
+   Sources uint
+   Rate    uint // maximum value for percentage events
+   Seed    int64
+   Events  []ScenarioEvent
+   Phases  []ScenarioPhase
+}
+
+type ScenarioEvent struct {
+   Mnemonic string
+   Desc     string    // leading '%' denotes percentage of Rate
+   Kind     string    // "counter" (default), "gauge" or "ratio"
+   Unit     string    // units of gauges
+   Base     float64   // events per second or gauge value per source, or fraction of Rate for percentages
+   Skew     []float64 // per-source multiplier, repeating if shorter than Sources
+   Noise    float64   // relative standard deviation
+}
+
+type ScenarioPhase struct {
+   Name       string
+   Duration   string             // eg "10s"
+   Scale      map[string]float64 // multiplier per mnemonic; "*" applies to all others
+   Burst      float64            // probability a source bursts in a sample
+   BurstScale float64            // multiplier during a burst
+}
+
+// used with '-scenario demo'
+const demoScenario = `{
+   "Name": "demo",
+   "Sources": 4,
+   "Rate": 200000000,
+   "Events": [
+      {"Mnemonic": "synRemoteRead", "Desc": "remote cacheline reads", "Base": 3e6, "Skew": [1.6, 1, 0.7, 0.7], "Noise": 0.1},
+      {"Mnemonic": "synRemoteWrite", "Desc": "remote cacheline writebacks", "Base": 1e6, "Skew": [1.2, 1, 1, 0.8], "Noise": 0.15},
+      {"Mnemonic": "synProbeBcast", "Desc": "broadcast probes", "Base": 4e5, "Noise": 0.3},
+      {"Mnemonic": "synLocalAlloc", "Desc": "local page allocations", "Base": 2e4, "Skew": [1, 1, 0.5, 2], "Noise": 0.2},
+      {"Mnemonic": "synRemoteAlloc", "Desc": "remote page allocations", "Base": 2e3, "Skew": [0.5, 1, 1, 3], "Noise": 0.2},
+      {"Mnemonic": "synCacheBusy", "Desc": "% cycles remote cache busy", "Base": 0.3, "Skew": [1.5, 1, 0.8, 0.8], "Noise": 0.05},
+      {"Mnemonic": "synWaitCyc", "Desc": "% wait cycles for remote responses", "Base": 0.1, "Noise": 0.1}
+   ],
+   "Phases": [
+      {"Name": "idle", "Duration": "10s", "Scale": {"*": 0.05}},
+      {"Name": "initialise", "Duration": "8s", "Scale": {"synLocalAlloc": 20, "synRemoteAlloc": 10, "*": 0.5}},
+      {"Name": "compute", "Duration": "30s", "Scale": {"synRemoteRead": 2, "synCacheBusy": 2}, "Burst": 0.05, "BurstScale": 4},
+      {"Name": "exchange", "Duration": "10s", "Scale": {"synRemoteWrite": 4, "synProbeBcast": 6, "synWaitCyc": 5}, "Burst": 0.2, "BurstScale": 2},
+      {"Name": "checkpoint", "Duration": "6s", "Scale": {"synRemoteWrite": 8, "*": 0.3}}
+   ]
+}`
+
+func NewSynthetic() *Synthetic {
+   return &Synthetic{clock: time.Now}
+}
+
+// loads scenario from JSON, returning any error
+func (d *Synthetic) Load(input []byte) error {
+   var s Scenario
+
+   err := json.Unmarshal(input, &s)
+   if err != nil {
+      return err
+   }
+
+   if s.Sources == 0 {
+      s.Sources = 1
+   }
+
+   if len(s.Events) == 0 {
+      return fmt.Errorf("scenario %q has no events", s.Name)
+   }
+
+   d.scenario = s
+   d.events = make([]Event, len(s.Events))
+   d.phases = make([]time.Duration, len(s.Phases))
+   d.period = 0
+
+   for i, event := range s.Events {
+      kind := parseKind(event.Kind)
+      if strings.HasPrefix(event.Desc, "%") {
+         kind = Ratio
+      }
+
+      d.events[i] = Event{int16(i), event.Mnemonic, event.Desc, false, kind, event.Unit}
+   }
+
+   for i, phase := range s.Phases {
+      d.phases[i], err = time.ParseDuration(phase.Duration)
+      if err != nil {
+         return fmt.Errorf("phase %q: %v", phase.Name, err)
+      }
+
+      d.period += d.phases[i]
+   }
+
+   d.random = rand.New(rand.NewSource(s.Seed))
+   return nil
+}
+
+func (d *Synthetic) Present() bool {
+   if *scenario == "" {
+      return false
+   }
+
+   input := []byte(demoScenario)
+
+   if *scenario != "demo" {
+      var err error
+      input, err = ioutil.ReadFile(*scenario)
+      validate(err)
+   }
+
+   err := d.Load(input)
+   validate(err)
+
+   return true
+}
+
+func (d *Synthetic) Sources() uint {
+   return d.scenario.Sources
+}
+
+func (d *Synthetic) Name() string {
+   return "Synthetic"
+}
+
+func (d *Synthetic) Rate() uint {
+   return d.scenario.Rate
+}
+
+func (d *Synthetic) Lock() {
+   d.mutex.Lock()
+}
+
+func (d *Synthetic) Unlock() {
+   d.mutex.Unlock()
+}
+
+func (d *Synthetic) Enable(discrete bool) {
+   d.discrete = discrete
+   d.nEnabled = 0
+
+   for _, event := range d.events {
+      if event.enabled {
+         d.nEnabled++
+      }
+   }
+
+   if d.started.IsZero() {
+      d.started = d.clock()
+   }
+}
+
+func (d *Synthetic) Headings(mnemonics bool) []string {
+   var headings []string
+
+   for _, event := range d.events {
+      if !event.enabled {
+         continue
+      }
+
+      var name string
+      if mnemonics {
+         name = event.mnemonic
+      } else {
+         name = event.desc
+      }
+
+      if d.discrete {
+         for i := uint(0); i < d.scenario.Sources; i++ {
+            heading := fmt.Sprintf("%s:%d", name, i)
+            headings = append(headings, heading)
+         }
+      } else {
+         headings = append(headings, name)
+      }
+   }
+
+   return headings
+}
+
+// finds the phase active at elapsed time, looping the scenario
+func (d *Synthetic) phase(elapsed time.Duration) *ScenarioPhase {
+   if d.period == 0 {
+      return nil
+   }
+
+   elapsed %= d.period
+
+   for i := range d.phases {
+      if elapsed < d.phases[i] {
+         return &d.scenario.Phases[i]
+      }
+
+      elapsed -= d.phases[i]
+   }
+
+   return nil
+}
+
+func (d *Synthetic) value(index int, phase *ScenarioPhase, source uint) float64 {
+   event := &d.scenario.Events[index]
+   val := event.Base
+
+   if len(event.Skew) > 0 {
+      val *= event.Skew[int(source) % len(event.Skew)]
+   }
+
+   if phase != nil {
+      if scale, ok := phase.Scale[event.Mnemonic]; ok {
+         val *= scale
+      } else if scale, ok := phase.Scale["*"]; ok {
+         val *= scale
+      }
+
+      if phase.Burst > 0 && d.random.Float64() < phase.Burst {
+         val *= phase.BurstScale
+      }
+   }
+
+   val *= 1 + event.Noise * d.random.NormFloat64()
+
+   if d.events[index].kind == Ratio {
+      // fraction of maximum rate
+      val = math.Min(val, 1) * float64(d.scenario.Rate)
+   }
+
+   return math.Max(val, 0)
+}
+
+func (d *Synthetic) Sample() []int64 {
+   var samples []int64
+
+   d.Lock()
+   defer d.Unlock()
+
+   nSources := int(d.scenario.Sources)
+
+   if d.discrete {
+      samples = make([]int64, d.nEnabled * nSources)
+   } else {
+      samples = make([]int64, d.nEnabled)
+   }
+
+   phase := d.phase(d.clock().Sub(d.started))
+   i := 0
+
+   for j, event := range d.events {
+      if !event.enabled {
+         continue
+      }
+
+      for n := 0; n < nSources; n++ {
+         sample := int64(d.value(j, phase, uint(n)))
+
+         if d.discrete {
+            samples[i*nSources+n] = sample
+         } else {
+            // sum all sources
+            samples[i] += sample
+         }
+      }
+
+      i++
+   }
+
+   return samples
+}
+
+func (d *Synthetic) Events() []Event {
+   return d.events
+}
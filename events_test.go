@@ -19,12 +19,16 @@ package main
 
 import (
    "fmt"
+   "io/ioutil"
+   "os"
+   "path/filepath"
    "testing"
+   "time"
 )
 
 func TestMain(m *testing.M) {
    fmt.Println("TestMain")
-   dev := &Numaconnect2{}
+   dev := NewNumaconnect2()
 
    if dev.Present() {
       events := dev.Events()
@@ -39,4 +43,222 @@ func TestMain(m *testing.M) {
    } else {
       fmt.Println("Numachip2 not detected")
    }
+
+   os.Exit(m.Run())
+}
+
+func emulated(nCards int) (*Numaconnect2, *Emulator) {
+   emu := NewEmulator(nCards)
+   emu.clock = nil
+   dev := NewNumaconnect2With(emu)
+
+   if !dev.Present() {
+      panic("emulated Numachip2 not detected")
+   }
+
+   return dev, emu
+}
+
+func TestNumaconnect2Discovery(t *testing.T) {
+   dev, _ := emulated(3)
+
+   if dev.Sources() != 3 {
+      t.Errorf("discovered %d cards, expected 3", dev.Sources())
+   }
+}
+
+func TestNumaconnect2Sample(t *testing.T) {
+   dev, emu := emulated(2)
+   events := dev.Events()
+   events[0].enabled = true
+   events[3].enabled = true
+
+   for card := 0; card < 2; card++ {
+      emu.SetRate(card, events[0].index, 500)
+      emu.SetRate(card, events[3].index, uint64(10 * (card+1)))
+   }
+
+   dev.Enable(true)
+
+   headings := dev.Headings(true)
+   expected := []string{"n2CycRmpeHalf:0", "n2CycRmpeHalf:1", "n2ReqPiuRmpe:0", "n2ReqPiuRmpe:1"}
+   if fmt.Sprint(headings) != fmt.Sprint(expected) {
+      t.Errorf("headings %v, expected %v", headings, expected)
+   }
+
+   emu.Advance(1000000)
+   samples := dev.Sample()
+   want := []int64{100000000, 100000000, 2000000, 4000000}
+   if fmt.Sprint(samples) != fmt.Sprint(want) {
+      t.Errorf("discrete samples %v, expected %v", samples, want)
+   }
+
+   dev.Enable(false)
+
+   headings = dev.Headings(true)
+   if len(headings) != 2 {
+      t.Errorf("averaged headings %v", headings)
+   }
+
+   emu.Advance(1000000)
+   samples = dev.Sample()
+   want = []int64{200000000, 6000000}
+   if fmt.Sprint(samples) != fmt.Sprint(want) {
+      t.Errorf("averaged samples %v, expected %v", samples, want)
+   }
+}
+
+func TestNumaconnect2Wrap(t *testing.T) {
+   dev, emu := emulated(1)
+   events := dev.Events()
+   events[3].enabled = true
+   emu.SetRate(0, events[3].index, 100)
+   dev.Enable(false)
+
+   emu.Advance(1000)
+   _ = dev.Sample()
+
+   // place both counters just short of 48-bit limit
+   emu.Preset(0, statElapsed, wrapLimit - 499)
+   emu.Preset(0, events[3].index, wrapLimit - 49)
+   dev.cards[0].lastElapsed = wrapLimit - 499
+   dev.cards[0].last[0] = wrapLimit - 49
+
+   emu.Advance(1000)
+   samples := dev.Sample()
+   if samples[0] != 20000000 {
+      t.Errorf("sample across wrap %d, expected 20000000", samples[0])
+   }
+}
+
+func TestSyntheticPhases(t *testing.T) {
+   now := time.Unix(0, 0)
+   dev := NewSynthetic()
+   dev.clock = func() time.Time { return now }
+
+   err := dev.Load([]byte(`{
+      "Sources": 2,
+      "Rate": 1000,
+      "Events": [
+         {"Mnemonic": "reads", "Desc": "reads", "Base": 100, "Skew": [1, 3]},
+         {"Mnemonic": "busy", "Desc": "% busy", "Base": 0.5}
+      ],
+      "Phases": [
+         {"Name": "quiet", "Duration": "1s", "Scale": {"*": 0.1}},
+         {"Name": "busy", "Duration": "1s", "Scale": {"busy": 4}}
+      ]
+   }`))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   events := dev.Events()
+   events[0].enabled = true
+   events[1].enabled = true
+   dev.Enable(true)
+
+   samples := dev.Sample()
+   want := []int64{10, 30, 50, 50}
+   if fmt.Sprint(samples) != fmt.Sprint(want) {
+      t.Errorf("first phase samples %v, expected %v", samples, want)
+   }
+
+   now = now.Add(1500 * time.Millisecond)
+   dev.Enable(false)
+
+   // percentage is limited to rate
+   samples = dev.Sample()
+   want = []int64{400, 2000}
+   if fmt.Sprint(samples) != fmt.Sprint(want) {
+      t.Errorf("second phase samples %v, expected %v", samples, want)
+   }
+}
+
+func TestNodes(t *testing.T) {
+   root, err := ioutil.TempDir("", "nodes")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(root)
+
+   write := func(node int, numaMiss int) {
+      dir := filepath.Join(root, fmt.Sprintf("node%d", node))
+      os.MkdirAll(dir, 0755)
+      numastat := fmt.Sprintf("numa_hit 100\nnuma_miss %d\nlocal_node 100\n", numaMiss)
+      ioutil.WriteFile(filepath.Join(dir, "numastat"), []byte(numastat), 0644)
+      ioutil.WriteFile(filepath.Join(dir, "vmstat"), []byte("nr_free_pages 5\nnuma_hit 100\n"), 0644)
+   }
+
+   write(0, 0)
+   write(2, 0)
+
+   dev := NewNodes()
+   dev.root = root
+   if !dev.Present() {
+      t.Fatal("nodes not detected")
+   }
+
+   var mnemonics []string
+   for _, event := range dev.Events() {
+      mnemonics = append(mnemonics, event.mnemonic)
+   }
+
+   expected := "[node_numa_hit node_numa_miss node_numa_local node_nr_free_pages]"
+   if fmt.Sprint(mnemonics) != expected {
+      t.Errorf("events %v, expected %v", mnemonics, expected)
+   }
+
+   dev.Events()[1].enabled = true
+   dev.Enable(true)
+
+   headings := dev.Headings(true)
+   if fmt.Sprint(headings) != "[node_numa_miss:0 node_numa_miss:2]" {
+      t.Errorf("headings %v", headings)
+   }
+
+   _ = dev.Sample()
+   write(2, 1000000)
+   samples := dev.Sample()
+
+   if samples[0] != 0 || samples[1] <= 0 {
+      t.Errorf("samples %v, expected misses only on node 2", samples)
+   }
+}
+
+func TestKernelDiscovery(t *testing.T) {
+   f, err := ioutil.TempFile("", "vmstat")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.Remove(f.Name())
+
+   f.WriteString("nr_free_pages 100\nnuma_hint_faults 5\nnr_made_up 7\npgmade_up 9\n")
+   f.Close()
+
+   dev := NewKernel()
+   dev.path = f.Name()
+   if !dev.Present() {
+      t.Fatal("vmstat not detected")
+   }
+
+   events := dev.Events()
+   if len(events) != 4 {
+      t.Fatalf("discovered %d fields, expected 4", len(events))
+   }
+
+   if events[1].desc != "NUMA hinting faults" || events[0].kind != Gauge {
+      t.Errorf("curated metadata not applied: %+v %+v", events[0], events[1])
+   }
+
+   if events[2].desc != "undocumented nr_made_up" || events[2].kind != Gauge || events[3].kind != Counter {
+      t.Errorf("unknown fields misclassified: %+v %+v", events[2], events[3])
+   }
+
+   events[0].enabled = true
+   dev.Enable(false)
+
+   samples := dev.Sample()
+   if samples[0] != 100 {
+      t.Errorf("gauge sample %d, expected 100", samples[0])
+   }
 }
@@ -0,0 +1,504 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "encoding/json"
+   "fmt"
+   "io/ioutil"
+   "net"
+   "net/http"
+   "net/url"
+   "path"
+   "sort"
+   "strings"
+   "sync"
+   "time"
+)
+
+type ExportConfig struct {
+   Exporters []ExporterConfig
+}
+
+// a sink and the events forwarded to it
+type ExporterConfig struct {
+   Name    string            // used in messages, defaults to URL
+   Format  string            // "influx", "graphite" or "statsd"
+   URL     string            // tcp://host:port, udp://host:port or http(s)://...
+   Events  []string          // mnemonic patterns, eg "n2*"; all if empty
+   Sensors []string          // sensor names; all if empty
+   Prefix  string            // of graphite and statsd paths, default "numascope"
+   Tags    map[string]string // added to influx points
+   Batch   int               // lines per write, default 500
+   Buffer  int               // lines held while sink is unavailable, default 100000
+   Flush   string            // maximum delay before writing, default "1s"
+}
+
+// encodes a point as one line of a protocol
+type ExportFormat interface {
+   Encode(buf *bytes.Buffer, p *Point, timestamp int64, dt float64)
+}
+
+type influxFormat struct {
+   tags string // sorted and escaped
+}
+
+type graphiteFormat struct {
+   prefix string
+}
+
+type statsdFormat struct {
+   prefix string
+}
+
+// forwards points to a sink without blocking sampling
+type Exporter struct {
+   config   ExporterConfig
+   format   ExportFormat
+   url      *url.URL
+   flush    time.Duration
+   lines    [][]byte
+   dropped  uint64
+   wake     chan struct{}
+   conn     net.Conn
+   client   *http.Client
+   mutex    sync.Mutex
+   sending  sync.Mutex
+}
+
+const (
+   maxBackoff = 30 * time.Second
+   maxDatagram = 1400
+   sinkTimeout = 5 * time.Second
+)
+
+var exporters []*Exporter
+
+var (
+   influxMeasurement = strings.NewReplacer(",", `\,`, " ", `\ `)
+   influxTag = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// replaces characters with special meaning in graphite and statsd paths
+func pathElem(s string) string {
+   return strings.Map(func(r rune) rune {
+      if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+         return r
+      }
+
+      return '_'
+   }, s)
+}
+
+// measurement per event, tagged with sensor and source; counters are rates per second
+func (f *influxFormat) Encode(buf *bytes.Buffer, p *Point, timestamp int64, dt float64) {
+   buf.WriteString(influxMeasurement.Replace(p.Event.mnemonic))
+   buf.WriteString(",sensor=")
+   buf.WriteString(influxTag.Replace(p.Sensor))
+
+   if p.SourceLabel != "" {
+      fmt.Fprintf(buf, ",%s=%s", p.SourceLabel, influxTag.Replace(p.Source))
+   }
+
+   fmt.Fprintf(buf, "%s value=%g %d\n", f.tags, p.Value, timestamp * 1e3)
+}
+
+// prefix.sensor.event[.cardN]; counters are rates per second
+func (f *graphiteFormat) Encode(buf *bytes.Buffer, p *Point, timestamp int64, dt float64) {
+   fmt.Fprintf(buf, "%s.%s.%s", f.prefix, pathElem(p.Sensor), pathElem(p.Event.mnemonic))
+
+   if p.SourceLabel != "" {
+      fmt.Fprintf(buf, ".%s%s", p.SourceLabel, pathElem(p.Source))
+   }
+
+   fmt.Fprintf(buf, " %g %d\n", p.Value, timestamp / 1e6)
+}
+
+// prefix.event[.cardN]; counters are counts over the interval
+func (f *statsdFormat) Encode(buf *bytes.Buffer, p *Point, timestamp int64, dt float64) {
+   fmt.Fprintf(buf, "%s.%s", f.prefix, pathElem(p.Event.mnemonic))
+
+   if p.SourceLabel != "" {
+      fmt.Fprintf(buf, ".%s%s", p.SourceLabel, pathElem(p.Source))
+   }
+
+   if p.Event.kind == Counter {
+      fmt.Fprintf(buf, ":%g|c\n", p.Value * dt)
+   } else {
+      fmt.Fprintf(buf, ":%g|g\n", p.Value)
+   }
+}
+
+func NewExporter(config ExporterConfig) (*Exporter, error) {
+   e := &Exporter{config: config, wake: make(chan struct{}, 1), client: &http.Client{Timeout: sinkTimeout}}
+
+   var err error
+   e.url, err = url.Parse(config.URL)
+   if err != nil {
+      return nil, err
+   }
+
+   switch e.url.Scheme {
+   case "tcp", "udp", "http", "https":
+   default:
+      return nil, fmt.Errorf("exporter URL '%s' needs tcp, udp, http or https scheme", config.URL)
+   }
+
+   if e.config.Name == "" {
+      e.config.Name = config.URL
+   }
+
+   if e.config.Prefix == "" {
+      e.config.Prefix = "numascope"
+   }
+
+   if e.config.Batch <= 0 {
+      e.config.Batch = 500
+   }
+
+   if e.config.Buffer <= 0 {
+      e.config.Buffer = 100000
+   } else if e.config.Buffer < e.config.Batch {
+      e.config.Buffer = e.config.Batch
+   }
+
+   e.flush = time.Second
+   if config.Flush != "" {
+      e.flush, err = time.ParseDuration(config.Flush)
+      if err != nil {
+         return nil, err
+      }
+   }
+
+   for _, pattern := range config.Events {
+      _, err = path.Match(pattern, "")
+      if err != nil {
+         return nil, fmt.Errorf("invalid event pattern '%s'", pattern)
+      }
+   }
+
+   switch config.Format {
+   case "influx":
+      var keys []string
+      for key := range config.Tags {
+         keys = append(keys, key)
+      }
+      sort.Strings(keys)
+
+      var tags string
+      for _, key := range keys {
+         tags += "," + influxTag.Replace(key) + "=" + influxTag.Replace(config.Tags[key])
+      }
+
+      e.format = &influxFormat{tags}
+   case "graphite":
+      e.format = &graphiteFormat{e.config.Prefix}
+   case "statsd":
+      e.format = &statsdFormat{e.config.Prefix}
+   default:
+      return nil, fmt.Errorf("unknown exporter format '%s'", config.Format)
+   }
+
+   return e, nil
+}
+
+// checks if point is in the configured event group
+func (e *Exporter) selected(p *Point) bool {
+   if len(e.config.Sensors) > 0 {
+      found := false
+
+      for _, name := range e.config.Sensors {
+         found = found || name == p.Sensor
+      }
+
+      if !found {
+         return false
+      }
+   }
+
+   if len(e.config.Events) == 0 {
+      return true
+   }
+
+   for _, pattern := range e.config.Events {
+      if ok, _ := path.Match(pattern, p.Event.mnemonic); ok {
+         return true
+      }
+   }
+
+   return false
+}
+
+// discards oldest lines beyond buffer; called with mutex held
+func (e *Exporter) bound() {
+   if n := len(e.lines) - e.config.Buffer; n > 0 {
+      e.lines = e.lines[n:]
+      e.dropped += uint64(n)
+   }
+}
+
+// queues points, discarding the oldest if the sink is unavailable
+func (e *Exporter) Push(points []Point, timestamp int64, dt float64) {
+   var buf bytes.Buffer
+   var lines [][]byte
+
+   for i := range points {
+      if !e.selected(&points[i]) {
+         continue
+      }
+
+      start := buf.Len()
+      e.format.Encode(&buf, &points[i], timestamp, dt)
+      lines = append(lines, buf.Bytes()[start:buf.Len()])
+   }
+
+   if len(lines) == 0 {
+      return
+   }
+
+   e.mutex.Lock()
+   e.lines = append(e.lines, lines...)
+   e.bound()
+   full := len(e.lines) >= e.config.Batch
+   e.mutex.Unlock()
+
+   if full {
+      select {
+      case e.wake <- struct{}{}:
+      default:
+      }
+   }
+}
+
+func (e *Exporter) take() [][]byte {
+   e.mutex.Lock()
+   defer e.mutex.Unlock()
+
+   n := len(e.lines)
+   if n > e.config.Batch {
+      n = e.config.Batch
+   }
+
+   batch := e.lines[:n:n]
+   e.lines = e.lines[n:]
+
+   return batch
+}
+
+// returns unsent lines to the front of the queue
+func (e *Exporter) requeue(batch [][]byte) {
+   e.mutex.Lock()
+   defer e.mutex.Unlock()
+
+   e.lines = append(batch, e.lines...)
+   e.bound()
+}
+
+func (e *Exporter) write(batch [][]byte) error {
+   switch e.url.Scheme {
+   case "http", "https":
+      resp, err := e.client.Post(e.config.URL, "text/plain; charset=utf-8", bytes.NewReader(bytes.Join(batch, nil)))
+      if err != nil {
+         return err
+      }
+
+      ioutil.ReadAll(resp.Body)
+      resp.Body.Close()
+
+      if resp.StatusCode / 100 != 2 {
+         return fmt.Errorf("%s", resp.Status)
+      }
+
+      return nil
+   }
+
+   if e.conn == nil {
+      conn, err := net.DialTimeout(e.url.Scheme, e.url.Host, sinkTimeout)
+      if err != nil {
+         return err
+      }
+
+      e.conn = conn
+   }
+
+   e.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+   var err error
+
+   if e.url.Scheme == "udp" {
+      // datagrams hold whole lines
+      var datagram []byte
+
+      for _, line := range batch {
+         if len(datagram) > 0 && len(datagram) + len(line) > maxDatagram {
+            _, err = e.conn.Write(datagram)
+            if err != nil {
+               break
+            }
+
+            datagram = nil
+         }
+
+         datagram = append(datagram, line...)
+      }
+
+      if err == nil && len(datagram) > 0 {
+         _, err = e.conn.Write(datagram)
+      }
+   } else {
+      _, err = e.conn.Write(bytes.Join(batch, nil))
+   }
+
+   if err != nil {
+      e.conn.Close()
+      e.conn = nil
+   }
+
+   return err
+}
+
+// writes queued lines, returning any error after requeuing
+func (e *Exporter) send() error {
+   e.sending.Lock()
+   defer e.sending.Unlock()
+
+   for {
+      batch := e.take()
+      if len(batch) == 0 {
+         return nil
+      }
+
+      err := e.write(batch)
+      if err != nil {
+         e.requeue(batch)
+         return err
+      }
+   }
+}
+
+func (e *Exporter) run() {
+   backoff := e.flush
+   timer := time.NewTimer(e.flush)
+
+   for {
+      select {
+      case <-e.wake:
+      case <-timer.C:
+      }
+
+      err := e.send()
+      delay := e.flush
+
+      // retry with exponential backoff while sink is unavailable
+      if err != nil {
+         if *debug {
+            fmt.Printf("exporter %s failed: %v\n", e.config.Name, err)
+         }
+
+         delay = backoff
+         backoff *= 2
+         if backoff > maxBackoff {
+            backoff = maxBackoff
+         }
+
+         // drain wakeups during backoff
+         time.Sleep(delay)
+         select {
+         case <-e.wake:
+         default:
+         }
+
+         delay = 0
+      } else {
+         backoff = e.flush
+      }
+
+      if !timer.Stop() {
+         select {
+         case <-timer.C:
+         default:
+         }
+      }
+
+      timer.Reset(delay)
+   }
+}
+
+// reports lines discarded as the buffer was full
+func (e *Exporter) Dropped() uint64 {
+   e.mutex.Lock()
+   defer e.mutex.Unlock()
+
+   return e.dropped
+}
+
+func startExporters(name string) {
+   if name == "" {
+      return
+   }
+
+   input, err := ioutil.ReadFile(name)
+   validate(err)
+
+   var config ExportConfig
+   err = json.Unmarshal(input, &config)
+   validate(err)
+
+   for _, c := range config.Exporters {
+      e, err := NewExporter(c)
+      validate(err)
+
+      exporters = append(exporters, e)
+      go e.run()
+   }
+}
+
+// forwards a sampling pass covering dt in s, with values parallel to sensors
+// describes samples for any exporters; called with controlMutex held, so events match the samples
+func exportPoints(sensors []Sensor, values [][]int64) []Point {
+   if len(exporters) == 0 {
+      return nil
+   }
+
+   var points []Point
+   for i, sensor := range sensors {
+      points = append(points, pointsOf(sensor, values[i])...)
+   }
+
+   return points
+}
+
+func export(timestamp int64, dt float64, points []Point) {
+   for _, e := range exporters {
+      e.Push(points, timestamp, dt)
+   }
+}
+
+// makes a last attempt to write queued lines
+func flushExporters() {
+   for _, e := range exporters {
+      err := e.send()
+      if err != nil {
+         fmt.Printf("exporter %s failed: %v\n", e.config.Name, err)
+      }
+
+      if dropped := e.Dropped(); dropped > 0 {
+         fmt.Printf("exporter %s dropped %d lines\n", e.config.Name, dropped)
+      }
+   }
+}
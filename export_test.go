@@ -0,0 +1,163 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "io/ioutil"
+   "net"
+   "net/http"
+   "net/http/httptest"
+   "strings"
+   "testing"
+   "time"
+)
+
+// points of the second sample of the test recording, per source
+func testPoints() []Point {
+   rec := testRecording(1)
+   d := NewPlayback(&rec.Header.Sensors[0], 0)
+   for i := range d.events {
+      d.events[i].enabled = true
+   }
+
+   d.Enable(true)
+   d.set(rec.Samples[1].Values)
+
+   return pointsOf(d, d.Sample())
+}
+
+func TestExportStatsd(t *testing.T) {
+   conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer conn.Close()
+
+   e, err := NewExporter(ExporterConfig{Format: "statsd", URL: "udp://"+conn.LocalAddr().String(), Events: []string{"re*", "free"}})
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   e.Push(testPoints(), 1000000, 0.5)
+   err = e.send()
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   buf := make([]byte, maxDatagram)
+   conn.SetReadDeadline(time.Now().Add(time.Second))
+   n, _, err := conn.ReadFrom(buf)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   expected := "numascope.reads.source0:5|c\nnumascope.reads.source1:50|c\nnumascope.free.source0:51|g\nnumascope.free.source1:50|g\n"
+   if string(buf[:n]) != expected {
+      t.Errorf("received %q, expected %q", buf[:n], expected)
+   }
+}
+
+func TestExportGraphiteRetry(t *testing.T) {
+   // find a free port, with sink initially down
+   listener, err := net.Listen("tcp", "127.0.0.1:0")
+   if err != nil {
+      t.Fatal(err)
+   }
+   addr := listener.Addr().String()
+   listener.Close()
+
+   e, err := NewExporter(ExporterConfig{Format: "graphite", URL: "tcp://"+addr, Sensors: []string{"test"}, Events: []string{"reads"}, Batch: 2, Buffer: 3})
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   e.Push(testPoints(), 1000000, 1)
+   e.Push(testPoints(), 2000000, 1)
+
+   if e.send() == nil {
+      t.Fatal("expected failure with sink down")
+   }
+
+   // oldest discarded beyond buffer
+   if e.Dropped() != 1 || len(e.lines) != 3 {
+      t.Fatalf("dropped %d, %d queued", e.Dropped(), len(e.lines))
+   }
+
+   listener, err = net.Listen("tcp", addr)
+   if err != nil {
+      t.Skip("port reused:", err)
+   }
+   defer listener.Close()
+
+   received := make(chan []string)
+   go func() {
+      var lines []string
+      conn, err := listener.Accept()
+      if err == nil {
+         conn.SetReadDeadline(time.Now().Add(time.Second))
+         scanner := bufio.NewScanner(conn)
+         for len(lines) < 3 && scanner.Scan() {
+            lines = append(lines, scanner.Text())
+         }
+         conn.Close()
+      }
+      received <- lines
+   }()
+
+   err = e.send()
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   lines := <-received
+   expected := []string{"numascope.test.reads.source1 100 1", "numascope.test.reads.source0 10 2", "numascope.test.reads.source1 100 2"}
+   if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+      t.Errorf("received %q, expected %q", lines, expected)
+   }
+}
+
+func TestExportInflux(t *testing.T) {
+   received := make(chan string, 1)
+   server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      body, _ := ioutil.ReadAll(r.Body)
+      received <- string(body)
+      w.WriteHeader(http.StatusNoContent)
+   }))
+   defer server.Close()
+
+   e, err := NewExporter(ExporterConfig{Format: "influx", URL: server.URL+"/write?db=numa", Events: []string{"busy"}, Tags: map[string]string{"site": "lab 1"}})
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   e.Push(testPoints(), 1000000, 1)
+   err = e.send()
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   expected := "busy,sensor=test,source=0,site=lab\\ 1 value=0.5 1000000000\nbusy,sensor=test,source=1,site=lab\\ 1 value=0.1 1000000000\n"
+   if body := <-received; body != expected {
+      t.Errorf("received %q, expected %q", body, expected)
+   }
+
+   if _, err = NewExporter(ExporterConfig{Format: "opentsdb", URL: "tcp://localhost:4242"}); err == nil {
+      t.Error("expected unknown format to fail")
+   }
+}
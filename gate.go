@@ -0,0 +1,343 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "encoding/xml"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "math"
+   "os"
+   "path/filepath"
+   "strings"
+   "text/tabwriter"
+)
+
+// baseline recording and limits a recording is evaluated against
+type GateSpec struct {
+   Baseline string // relative to the specification file
+   Align    string // "labels" (default) or "start"
+   Select   string // spans or labels compared, as with -select
+   Checks   []GateCheck
+}
+
+type GateCheck struct {
+   Event       string   // mnemonic for the whole event, summed across any sources, or heading
+   Phase       string   // label, or "all" (default)
+   Metric      string   // "total" (default for counters) or "mean"
+   MaxIncrease *float64 // percentage
+   MaxDecrease *float64 // percentage
+   Significant bool     // only fail on statistically significant changes
+}
+
+type GateResult struct {
+   Event    string
+   Phase    string
+   Metric   string
+   Baseline float64
+   Value    float64
+   Change   *float64 `json:",omitempty"` // percentage
+   Limit    string
+   Passed   bool
+   Message  string   `json:",omitempty"`
+}
+
+type GateReport struct {
+   Baseline  string
+   Recording string
+   Passed    bool
+   Notes     []string
+   Results   []GateResult
+}
+
+func loadGateSpec(name string) (*GateSpec, error) {
+   input, err := ioutil.ReadFile(name)
+   if err != nil {
+      return nil, err
+   }
+
+   var spec GateSpec
+   err = json.Unmarshal(input, &spec)
+   if err != nil {
+      return nil, fmt.Errorf("%s: %v", name, err)
+   }
+
+   if spec.Baseline == "" {
+      return nil, fmt.Errorf("%s: no baseline", name)
+   }
+
+   if !filepath.IsAbs(spec.Baseline) {
+      spec.Baseline = filepath.Join(filepath.Dir(name), spec.Baseline)
+   }
+
+   if spec.Align == "" {
+      spec.Align = "labels"
+   }
+
+   for i := range spec.Checks {
+      check := &spec.Checks[i]
+
+      if check.Event == "" {
+         return nil, fmt.Errorf("%s: check %d has no event", name, i+1)
+      }
+
+      if check.MaxIncrease == nil && check.MaxDecrease == nil {
+         return nil, fmt.Errorf("%s: check of %s has no limit", name, check.Event)
+      }
+
+      if check.Phase == "" {
+         check.Phase = "all"
+      }
+
+      switch check.Metric {
+      case "", "total", "mean":
+      default:
+         return nil, fmt.Errorf("%s: unknown metric '%s'", name, check.Metric)
+      }
+   }
+
+   return &spec, nil
+}
+
+func (check *GateCheck) evaluate(cmp *Comparison) GateResult {
+   res := GateResult{Event: check.Event, Phase: check.Phase, Metric: check.Metric}
+
+   if check.MaxIncrease != nil {
+      res.Limit = fmt.Sprintf("+%g%%", *check.MaxIncrease)
+   }
+   if check.MaxDecrease != nil {
+      if res.Limit != "" {
+         res.Limit += " "
+      }
+      res.Limit += fmt.Sprintf("-%g%%", *check.MaxDecrease)
+   }
+
+   // headings, or mnemonics of whole events whatever their sources
+   var d *Difference
+   for i := range cmp.Differences {
+      c := &cmp.Differences[i]
+      if c.Phase == check.Phase && (c.Name == check.Event || c.Mnemonic == check.Event && c.source == -1) {
+         d = c
+         break
+      }
+   }
+
+   if d == nil {
+      res.Message = fmt.Sprintf("%s not comparable in phase '%s'", check.Event, check.Phase)
+      return res
+   }
+
+   if res.Metric == "" {
+      res.Metric = "mean"
+      if d.Kind == Counter.String() {
+         res.Metric = "total"
+      }
+   }
+
+   if res.Metric == "total" {
+      res.Baseline, res.Value = d.TotalA, d.TotalB
+   } else {
+      res.Baseline, res.Value = d.MeanA, d.MeanB
+   }
+
+   var change float64
+   switch {
+   case res.Baseline != 0:
+      change = (res.Value - res.Baseline) / math.Abs(res.Baseline) * 100
+      res.Change = &change
+   case res.Value > 0:
+      change = math.Inf(1)
+   case res.Value < 0:
+      change = math.Inf(-1)
+   }
+
+   res.Passed = true
+
+   if check.Significant && !d.Significant {
+      return res
+   }
+
+   if check.MaxIncrease != nil && change > *check.MaxIncrease {
+      res.Passed = false
+      res.Message = fmt.Sprintf("%s %s increased from %.6g to %.6g", check.Event, res.Metric, res.Baseline, res.Value)
+   }
+
+   if check.MaxDecrease != nil && change < -*check.MaxDecrease {
+      res.Passed = false
+      res.Message = fmt.Sprintf("%s %s decreased from %.6g to %.6g", check.Event, res.Metric, res.Baseline, res.Value)
+   }
+
+   return res
+}
+
+func gateOf(spec *GateSpec, baseline, rec *Recording) (*GateReport, error) {
+   cmp, err := compare(baseline, rec, spec.Align, spec.Select)
+   if err != nil {
+      return nil, err
+   }
+
+   report := &GateReport{Baseline: spec.Baseline, Passed: true, Notes: cmp.Notes}
+
+   for i := range spec.Checks {
+      res := spec.Checks[i].evaluate(cmp)
+      report.Passed = report.Passed && res.Passed
+      report.Results = append(report.Results, res)
+   }
+
+   return report, nil
+}
+
+func writeGateTable(w io.Writer, report *GateReport) error {
+   for _, note := range report.Notes {
+      fmt.Fprintf(w, "note: %s\n", note)
+   }
+
+   tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+   fmt.Fprintln(tw, "result\tphase\tevent\tmetric\tbaseline\tvalue\tchange\tlimit")
+
+   for _, res := range report.Results {
+      status := "pass"
+      if !res.Passed {
+         status = "FAIL"
+      }
+
+      change := "-"
+      if res.Change != nil {
+         change = fmt.Sprintf("%+.1f%%", *res.Change)
+      }
+
+      fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.6g\t%.6g\t%s\t%s\n",
+         status, res.Phase, res.Event, res.Metric, res.Baseline, res.Value, change, res.Limit)
+   }
+
+   err := tw.Flush()
+   if err != nil {
+      return err
+   }
+
+   for _, res := range report.Results {
+      if !res.Passed {
+         fmt.Fprintf(w, "%s\n", res.Message)
+      }
+   }
+
+   return nil
+}
+
+type junitFailure struct {
+   Message string `xml:"message,attr"`
+   Text    string `xml:",chardata"`
+}
+
+type junitCase struct {
+   Name      string        `xml:"name,attr"`
+   Classname string        `xml:"classname,attr"`
+   Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitSuite struct {
+   XMLName  xml.Name    `xml:"testsuite"`
+   Name     string      `xml:"name,attr"`
+   Tests    int         `xml:"tests,attr"`
+   Failures int         `xml:"failures,attr"`
+   Cases    []junitCase `xml:"testcase"`
+}
+
+func writeJUnit(w io.Writer, report *GateReport) error {
+   suite := junitSuite{Name: "numascope", Tests: len(report.Results)}
+
+   for _, res := range report.Results {
+      c := junitCase{Name: strings.TrimSpace(res.Event + " " + res.Metric), Classname: "numascope." + res.Phase}
+
+      if !res.Passed {
+         suite.Failures++
+         c.Failure = &junitFailure{res.Message, fmt.Sprintf("baseline %s, limit %s", report.Baseline, res.Limit)}
+      }
+
+      suite.Cases = append(suite.Cases, c)
+   }
+
+   io.WriteString(w, xml.Header)
+   enc := xml.NewEncoder(w)
+   enc.Indent("", "   ")
+   err := enc.Encode(suite)
+   if err != nil {
+      return err
+   }
+
+   _, err = io.WriteString(w, "\n")
+   return err
+}
+
+func writeGateFile(name string, report *GateReport, write func(io.Writer, *GateReport) error) {
+   if name == "" {
+      return
+   }
+
+   f, err := os.Create(name)
+   validate(err)
+
+   err = write(f, report)
+   validate(err)
+
+   err = f.Close()
+   validate(err)
+}
+
+func writeGateJSON(w io.Writer, report *GateReport) error {
+   enc := json.NewEncoder(w)
+   enc.SetIndent("", "   ")
+   return enc.Encode(report)
+}
+
+// exits with 2 on regression, as errors exit with 1
+func gate(args []string) {
+   if len(args) != 2 {
+      fmt.Println("syntax: gate <specification> <filename>")
+      os.Exit(1)
+   }
+
+   spec, err := loadGateSpec(args[0])
+   validate(err)
+
+   if *selection != "" {
+      spec.Select = *selection
+   }
+
+   baseline, err := loadRecording(spec.Baseline)
+   validate(err)
+
+   rec, err := loadRecording(args[1])
+   validate(err)
+
+   report, err := gateOf(spec, baseline, rec)
+   validate(err)
+   report.Recording = args[1]
+
+   err = writeGateTable(os.Stdout, report)
+   validate(err)
+
+   writeGateFile(*resultFile, report, writeGateJSON)
+   writeGateFile(*junitFile, report, writeJUnit)
+
+   if !report.Passed {
+      os.Exit(2)
+   }
+}
@@ -0,0 +1,150 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "io/ioutil"
+   "os"
+   "strings"
+   "testing"
+)
+
+func TestGate(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   spec := dir + "/spec.json"
+   err = ioutil.WriteFile(spec, []byte(`{
+      "Baseline": "baseline.json",
+      "Checks": [
+         {"Event": "reads:0", "MaxIncrease": 50},
+         {"Event": "free:0", "Phase": "phase 1", "MaxIncrease": 50},
+         {"Event": "misses", "MaxIncrease": 10}
+      ]
+   }`), 0644)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   s, err := loadGateSpec(spec)
+   if err != nil || s.Baseline != dir + "/baseline.json" || s.Align != "labels" {
+      t.Fatalf("unexpected specification %+v: %v", s, err)
+   }
+
+   report, err := gateOf(s, testRecording(1), testRecording(2))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // doubled reads fail, unchanged gauge passes, missing event fails
+   if report.Passed || len(report.Results) != 3 {
+      t.Fatalf("unexpected report %+v", report)
+   }
+
+   if res := report.Results[0]; res.Passed || res.Metric != "total" || *res.Change != 100 {
+      t.Errorf("unexpected reads:0 result %+v", res)
+   }
+
+   if res := report.Results[1]; !res.Passed || res.Metric != "mean" {
+      t.Errorf("unexpected free:0 result %+v", res)
+   }
+
+   if res := report.Results[2]; res.Passed || res.Message == "" {
+      t.Errorf("unexpected misses result %+v", res)
+   }
+
+   var buf bytes.Buffer
+   err = writeJUnit(&buf, report)
+   if err != nil || !strings.Contains(buf.String(), `failures="2"`) {
+      t.Errorf("unexpected JUnit output %s: %v", buf.String(), err)
+   }
+
+   buf.Reset()
+   err = writeGateJSON(&buf, report)
+   if err != nil || !strings.Contains(buf.String(), `"Passed": false`) {
+      t.Errorf("unexpected JSON output %s: %v", buf.String(), err)
+   }
+}
+
+// headings of single-source sensors are descriptions, so checks name mnemonics
+func TestGateSingleSource(t *testing.T) {
+   max := 10.0
+   spec := &GateSpec{Align: "labels", Checks: []GateCheck{
+      {Event: "numa_miss", Phase: "all", MaxIncrease: &max},
+      {Event: "nr_dirty", Phase: "solve", MaxIncrease: &max},
+   }}
+
+   report, err := gateOf(spec, singleSourceRecording(1), singleSourceRecording(1))
+   if err != nil || !report.Passed || report.Results[0].Baseline != 150 || report.Results[1].Baseline != 103.5 {
+      t.Errorf("identical recordings failed %+v: %v", report, err)
+   }
+
+   // the open span continues to the end
+   report, err = gateOf(spec, singleSourceRecording(1), singleSourceRecording(2))
+   if err != nil || report.Passed || report.Results[0].Value != 300 || !report.Results[1].Passed {
+      t.Errorf("doubled misses passed %+v: %v", report, err)
+   }
+}
+
+// without a phase, checks cover only the selected spans or labels
+func TestGateSelect(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   err = ioutil.WriteFile(dir + "/spec.json", []byte(`{
+      "Baseline": "baseline.json",
+      "Select": "phase*",
+      "Checks": [
+         {"Event": "reads:0", "MaxIncrease": 50},
+         {"Event": "free:0", "MaxIncrease": 50}
+      ]
+   }`), 0644)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   spec, err := loadGateSpec(dir + "/spec.json")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   report, err := gateOf(spec, testRecording(1), testRecording(2))
+   if err != nil || len(report.Results) != 2 {
+      t.Fatalf("unexpected report %+v: %v", report, err)
+   }
+
+   whole, err := compare(testRecording(1), testRecording(1), "labels", "")
+   if err != nil || whole.Differences[0].Name != "reads:0" {
+      t.Fatalf("unexpected comparison %+v: %v", whole, err)
+   }
+
+   if res := report.Results[0]; res.Passed || res.Phase != "all" || res.Baseline >= whole.Differences[0].TotalA {
+      t.Errorf("unexpected reads:0 result %+v", res)
+   }
+
+   if res := report.Results[1]; !res.Passed || res.Message != "" {
+      t.Errorf("unexpected free:0 result %+v", res)
+   }
+}
@@ -18,8 +18,9 @@
 package main
 
 import (
-   "bytes"
+   "crypto/tls"
    "fmt"
+   "net"
    "net/http"
    "strconv"
    "strings"
@@ -33,7 +34,10 @@ import (
 type SignonMessage struct {
    Timestamp int64
    Tree      map[string][]string
+   Kinds     map[string][]string // parallel to Tree
+   Units     map[string][]string // parallel to Tree
    Sources   map[string]uint
+   Role      string // "control", or "view" when changes are refused
 }
 
 type ChangeMessage struct {
@@ -42,54 +46,85 @@ type ChangeMessage struct {
    Interval  int
    Discrete  bool
    Enabled   map[string][]string
+   Replay    *ReplayState `json:",omitempty"`
 }
 
 type LabelMessage struct {
    Op        string
    Timestamp int64
    Label     string
+   Kind      string            `json:",omitempty"` // "begin" or "end" of a span
+   Span      string            `json:",omitempty"`
+   Attrs     map[string]string `json:",omitempty"`
+}
+
+type ErrorMessage struct {
+   Op    string
+   Error string
 }
 
 type Connection struct {
    socket  *websocket.Conn
-   mutex   *sync.Mutex
+   mutex   *sync.Mutex // of socket writes and stopped
    stopped bool
+   role    string
 }
 
+const handshakeTimeout = 10 * time.Second
+
 var (
    upgrader = websocket.Upgrader{}
    connections []*Connection
+   connectionsMutex sync.Mutex // as clients connect from their own goroutines
 )
 
 func live() {
-   initweb(*listenAddr)
-   labelBuf := make([]byte, 256)
+   http.HandleFunc("/api/", api)
+   initweb(serveAddr())
+   fifoBuf := make([]byte, 256)
 
    var lastTimestamp int64 = 0
    var epochs [][]int64
+   last := time.Now()
 
    for {
-      time.Sleep(time.Duration(*interval) * time.Millisecond)
+      period := currentInterval()
+      time.Sleep(period)
 
-      // forward any label
-      n, err := unix.Read(fifo, labelBuf)
-      validateNonblock(err)
+      pollFifo(fifoBuf)
 
-      timestamp := time.Now().UnixNano() / 1e3
+      now := time.Now()
+      timestamp := now.UnixNano() / 1e3
 
-      if n > 0 {
-         broadcastLabel(timestamp, string(bytes.TrimSpace(labelBuf[:n])))
-      }
+      // sampled even without clients, for metrics
+      samples := []int64{timestamp}
+      dt := now.Sub(last).Seconds()
+      last = now
 
-      // avoid wasting processor time
-      if len(connections) == 0 {
-         continue
+      var points []Point
+      controlMutex.Lock()
+
+      // described under the lock, as events may change
+      for _, sensor := range present {
+         values := sensor.Sample()
+         sensorPoints := pointsOf(sensor, values)
+         metrics.Observe(sensor.Name(), sensorPoints, dt, generation)
+         points = append(points, sensorPoints...)
+         samples = append(samples, values...)
       }
 
-      samples := []int64{timestamp}
+      // started through the API or control socket
+      writeSample(timestamp, samples[1:])
+      controlMutex.Unlock()
 
-      for _, sensor := range present {
-         samples = append(samples, sensor.Sample()...)
+      export(timestamp, dt, points)
+
+      duration := time.Since(now)
+      metrics.Sampled(duration, duration > period)
+
+      if clientCount() == 0 {
+         epochs = nil
+         continue
       }
 
       // coalesce
@@ -115,8 +150,37 @@ func (c *Connection) WriteJSON(msg interface{}) error {
    return err
 }
 
-func change(c Connection) {
-   msg := ChangeMessage{
+// snapshot of connected clients, which may be iterated while others connect
+func clients() []*Connection {
+   connectionsMutex.Lock()
+   defer connectionsMutex.Unlock()
+
+   return append([]*Connection(nil), connections...)
+}
+
+func clientCount() int {
+   connectionsMutex.Lock()
+   defer connectionsMutex.Unlock()
+
+   return len(connections)
+}
+
+func (c *Connection) setStopped(stopped bool) {
+   c.mutex.Lock()
+   c.stopped = stopped
+   c.mutex.Unlock()
+}
+
+func (c *Connection) isStopped() bool {
+   c.mutex.Lock()
+   defer c.mutex.Unlock()
+
+   return c.stopped
+}
+
+// describes enabled events, interval and mode; called with controlMutex held
+func changeMessage() *ChangeMessage {
+   msg := &ChangeMessage{
       Op: "enabled",
       Timestamp: time.Now().UnixNano() / 1e3,
       Interval: *interval,
@@ -124,6 +188,10 @@ func change(c Connection) {
       Enabled: make(map[string][]string),
    }
 
+   if player != nil {
+      msg.Replay = player.State()
+   }
+
    // structure events into hashmap
    for _, sensor := range present {
       name := sensor.Name()
@@ -136,20 +204,35 @@ func change(c Connection) {
       }
    }
 
-   err := c.WriteJSON(&msg)
+   return msg
+}
+
+func writeChange(c *Connection, msg *ChangeMessage) {
+   err := c.WriteJSON(msg)
    if err != nil && *debug {
       fmt.Println("failed writing:", err)
    }
 }
 
-func broadcastLabel(timestamp int64, label string) {
+func change(c *Connection) {
+   controlMutex.Lock()
+   msg := changeMessage()
+   controlMutex.Unlock()
+
+   writeChange(c, msg)
+}
+
+func broadcastLabel(label Label) {
    msg := LabelMessage{
       Op: "label",
-      Timestamp: timestamp,
-      Label: label,
+      Timestamp: label.Timestamp,
+      Label: label.Text,
+      Kind: label.Kind,
+      Span: label.Span,
+      Attrs: label.Attrs,
    }
 
-   for _, c := range connections {
+   for _, c := range clients() {
       err := c.WriteJSON(&msg)
       if err != nil && *debug {
          fmt.Println("failed writing:", err)
@@ -158,8 +241,8 @@ func broadcastLabel(timestamp int64, label string) {
 }
 
 func broadcastData(epochs [][]int64) {
-   for _, c := range connections {
-      if c.stopped {
+   for _, c := range clients() {
+      if c.isStopped() {
          continue
       }
 
@@ -171,70 +254,64 @@ func broadcastData(epochs [][]int64) {
    }
 }
 
-func remove(c *websocket.Conn) {
-   for i := range connections {
-      if connections[i].socket == c {
-         connections[i] = connections[len(connections)-1]
-         connections = connections[:len(connections)-1]
-         return
-      }
+// ops changing what all clients see
+func controlling(op string) bool {
+   switch op {
+   case "update", "averaging", "interval", "seek", "speed", "loop", "pause", "resume":
+      return true
    }
 
-   panic("element not found")
+   return false
 }
 
-func state(desc string, state bool) {
-   for _, sensor := range present {
-      events := sensor.Events()
-      sensor.Lock()
+// tells client why op was refused, restoring the state it may have changed locally
+func refuse(c *Connection, op string) {
+   err := c.WriteJSON(&ErrorMessage{Op: "error", Error: fmt.Sprintf("'%s' needs a controlling token", op)})
+   if err != nil && *debug {
+      fmt.Println("failed writing:", err)
+   }
 
-      // check if 'all' button was selected
-      if desc == /*sensor.Name() +*/ "all" {
-         for i := range events {
-            events[i].enabled = true
-         }
+   change(c)
+}
 
-         sensor.Enable(*discrete)
-         sensor.Unlock()
-         // discard values to initialise last
-         sensor.Sample()
-         return
-      }
+func remove(c *websocket.Conn) {
+   connectionsMutex.Lock()
+   defer connectionsMutex.Unlock()
 
-      for i := range events {
-         if events[i].desc == desc {
-            events[i].enabled = state
-            sensor.Enable(*discrete)
-            sensor.Unlock()
-            // discard values to initialise last
-            sensor.Sample()
-            return
-         }
+   for i := range connections {
+      if connections[i].socket == c {
+         connections[i] = connections[len(connections)-1]
+         connections = connections[:len(connections)-1]
+         return
       }
-
-      sensor.Unlock()
    }
 
-   panic("event '"+desc+"' not found")
+   panic("element not found")
 }
 
 func toggle(desc string, val string) {
+   var err error
+
    switch (val) {
    case "on":
-      state(desc, true)
+      err = controlEvents([]string{desc}, true)
    case "off":
-      state(desc, false)
+      err = controlEvents([]string{desc}, false)
    default:
-      panic("unexpected state")
+      err = fmt.Errorf("unexpected state '%s'", val)
    }
 
-   // update all clients
-   for _, c := range connections {
-      change(*c)
+   if err != nil {
+      fmt.Println(err)
    }
 }
 
 func monitor(w http.ResponseWriter, r *http.Request) {
+   if auth.Blocked(r) {
+      http.Error(w, "too many failed authentications", http.StatusTooManyRequests)
+      return
+   }
+
    socket, err := upgrader.Upgrade(w, r, nil)
    if err != nil {
       if *debug {
@@ -248,6 +325,7 @@ func monitor(w http.ResponseWriter, r *http.Request) {
    c := Connection{socket: socket, mutex: &sync.Mutex{}}
 
    // handshake
+   c.socket.SetReadDeadline(time.Now().Add(handshakeTimeout))
    _, message, err := c.socket.ReadMessage()
    if err != nil {
       if *debug {
@@ -256,10 +334,12 @@ func monitor(w http.ResponseWriter, r *http.Request) {
       return
    }
 
-   if string(message) != "463ba1974b06" {
-      if *debug {
-         fmt.Println("auth failed")
-      }
+   c.socket.SetReadDeadline(time.Time{})
+
+   c.role = auth.Role(string(message))
+   if c.role == "" {
+      auth.Failed(r, "invalid token")
+      c.socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "invalid token"), time.Now().Add(time.Second))
       return
    }
 
@@ -270,20 +350,25 @@ func monitor(w http.ResponseWriter, r *http.Request) {
    msg := SignonMessage{
       Timestamp: time.Now().UnixNano() / 1e3,
       Tree: make(map[string][]string, len(present)),
+      Kinds: make(map[string][]string, len(present)),
+      Units: make(map[string][]string, len(present)),
       Sources: make(map[string]uint, len(present)),
+      Role: c.role,
    }
 
-   msg.Tree = make(map[string][]string)
-
    for _, sensor := range present {
       name := sensor.Name()
       events := sensor.Events()
 
       msg.Tree[name] = make([]string, len(events))
+      msg.Kinds[name] = make([]string, len(events))
+      msg.Units[name] = make([]string, len(events))
       msg.Sources[name] = sensor.Sources()
 
       for i, val := range events {
          msg.Tree[name][i] = val.desc
+         msg.Kinds[name][i] = val.kind.String()
+         msg.Units[name][i] = val.unit
       }
    }
 
@@ -295,8 +380,11 @@ func monitor(w http.ResponseWriter, r *http.Request) {
       return
    }
 
-   change(c);
+   change(&c)
+
+   connectionsMutex.Lock()
    connections = append(connections, &c)
+   connectionsMutex.Unlock()
 
    for {
       var msg map[string]string
@@ -314,24 +402,41 @@ func monitor(w http.ResponseWriter, r *http.Request) {
          fmt.Printf("recv %#v\n", msg)
       }
 
+      if controlling(msg["Op"]) && c.role != roleControl {
+         refuse(&c, msg["Op"])
+         continue
+      }
+
       switch msg["Op"] {
       case "update":
          toggle(msg["Event"], msg["State"])
       case "stop":
-         c.stopped = true
+         c.setStopped(true)
       case "start":
-         c.stopped = false
+         c.setStopped(false)
       case "averaging":
-         *discrete = msg["Value"] == "false"
-         Activate()
-
-         for _, c2 := range connections {
-            change(*c2)
+         err = controlDiscrete(msg["Value"] == "false")
+         if err != nil {
+            fmt.Println(err)
          }
       case "interval":
-         *interval, err = strconv.Atoi(msg["Value"])
+         var ms int
+         ms, err = strconv.Atoi(msg["Value"])
+         if err == nil {
+            err = controlInterval(ms)
+         }
          if err != nil {
-            fmt.Printf("undefined value %v\n", msg["Value"])
+            fmt.Printf("undefined value %v: %v\n", msg["Value"], err)
+         }
+      case "seek", "speed", "loop", "pause", "resume":
+         if player == nil {
+            fmt.Printf("received replay control %+v when live\n", msg)
+            break
+         }
+
+         err = player.Control(msg["Op"], msg["Value"])
+         if err != nil {
+            fmt.Println(err)
          }
       default:
          fmt.Printf("received unknown message %+v\n", msg)
@@ -339,7 +444,8 @@ func monitor(w http.ResponseWriter, r *http.Request) {
    }
 }
 
-func initweb(addr string) {
+// finds installed or development web resources
+func resourcePath() string {
    path := "/usr/local/share/numascope"
    err := unix.Access(path, unix.R_OK)
    if err != nil {
@@ -350,11 +456,51 @@ func initweb(addr string) {
       }
    }
 
-   fileServer := http.FileServer(http.Dir(path))
+   return path
+}
+
+func listen(addr string) {
+   var err error
+   auth, err = NewAuthenticator(*httpAuth, *tokenFile, *passwordFile, *origins)
+   validate(err)
+
+   upgrader.CheckOrigin = auth.CheckOrigin
+
+   listener, err := net.Listen("tcp", addr)
+   validate(err)
+
+   scheme := "http"
+   if tlsEnabled() {
+      config, err := tlsConfig()
+      validate(err)
+
+      listener = tls.NewListener(listener, config)
+      scheme = "https"
+   }
+
+   go http.Serve(listener, auth.Handler(http.DefaultServeMux))
+   port := strings.Split(addr, ":")[1]
+   fmt.Printf("web interface available on port %s over %s\n", port, scheme)
+}
+
+func initweb(addr string) {
+   fileServer := http.FileServer(http.Dir(resourcePath()))
    http.Handle("/", fileServer)
    http.HandleFunc("/monitor", monitor)
+   http.HandleFunc("/metrics", metrics.serve)
 
-   go http.ListenAndServe(addr, nil)
-   port := strings.Split(addr, ":")[1]
-   fmt.Printf("web interface available on port %s\n", port)
+   listen(addr)
+
+   if auth.generated {
+      scheme := "http"
+      if tlsEnabled() {
+         scheme = "https"
+      }
+
+      port := strings.Split(addr, ":")[1]
+      for _, role := range []string{roleView, roleControl} {
+         token := auth.generatedToken(role)
+         fmt.Printf("web interface %s token %s, eg %s://<host>:%s/#token=%s\n", role, token, scheme, port, token)
+      }
+   }
 }
@@ -22,6 +22,7 @@ import (
    "fmt"
    "io/ioutil"
    "os"
+   "regexp"
    "strconv"
    "strings"
 
@@ -29,29 +30,64 @@ import (
 )
 
 const (
+   version = "1.1"
    fifoPath = "/run/numascope-ctl"
    pidPath = "/run/numascope.pid"
    coalescing = 600e3
+   simulatedCards = 4
+   offlineAddr = "0.0.0.0:8080"
+   tlsAddr = "0.0.0.0:443"
+   offlineTLSAddr = "0.0.0.0:8443"
 )
 
 var (
 // TODO enable advanced when there is useful discrimitation
-//   advanced   = flag.Bool("advanced", false, "list all events")
-   listenAddr = flag.String("listenAddr", "0.0.0.0:80", "web service listen address and port")
-   debug      = flag.Bool("debug", false, "print debugging output")
-   events     = flag.String("events", "pgfault,pgalloc_normal,pgfree,numa_local,n2VicBlkXSent,n2RdBlkXSent,n2RdBlkModSent,n2ChangeToDirtySent,n2BcastProbeCmdSent,n2RdRespSent,n2ProbeRespSent", "comma-separated list of events")
-   list       = flag.Bool("list", false, "list events available on this host")
-   discrete   = flag.Bool("discrete", false, "report events per unit, rather than average")
-   recordFile = flag.String("filename", "output.json", "filename to record to")
-   interval   = flag.Int("interval", 256, "sample interval in ms")
-   overwrite  = flag.Bool("overwrite", false, "overwrite existing file")
+//   advanced     = flag.Bool("advanced", false, "list all events")
+   listenAddr   = flag.String("listenAddr", "0.0.0.0:80", "web service listen address and port")
+   debug        = flag.Bool("debug", false, "print debugging output")
+   events       = flag.String("events", "pgfault,pgalloc_normal,pgfree,numa_local,n2VicBlkXSent,n2RdBlkXSent,n2RdBlkModSent,n2ChangeToDirtySent,n2BcastProbeCmdSent,n2RdRespSent,n2ProbeRespSent", "comma-separated list of events, or 'all'")
+   list         = flag.Bool("list", false, "list events available on this host")
+   discrete     = flag.Bool("discrete", false, "report events per unit, rather than average")
+   recordFile   = flag.String("filename", "output.json", "filename to record to")
+   recordDir    = flag.String("recordDir", "", "directory of recordings started through the API or control socket, rather than that of -filename")
+   format       = flag.String("format", "", "recording format 'json', 'lines', 'binary' or 'csv', rather than from filename extension")
+   interval     = flag.Int("interval", 256, "sample interval in ms")
+   overwrite    = flag.Bool("overwrite", false, "overwrite existing file")
+   rotateSize   = flag.Int("rotateSize", 0, "start new recording file after this many MB")
+   rotatePeriod = flag.Duration("rotatePeriod", 0, "start new recording file after this period, eg 24h")
+   rotateLabel  = flag.String("rotateLabel", "", "start new recording file at labels matching regular expression")
+   outputFormat = flag.String("output", "text", "report output 'text', 'csv' or 'json'")
+   align        = flag.String("align", "labels", "diff recordings aligned by 'start' or matching 'labels'")
+   resultFile   = flag.String("result", "", "write gate result as JSON to file")
+   junitFile    = flag.String("junit", "", "write gate result as JUnit XML to file")
+   selection    = flag.String("select", "", "report, diff, gate or convert only spans and labels matching comma-separated names or key=value attributes")
+   threshold    = flag.String("threshold", "", "report share of time above threshold, as value or comma-separated event=value")
+   simulate     = flag.Bool("simulate", false, "emulate NumaConnect2 hardware")
+   scenario     = flag.String("scenario", "", "generate synthetic events from scenario file, or 'demo'")
+   exportFile   = flag.String("export", "", "forward samples to sinks configured in JSON file")
+   speed        = flag.Float64("speed", 1, "replay speed relative to real time")
+   loop         = flag.Bool("loop", false, "replay repeatedly")
+   replayFrom   = flag.Duration("from", 0, "replay from this far into the recording, eg 1h")
+   httpAuth     = flag.String("httpAuth", "none", "require HTTP authentication 'none', 'basic' or 'bearer' for the web interface")
+   tokenFile    = flag.String("tokenFile", "", "file of web interface tokens, rather than generating one")
+   passwordFile = flag.String("passwordFile", "", "file of user:password lines for basic authentication")
+   tlsCert      = flag.String("tlsCert", "", "serve web interface over TLS with certificate file")
+   tlsKey       = flag.String("tlsKey", "", "private key file of TLS certificate")
+   selfSigned   = flag.Bool("selfSigned", false, "serve over TLS, generating a self-signed certificate on first start unless -tlsCert exists")
+   origins      = flag.String("origins", "", "comma-separated origins of pages allowed to connect, besides this server")
+   socketPath   = flag.String("socket", "/run/numascope.sock", "control socket path")
+   socketMode   = flag.String("socketMode", "0600", "control socket permissions, limiting who may send commands")
+   socketGroup  = flag.String("socketGroup", "", "control socket group, eg to allow commands with socketMode 0660")
 
    // highest priority first
-   present    = []Sensor{
+   present      = []Sensor{
       NewNumaconnect2(),
       NewKernel(),
+      NewNodes(),
+      NewSynthetic(),
    }
-   fifo       int
+   fifo         int
+   mode         string
 )
 
 func dups() {
@@ -95,10 +131,31 @@ func Activate() {
 }
 
 func usage() {
-   fmt.Println("Usage: numascope [option...] stat|live|record [command] [argument...]")
+   fmt.Println("Usage: numascope [option...] stat|live|record [command] [argument...]\n       numascope repair <filename>\n       numascope convert <input> <output>\n       numascope report <filename>\n       numascope diff <first> <second>\n       numascope gate <specification> <filename>\n       numascope replay <filename>\n       numascope view [filename|directory...]\n       numascope ctl [command [argument...]]")
    flag.PrintDefaults()
 }
 
+// unprivileged users can't listen on port 80, so use an alternate default
+func serveAddr() string {
+   set := false
+   flag.Visit(func(f *flag.Flag) {
+      set = set || f.Name == "listenAddr"
+   })
+
+   switch {
+   case set:
+      return *listenAddr
+   case os.Geteuid() != 0 && tlsEnabled():
+      return offlineTLSAddr
+   case os.Geteuid() != 0:
+      return offlineAddr
+   case tlsEnabled():
+      return tlsAddr
+   }
+
+   return *listenAddr
+}
+
 func exclusive() {
    content, err := ioutil.ReadFile(pidPath)
 
@@ -126,12 +183,46 @@ func main() {
    flag.Usage = usage
    flag.Parse()
 
-   if os.Geteuid() != 0 {
+   // offline commands need no privileges or hardware
+   switch flag.Arg(0) {
+   case "repair":
+      repair(flag.Args()[1:])
+      return
+   case "convert":
+      convert(flag.Args()[1:])
+      return
+   case "report":
+      report(flag.Args()[1:])
+      return
+   case "diff":
+      diff(flag.Args()[1:])
+      return
+   case "gate":
+      gate(flag.Args()[1:])
+      return
+   case "replay":
+      replay(flag.Args()[1:])
+      return
+   case "view":
+      view(flag.Args()[1:])
+      return
+   case "ctl":
+      ctl(flag.Args()[1:])
+      return
+   }
+
+   // the emulator needs no privileges
+   if *simulate {
+      present[0] = NewNumaconnect2With(NewEmulator(simulatedCards))
+   } else if os.Geteuid() != 0 {
       fmt.Println("please run with sudo/root")
       os.Exit(1)
    }
 
-   exclusive()
+   // the pid file is only writable by root
+   if os.Geteuid() == 0 {
+      exclusive()
+   }
 
    // remove any sensors where probe fails
    for i := len(present)-1; i >= 0; i-- {
@@ -148,7 +239,7 @@ func main() {
 
       for _, elem := range elems {
          for i := range events {
-            if events[i].mnemonic == elem {
+            if events[i].mnemonic == elem || elem == "all" {
                events[i].enabled = true
                total++
             }
@@ -163,20 +254,39 @@ func main() {
       os.Exit(0)
    }
 
-   // expected to fail if already exists
-   unix.Umask(0)
-   unix.Mkfifo(fifoPath, 0666)
+   startExporters(*exportFile)
 
-   var err error
-   fifo, err = unix.Open(fifoPath, unix.O_RDONLY|unix.O_NONBLOCK, 0)
-   validate(err)
+   // recordings may be started in any mode
+   if *rotateLabel != "" {
+      var err error
+      rotatePattern, err = regexp.Compile(*rotateLabel)
+      validate(err)
+   }
+
+   // under /run, so unprivileged emulation is only controlled through the web interface
+   fifo = -1
+   if os.Geteuid() == 0 {
+      // expected to fail if already exists; any user may label
+      unix.Umask(0)
+      unix.Mkfifo(fifoPath, 0666)
+
+      var err error
+      fifo, err = unix.Open(fifoPath, unix.O_RDONLY|unix.O_NONBLOCK, 0)
+      validate(err)
+
+      listener := listenControl(*socketPath)
+      defer os.Remove(*socketPath)
+      defer listener.Close()
+   }
 
    if flag.NArg() < 1 {
       flag.Usage()
       os.Exit(1)
    }
 
-   switch flag.Arg(0) {
+   mode = flag.Arg(0)
+
+   switch mode {
    case "stat":
       stat()
    case "live":
@@ -0,0 +1,281 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "io"
+   "net/http"
+   "sort"
+   "strings"
+   "sync"
+   "time"
+)
+
+// one labelled value of a Prometheus metric
+type metricSeries struct {
+   name   string
+   help   string
+   kind   string // "counter" or "gauge"
+   labels string
+   value  float64
+}
+
+// accumulates samples for exposition in Prometheus text format
+type Metrics struct {
+   series   map[string]*metricSeries
+   generations map[string]int // of enabled events of each sensor
+   observed map[string]map[string]int // generation each series of each sensor was last observed
+   samples  uint64
+   overruns uint64
+   duration time.Duration // of last sampling pass
+   last     time.Time
+   mutex    sync.Mutex
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+   return &Metrics{series: make(map[string]*metricSeries), generations: make(map[string]int), observed: make(map[string]map[string]int)}
+}
+
+// replaces characters not permitted in metric names
+func metricName(s string) string {
+   return strings.Map(func(r rune) rune {
+      if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+         return r
+      }
+
+      return '_'
+   }, s)
+}
+
+func labelValue(s string) string {
+   return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// label naming the source of per-source headings
+func sourceLabel(sensor string) string {
+   switch sensor {
+   case "NumaConnect2":
+      return "card"
+   case "NUMA nodes":
+      return "node"
+   default:
+      return "source"
+   }
+}
+
+// sampled value of an event from one source, or all sources
+type Point struct {
+   Sensor      string
+   Event       Event
+   SourceLabel string // "card", "node" or "source", if per source
+   Source      string
+   Value       float64 // rate per second of counters, fraction of ratios
+}
+
+// describes samples of enabled events
+func pointsOf(sensor Sensor, values []int64) []Point {
+   var enabled []Event
+   for _, event := range sensor.Events() {
+      if event.enabled {
+         enabled = append(enabled, event)
+      }
+   }
+
+   if len(enabled) == 0 || len(values) == 0 {
+      return nil
+   }
+
+   headings := sensor.Headings(true)
+   perEvent := len(values) / len(enabled)
+   if perEvent == 0 {
+      perEvent = 1
+   }
+
+   points := make([]Point, 0, len(values))
+
+   for i, val := range values {
+      if i / perEvent >= len(enabled) {
+         break
+      }
+
+      p := Point{Sensor: sensor.Name(), Event: enabled[i / perEvent], Value: float64(val)}
+
+      // per-source headings are suffixed with ':N'
+      if i < len(headings) {
+         if j := strings.LastIndex(headings[i], ":"); j != -1 {
+            p.SourceLabel = sourceLabel(p.Sensor)
+            p.Source = headings[i][j+1:]
+         }
+      }
+
+      if p.Event.kind == Ratio {
+         p.Value = 0
+         if rate := sensor.Rate(); rate > 0 {
+            p.Value = float64(val) / float64(rate)
+         }
+      }
+
+      points = append(points, p)
+   }
+
+   return points
+}
+
+// adds samples of enabled events covering interval dt in s, expiring series of events since disabled
+func (m *Metrics) Observe(name string, points []Point, dt float64, generation int) {
+   m.mutex.Lock()
+   defer m.mutex.Unlock()
+
+   expire := m.generations[name] != generation
+   m.generations[name] = generation
+
+   observed := m.observed[name]
+   if observed == nil {
+      observed = make(map[string]int)
+      m.observed[name] = observed
+   }
+
+   for _, p := range points {
+      event := p.Event
+      labels := fmt.Sprintf(`sensor="%s",event="%s"`, labelValue(p.Sensor), labelValue(event.mnemonic))
+
+      if p.SourceLabel != "" {
+         labels += fmt.Sprintf(`,%s="%s"`, p.SourceLabel, labelValue(p.Source))
+      }
+
+      s := metricSeries{name: "numascope_" + metricName(event.mnemonic), help: event.desc, labels: labels}
+
+      switch event.kind {
+      case Gauge:
+         s.kind = "gauge"
+         if event.unit != "" {
+            s.help += " (" + event.unit + ")"
+         }
+      case Ratio:
+         s.kind = "gauge"
+         s.name += "_ratio"
+      default:
+         s.kind = "counter"
+         s.name += "_total"
+      }
+
+      key := s.name + "{" + labels + "}"
+      series, ok := m.series[key]
+      if !ok {
+         series = &s
+         m.series[key] = series
+      }
+
+      observed[key] = generation
+
+      if event.kind == Counter {
+         // rates are integrated into cumulative totals
+         series.value += p.Value * dt
+      } else {
+         series.value = p.Value
+      }
+   }
+
+   if expire {
+      for key, gen := range observed {
+         if gen != generation {
+            delete(observed, key)
+            delete(m.series, key)
+         }
+      }
+   }
+}
+
+// records health of a sampling pass
+func (m *Metrics) Sampled(duration time.Duration, overrun bool) {
+   m.mutex.Lock()
+   defer m.mutex.Unlock()
+
+   m.samples++
+   m.duration = duration
+   m.last = time.Now()
+
+   if overrun {
+      m.overruns++
+   }
+}
+
+func (m *Metrics) Write(w io.Writer) error {
+   // before locking, as metrics are observed with controlMutex held
+   period := currentInterval()
+
+   m.mutex.Lock()
+   defer m.mutex.Unlock()
+
+   health := []metricSeries{
+      {"numascope_samples_total", "sampling passes", "counter", "", float64(m.samples)},
+      {"numascope_sample_overruns_total", "sampling passes taking longer than the interval", "counter", "", float64(m.overruns)},
+      {"numascope_sample_duration_seconds", "duration of last sampling pass", "gauge", "", m.duration.Seconds()},
+      {"numascope_sample_interval_seconds", "sampling interval", "gauge", "", period.Seconds()},
+      {"numascope_websocket_clients", "connected web interface clients", "gauge", "", float64(clientCount())},
+   }
+
+   if !m.last.IsZero() {
+      health = append(health, metricSeries{"numascope_last_sample_timestamp_seconds", "time of last sampling pass", "gauge", "", float64(m.last.UnixNano()) / 1e9})
+   }
+
+   keys := make([]string, 0, len(m.series))
+   for key := range m.series {
+      keys = append(keys, key)
+   }
+   sort.Strings(keys)
+
+   all := health
+   for _, key := range keys {
+      all = append(all, *m.series[key])
+   }
+
+   name := ""
+
+   for _, s := range all {
+      // describe each metric once
+      if s.name != name {
+         name = s.name
+         fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, strings.Replace(s.help, "\n", " ", -1), s.name, s.kind)
+      }
+
+      labels := ""
+      if s.labels != "" {
+         labels = "{" + s.labels + "}"
+      }
+
+      _, err := fmt.Fprintf(w, "%s%s %g\n", s.name, labels, s.value)
+      if err != nil {
+         return err
+      }
+   }
+
+   return nil
+}
+
+func (m *Metrics) serve(w http.ResponseWriter, r *http.Request) {
+   w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+   err := m.Write(w)
+   if err != nil && *debug {
+      fmt.Println("failed writing:", err)
+   }
+}
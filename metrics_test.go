@@ -0,0 +1,111 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "strings"
+   "testing"
+   "time"
+)
+
+func TestMetrics(t *testing.T) {
+   rec := testRecording(1)
+   d := NewPlayback(&rec.Header.Sensors[0], 0)
+   for i := range d.events {
+      d.events[i].enabled = true
+   }
+
+   d.Enable(true)
+   m := NewMetrics()
+
+   // counters accumulate over intervals
+   for _, sample := range rec.Samples[1:3] {
+      d.set(sample.Values)
+      m.Observe(d.Name(), pointsOf(d, d.Sample()), 0.5, 0)
+   }
+
+   m.Sampled(time.Millisecond, false)
+
+   var buf bytes.Buffer
+   err := m.Write(&buf)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   for _, line := range []string{
+      "# TYPE numascope_reads_total counter",
+      `numascope_reads_total{sensor="test",event="reads",source="0"} 15`,
+      `numascope_reads_total{sensor="test",event="reads",source="1"} 100`,
+      "# TYPE numascope_free gauge",
+      `numascope_free{sensor="test",event="free",source="0"} 52`,
+      `numascope_busy_ratio{sensor="test",event="busy",source="1"} 0.1`,
+      "numascope_samples_total 1",
+   } {
+      if !strings.Contains(buf.String(), line+"\n") {
+         t.Errorf("missing %q in\n%s", line, buf.String())
+      }
+   }
+
+   // series of disabled events expire, the rest keep accumulating
+   d.events[1].enabled = false
+   d.Enable(true)
+   m.Observe(d.Name(), pointsOf(d, d.Sample()), 0.5, 1)
+
+   buf.Reset()
+   err = m.Write(&buf)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if strings.Contains(buf.String(), "numascope_free") || !strings.Contains(buf.String(), `numascope_reads_total{sensor="test",event="reads",source="0"} 25`+"\n") {
+      t.Errorf("unexpected series after disabling in\n%s", buf.String())
+   }
+}
+
+// single sources have no source label, and unit-less gauges no unit
+func TestMetricsSingleSource(t *testing.T) {
+   rec := singleSourceRecording(1)
+   d := NewPlayback(&rec.Header.Sensors[0], 0)
+   for i := range d.events {
+      d.events[i].enabled = true
+   }
+
+   d.Enable(true)
+   d.set(rec.Samples[1].Values)
+
+   m := NewMetrics()
+   m.Observe(d.Name(), pointsOf(d, d.Sample()), 1, 0)
+
+   var buf bytes.Buffer
+   err := m.Write(&buf)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   for _, line := range []string{
+      "# HELP numascope_nr_dirty dirty pages",
+      `numascope_nr_dirty{sensor="Kernel",event="nr_dirty"} 101`,
+      `numascope_numa_miss_total{sensor="Kernel",event="numa_miss"} 10`,
+      `numascope_busy_ratio{sensor="Kernel",event="busy"} 0.25`,
+   } {
+      if !strings.Contains(buf.String(), line+"\n") {
+         t.Errorf("missing %q in\n%s", line, buf.String())
+      }
+   }
+}
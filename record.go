@@ -18,14 +18,13 @@
 package main
 
 import (
-   "bytes"
    "os/exec"
    "fmt"
-   "encoding/json"
+   "io"
    "os"
    "os/signal"
    "path"
-   "strconv"
+   "regexp"
    "strings"
    "syscall"
    "time"
@@ -35,14 +34,54 @@ import (
 
 var (
    file *os.File
+   sink io.Writer // file, or compressor of it
+   output TraceWriter
+   command []string // being recorded
+   fileName string // currently recording to
+   previous string // segment being continued when rotating
+   segment int
+   segmentStart time.Time
+   sampled time.Time // last sampling pass
+   rotatePattern *regexp.Regexp
 )
 
-func writeLabel(timestamp int64, label string) {
-   elems := []interface{}{"label", timestamp, label}
-   b, err := json.Marshal(elems)
-   validate(err)
-   b = append(b, []byte(",\n")...)
-   _, err = file.Write(b)
+// selects format from flag or filename extension
+func formatOf(name string) string {
+   if *format != "" {
+      return *format
+   }
+
+   switch path.Ext(strings.TrimSuffix(name, compression(name))) {
+   case ".jsonl", ".ndjson":
+      return "lines"
+   case ".nsb":
+      return "binary"
+   case ".csv":
+      return "csv"
+   default:
+      return "json"
+   }
+}
+
+func newTraceWriter(name string, w io.Writer) TraceWriter {
+   switch formatOf(name) {
+   case "lines":
+      return newLinesWriter(w)
+   case "json":
+      return newJSONWriter(w)
+   case "binary":
+      return newBinaryWriter(w)
+   case "csv":
+      return newCSVWriter(w)
+   }
+
+   fmt.Printf("unknown format '%s'\n", formatOf(name))
+   os.Exit(1)
+   return nil
+}
+
+func writeLabel(timestamp int64, text string) {
+   err := output.Label(Label{Timestamp: timestamp, Text: text})
    validate(err)
 }
 
@@ -51,27 +90,30 @@ func fileStop() {
       return
    }
 
-   // trim trailing ','
-   _, err := file.Seek(-2, os.SEEK_CUR)
+   err := output.Close()
    validate(err)
 
-   _, err = file.WriteString("\n]\n")
-   validate(err)
+   if c, ok := sink.(*compressedWriter); ok {
+      err = c.Close()
+      validate(err)
+   }
 
    err = file.Close()
    validate(err)
-}
 
-func fileStart() {
-   fileStop()
+   file = nil
+   sink = nil
+   output = nil
+}
 
-   var err error
+// starts recording to a new file, replacing any current one only if successful
+func fileOpen() error {
    fileNameFull := *recordFile
    index := 0
 
 again:
    if index > 0 {
-      ext := path.Ext(*recordFile)
+      ext := extension(*recordFile)
       leaf := strings.TrimSuffix(*recordFile, ext)
       fileNameFull = fmt.Sprintf("%s_%d%s", leaf, index, ext)
    }
@@ -81,86 +123,140 @@ again:
       flags |= os.O_EXCL
    }
 
-   file, err = os.OpenFile(fileNameFull, flags, 0444)
+   f, err := os.OpenFile(fileNameFull, flags, 0444)
    if perr, ok := err.(*os.PathError); ok && perr.Err == unix.EEXIST {
       index++
       goto again
    }
 
-   validate(err)
+   if err != nil {
+      return err
+   }
 
-   header := fmt.Sprintf("[[\"%s\",%d,%d],\n", present[0].Name(), present[0].Sources(), present[0].Rate())
-   _, err = file.WriteString(header)
-   validate(err)
+   w, err := newCompressedWriter(fileNameFull, f)
+   if err != nil {
+      f.Close()
+      os.Remove(fileNameFull)
+      return err
+   }
 
-   headings := present[0].Headings(false)
-   b, err := json.Marshal(headings)
-   validate(err)
+   out := newTraceWriter(fileNameFull, w)
+   header := newHeader(command)
+   header.Previous = previous
+   header.Segment = segment
 
-   b = append(b, []byte(",\n")...)
-   _, err = file.Write(b)
-   validate(err)
+   err = out.Header(header)
+   if err != nil {
+      // stops any compressor goroutines
+      if c, ok := w.(*compressedWriter); ok {
+         c.Close()
+      }
+
+      f.Close()
+      os.Remove(fileNameFull)
+      return err
+   }
+
+   fileStop()
+   file, sink, output = f, w, out
+   fileName = fileNameFull
+   segmentStart = time.Now()
 
    fmt.Printf("recording to %v with %dms sample interval\n", fileNameFull, *interval)
+   return nil
 }
 
-func setInterval(input string) {
-   l := len(input)
-   if l < 2 {
-      fmt.Printf("missing interval")
-      return
+func fileStart() {
+   err := fileOpen()
+   validate(err)
+}
+
+// continues in a new segment referencing this one; called with controlMutex held
+func rotate() {
+   previous = path.Base(fileName)
+   segment++
+   fileStart()
+}
+
+// checks if segment reached size or age limit
+func rotationDue() bool {
+   if *rotatePeriod > 0 && time.Since(segmentStart) >= *rotatePeriod {
+      return true
    }
 
-   suffix := input[l-2:]
-   if suffix != "ms" {
-      fmt.Printf("unknown suffix '%s'\n", suffix)
-      return
+   if *rotateSize > 0 {
+      // compressed data is counted when flushed
+      pos, err := file.Seek(0, io.SeekCurrent)
+      validate(err)
+
+      return pos >= int64(*rotateSize) << 20
    }
 
-   nStr := input[:l-2]
+   return false
+}
 
-   var err error
-   i, err := strconv.Atoi(nStr)
-   if err != nil {
-      fmt.Printf("unknown number '%s'\n", nStr)
+// writes samples to any recording, starting a new segment when due; called with controlMutex held
+func writeSample(timestamp int64, values []int64) {
+   if output == nil {
       return
    }
 
-   *interval = i
+   if !paused {
+      err := output.Sample(timestamp, values)
+      validate(err)
+   }
+
+   if rotationDue() {
+      err := controlRotateLocked()
+      if err != nil {
+         fmt.Println(err)
+      }
+   }
 }
 
 func sample() {
-   line := []int64{time.Now().UnixNano() / 1e3}
-   line = append(line, present[0].Sample()...)
+   controlMutex.Lock()
+   defer controlMutex.Unlock()
 
-   b, err := json.Marshal(line)
-   validate(err)
-   b = append(b, []byte(",\n")...)
-   _, err = file.Write(b)
-   validate(err)
+   now := time.Now()
+   timestamp := now.UnixNano() / 1e3
+   var values []int64
+   perSensor := make([][]int64, len(present))
+
+   for i, sensor := range present {
+      perSensor[i] = sensor.Sample()
+      values = append(values, perSensor[i]...)
+   }
+
+   // first sample has no preceding interval
+   if !sampled.IsZero() {
+      export(timestamp, now.Sub(sampled).Seconds(), exportPoints(present, perSensor))
+   }
+   sampled = now
+
+   writeSample(timestamp, values)
 }
 
 func delay() {
-   time.Sleep(time.Duration(*interval) * time.Millisecond)
+   time.Sleep(currentInterval())
 }
 
 func record(args []string) {
-   // always capture per-chip counters
+   // always capture per-chip counters; the socket already accepts commands
+   controlMutex.Lock()
    *discrete = true
-   present[0].Enable(*discrete)
-
-   // enable all events
-   events := present[0].Events()
-   for i := range events {
-      events[i].enabled = true
-   }
-
    Activate()
+   controlMutex.Unlock()
+
+   command = args
 
    sigs := make(chan os.Signal, 1)
    signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+   controlMutex.Lock()
    fileStart()
+   controlMutex.Unlock()
+
    fifoBuf := make([]byte, 256)
 
    // launch any command
@@ -190,47 +286,11 @@ outer:
          break outer
       case <-exitStatus:
          break outer
-      case <-time.After(time.Duration(*interval) * time.Millisecond):
-      }
-
-      // handle command
-      n, err := unix.Read(fifo, fifoBuf)
-      validateNonblock(err)
-
-      if n > 0 {
-         timestamp := time.Now().UnixNano() / 1e3
-         line := string(bytes.TrimSpace(fifoBuf[:n]))
-         fields := strings.SplitN(line, " ", 2)
-
-         switch fields[0] {
-         case "record":
-            if len(fields) == 2 {
-               *recordFile = fields[1]
-               fileStart()
-            } else {
-               fmt.Println("syntax: record <filename.json>")
-            }
-         case "label":
-            if len(fields) >= 2 {
-               writeLabel(timestamp, fields[1])
-            } else {
-               fmt.Println("syntax: label <label>..")
-            }
-         case "pause":
-            fmt.Printf("pause\n")
-         case "resume":
-            fmt.Printf("resume\n")
-         case "interval":
-            if len(fields) == 2 {
-               setInterval(fields[1])
-            } else {
-               fmt.Println("syntax: interval <n>ms")
-            }
-         default:
-            fmt.Printf("unknown command '%v'\n", line)
-         }
+      case <-time.After(currentInterval()):
       }
 
+      // commands from FIFO; socket commands are handled concurrently
+      pollFifo(fifoBuf)
       sample()
    }
 
@@ -240,5 +300,9 @@ outer:
       sample()
    }
 
+   controlMutex.Lock()
    fileStop()
+   controlMutex.Unlock()
+
+   flushExporters()
 }
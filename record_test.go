@@ -0,0 +1,194 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "io/ioutil"
+   "os"
+   "path/filepath"
+   "testing"
+)
+
+// records from a synthetic sensor into a temporary directory
+func recordSynthetic(t *testing.T, dir string, nSamples int) string {
+   dev := NewSynthetic()
+   err := dev.Load([]byte(demoScenario))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   dev.Events()[0].enabled = true
+   dev.Events()[5].enabled = true
+
+   present = []Sensor{dev}
+   *discrete = true
+   *recordFile = filepath.Join(dir, "trace.json")
+   Activate()
+
+   fileStart()
+   for i := 0; i < nSamples; i++ {
+      sample()
+
+      if i == 1 {
+         writeLabel(1234, "phase 1")
+      }
+   }
+   fileStop()
+
+   return *recordFile
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   name := recordSynthetic(t, dir, 3)
+   rec, err := loadRecording(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   h := rec.Header
+   if h.Format != formatVersion || len(h.Sensors) != 1 || !h.Discrete {
+      t.Fatalf("unexpected header %+v", h)
+   }
+
+   headings, events := h.Headings()
+   if len(headings) != 8 || events[0].Mnemonic != "synRemoteRead" || events[7].Kind != "ratio" {
+      t.Errorf("unexpected headings %v %+v", headings, events)
+   }
+
+   if len(rec.Samples) != 3 || len(rec.Samples[0].Values) != 8 {
+      t.Errorf("unexpected samples %+v", rec.Samples)
+   }
+
+   if len(rec.Labels) != 1 || rec.Labels[0].Text != "phase 1" {
+      t.Errorf("unexpected labels %+v", rec.Labels)
+   }
+}
+
+// sensors are recorded in order, each with its own sources
+func TestRecordingSensors(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   savedPresent, savedFile, savedDiscrete := present, *recordFile, *discrete
+   defer func() { present, *recordFile, *discrete = savedPresent, savedFile, savedDiscrete }()
+
+   nc := NewNumaconnect2With(NewEmulator(2))
+   if !nc.Present() {
+      t.Fatal("emulator not present")
+   }
+   nc.Events()[0].enabled = true
+   nc.Events()[1].enabled = true
+
+   synth := NewSynthetic()
+   err = synth.Load([]byte(demoScenario))
+   if err != nil {
+      t.Fatal(err)
+   }
+   synth.Events()[0].enabled = true
+
+   present = []Sensor{nc, synth}
+   *discrete = true
+   *recordFile = filepath.Join(dir, "sensors.nsb")
+   Activate()
+
+   fileStart()
+   for i := 0; i < 4; i++ {
+      sample()
+   }
+   fileStop()
+
+   rec, err := loadRecording(*recordFile)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   sensors := rec.Header.Sensors
+   if len(sensors) != 2 || sensors[0].Name != "NumaConnect2" || sensors[1].Name != "Synthetic" {
+      t.Fatalf("unexpected sensors %+v", sensors)
+   }
+
+   if sensors[0].Sources != 2 || len(sensors[0].Headings) != 4 || sensors[1].Sources != 4 || len(sensors[1].Headings) != 4 {
+      t.Errorf("unexpected layout %+v", sensors)
+   }
+
+   for _, sample := range rec.Samples {
+      if len(sample.Values) != 8 {
+         t.Fatalf("sample has %d values, expected 8", len(sample.Values))
+      }
+   }
+
+   // each sensor sums its own sources
+   sums := 0
+   for _, s := range seriesOf(rec) {
+      if s.Source == -1 {
+         sums++
+      }
+   }
+
+   if len(rec.Samples) != 4 || sums != 3 {
+      t.Errorf("%d samples and %d sums", len(rec.Samples), sums)
+   }
+}
+
+func TestRotation(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   first := recordSynthetic(t, dir, 1)
+   os.Remove(first)
+
+   fileStart()
+   sample()
+   rotate()
+   sample()
+   sample()
+   fileStop()
+
+   previous = ""
+   segment = 0
+
+   rec, err := loadRecording(first)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(rec.Samples) != 1 || rec.Header.Previous != "" {
+      t.Errorf("first segment has %d samples, continues %q", len(rec.Samples), rec.Header.Previous)
+   }
+
+   rec, err = loadRecording(filepath.Join(dir, "trace_1.json"))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(rec.Samples) != 2 || rec.Header.Previous != "trace.json" || rec.Header.Segment != 1 || len(rec.Header.Sensors) != 1 {
+      t.Errorf("second segment has %d samples, continues %q", len(rec.Samples), rec.Header.Previous)
+   }
+}
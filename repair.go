@@ -0,0 +1,137 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/json"
+   "fmt"
+   "io/ioutil"
+   "os"
+   "path/filepath"
+)
+
+// returns the complete rows of a possibly truncated recording
+func completeRows(content []byte) (rows [][]byte, lines bool) {
+   content = bytes.TrimSpace(content)
+   lines = len(content) > 0 && content[0] == '{'
+
+   if !lines {
+      content = bytes.TrimPrefix(content, []byte("["))
+   }
+
+   for _, line := range bytes.Split(content, []byte("\n")) {
+      line = bytes.TrimSpace(line)
+      if !lines {
+         line = bytes.TrimSuffix(line, []byte(","))
+      }
+
+      // end of array
+      if len(line) == 0 || bytes.Equal(line, []byte("]")) {
+         continue
+      }
+
+      if !json.Valid(line) {
+         break
+      }
+
+      rows = append(rows, line)
+   }
+
+   return
+}
+
+// rebuilds a recording from its complete rows
+func repaired(content []byte) ([]byte, int, error) {
+   rows, lines := completeRows(content)
+
+   var out []byte
+   if lines {
+      out = append(bytes.Join(rows, []byte("\n")), '\n')
+   } else {
+      out = append([]byte("["), bytes.Join(rows, []byte(",\n"))...)
+      out = append(out, []byte("\n]\n")...)
+   }
+
+   _, err := readRecording(bytes.NewReader(out))
+   return out, len(rows), err
+}
+
+// makes an interrupted recording loadable, replacing the file
+func repair(args []string) {
+   if len(args) != 1 {
+      fmt.Println("syntax: repair <filename>")
+      os.Exit(1)
+   }
+
+   name := args[0]
+   raw, err := ioutil.ReadFile(name)
+   validate(err)
+
+   // decompress up to where compressed stream was interrupted
+   reader, err := decompressed(bufio.NewReader(bytes.NewReader(raw)))
+   validate(err)
+   content, err := ioutil.ReadAll(reader)
+   validate(err)
+
+   compressed := !bytes.Equal(content, raw)
+
+   if isBinary(bufio.NewReader(bytes.NewReader(content))) {
+      fmt.Printf("%s is binary, which is loadable when interrupted\n", name)
+      return
+   }
+
+   if json.Valid(content) && !compressed {
+      fmt.Printf("%s is already complete\n", name)
+      return
+   }
+
+   out, nRows, err := repaired(content)
+   if err != nil {
+      fmt.Printf("unable to repair %s: %v\n", name, err)
+      os.Exit(1)
+   }
+
+   info, err := os.Stat(name)
+   validate(err)
+
+   // replace atomically, so failure leaves the original
+   tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".repair")
+   validate(err)
+
+   w, err := newCompressedWriter(name, tmp)
+   validate(err)
+
+   _, err = w.Write(out)
+   validate(err)
+
+   if c, ok := w.(*compressedWriter); ok {
+      err = c.Close()
+      validate(err)
+   }
+   err = tmp.Chmod(info.Mode())
+   validate(err)
+   err = tmp.Close()
+   validate(err)
+
+   err = os.Rename(tmp.Name(), name)
+   validate(err)
+
+   fmt.Printf("repaired %s, keeping %d rows\n", name, nRows)
+}
@@ -0,0 +1,72 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "io/ioutil"
+   "os"
+   "strings"
+   "testing"
+)
+
+func TestRepair(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   name := recordSynthetic(t, dir, 4)
+   content, err := ioutil.ReadFile(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // as if killed before closing, part way through a sample
+   truncated := content[:len(content)-10]
+   _, err = readRecording(strings.NewReader(string(truncated)))
+   if err == nil {
+      t.Fatal("truncated recording unexpectedly loaded")
+   }
+
+   out, nRows, err := repaired(truncated)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   rec, err := readRecording(strings.NewReader(string(out)))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // header, three samples and a label
+   if nRows != 5 || len(rec.Samples) != 3 || len(rec.Labels) != 1 {
+      t.Errorf("%d rows with %d samples, expected 5 and 3", nRows, len(rec.Samples))
+   }
+
+   legacy := "[[\"NumaConnect2\",1,200000000],\n[\"reads\"],\n[1000,1],\n[2000,2],\n[30"
+   out, _, err = repaired([]byte(legacy))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   rec, err = readRecording(strings.NewReader(string(out)))
+   if err != nil || len(rec.Samples) != 2 {
+      t.Errorf("legacy repair failed: %v", err)
+   }
+}
@@ -0,0 +1,503 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "os"
+   "strconv"
+   "sync"
+   "time"
+)
+
+// replays a sensor's columns of a recording, as if sampled live
+type Playback struct {
+   header   *SensorHeader
+   events   []Event
+   offset   int // first column in sample
+   perEvent int // columns per event, more than one when recorded per source
+   discrete bool
+   nEnabled int
+   row      []int64
+   mutex    sync.Mutex
+}
+
+type ReplayState struct {
+   Start    int64 // first timestamp in us
+   Duration int64 // in us
+   Position int64 // from start in us
+   Speed    float64
+   Paused   bool
+   Loop     bool
+}
+
+type ReplayMessage struct {
+   Op        string
+   Timestamp int64
+   Replay    *ReplayState
+}
+
+type Player struct {
+   rec      *Recording
+   sensors  []*Playback
+   interval int // recorded interval in ms
+   next     int // sample index
+   speed    float64
+   paused   bool
+   loop     bool
+   reset    bool // clients need clearing
+   changed  bool // clients need control state
+   mutex    sync.Mutex
+}
+
+// set when replaying
+var player *Player
+
+func NewPlayback(header *SensorHeader, offset int) *Playback {
+   d := &Playback{header: header, offset: offset, perEvent: 1}
+
+   // legacy recordings describe only headings
+   if len(header.Events) == 0 {
+      for i, heading := range header.Headings {
+         d.events = append(d.events, Event{int16(i), heading, heading, false, Counter, ""})
+      }
+
+      return d
+   }
+
+   if n := len(header.Headings) / len(header.Events); n > 1 {
+      d.perEvent = n
+   }
+
+   for i, event := range header.Events {
+      d.events = append(d.events, Event{int16(i), event.Mnemonic, event.Desc, false, parseKind(event.Kind), event.Unit})
+   }
+
+   return d
+}
+
+func (d *Playback) Name() string {
+   return d.header.Name
+}
+
+func (d *Playback) Present() bool {
+   return true
+}
+
+func (d *Playback) Rate() uint {
+   return d.header.Rate
+}
+
+func (d *Playback) Sources() uint {
+   return uint(d.perEvent)
+}
+
+func (d *Playback) Events() []Event {
+   return d.events
+}
+
+func (d *Playback) Lock() {
+   d.mutex.Lock()
+}
+
+func (d *Playback) Unlock() {
+   d.mutex.Unlock()
+}
+
+// per-source columns are only available if recorded
+func (d *Playback) Enable(discrete bool) {
+   d.discrete = discrete && d.perEvent > 1
+   d.nEnabled = 0
+
+   for _, event := range d.events {
+      if event.enabled {
+         d.nEnabled++
+      }
+   }
+}
+
+func (d *Playback) Headings(mnemonics bool) []string {
+   var headings []string
+
+   for _, event := range d.events {
+      if !event.enabled {
+         continue
+      }
+
+      name := event.desc
+      if mnemonics {
+         name = event.mnemonic
+      }
+
+      if d.discrete {
+         for i := 0; i < d.perEvent; i++ {
+            headings = append(headings, fmt.Sprintf("%s:%d", name, i))
+         }
+      } else {
+         headings = append(headings, name)
+      }
+   }
+
+   return headings
+}
+
+// sets the recorded sample to return
+func (d *Playback) set(values []int64) {
+   d.Lock()
+   d.row = values
+   d.Unlock()
+}
+
+func (d *Playback) Sample() []int64 {
+   var samples []int64
+
+   d.Lock()
+   defer d.Unlock()
+
+   for _, event := range d.events {
+      if !event.enabled {
+         continue
+      }
+
+      var sum int64
+
+      for n := 0; n < d.perEvent; n++ {
+         col := d.offset + int(event.index) * d.perEvent + n
+         var val int64
+
+         if col < len(d.row) {
+            val = d.row[col]
+         }
+
+         if d.discrete {
+            samples = append(samples, val)
+         } else {
+            // sum all sources
+            sum += val
+         }
+      }
+
+      if !d.discrete {
+         samples = append(samples, sum)
+      }
+   }
+
+   return samples
+}
+
+func NewPlayer(rec *Recording) *Player {
+   p := &Player{rec: rec, speed: 1, interval: rec.Header.Interval}
+   offset := 0
+
+   for i := range rec.Header.Sensors {
+      d := NewPlayback(&rec.Header.Sensors[i], offset)
+      offset += len(rec.Header.Sensors[i].Headings)
+
+      for j := range d.events {
+         d.events[j].enabled = true
+      }
+
+      p.sensors = append(p.sensors, d)
+   }
+
+   // infer from timestamps if not recorded
+   if p.interval == 0 && len(rec.Samples) > 1 {
+      p.interval = int((rec.Samples[1].Timestamp - rec.Samples[0].Timestamp) / 1e3)
+   }
+
+   if p.interval <= 0 {
+      p.interval = 256
+   }
+
+   return p
+}
+
+func (p *Player) State() *ReplayState {
+   p.mutex.Lock()
+   defer p.mutex.Unlock()
+
+   state := &ReplayState{Speed: p.speed, Paused: p.paused, Loop: p.loop}
+   samples := p.rec.Samples
+
+   if len(samples) > 0 {
+      state.Start = samples[0].Timestamp
+      state.Duration = samples[len(samples)-1].Timestamp - state.Start
+
+      if p.next < len(samples) {
+         state.Position = samples[p.next].Timestamp - state.Start
+      } else {
+         state.Position = state.Duration
+      }
+   }
+
+   return state
+}
+
+// moves to offset from start in s
+func (p *Player) Seek(offset float64) {
+   p.mutex.Lock()
+   defer p.mutex.Unlock()
+
+   samples := p.rec.Samples
+   p.next = len(samples)
+
+   for i := range samples {
+      if float64(samples[i].Timestamp - samples[0].Timestamp) >= offset * 1e6 {
+         p.next = i
+         break
+      }
+   }
+
+   p.reset = true
+}
+
+func (p *Player) Control(op, value string) error {
+   switch op {
+   case "seek":
+      offset, err := strconv.ParseFloat(value, 64)
+      if err != nil {
+         return err
+      }
+
+      p.Seek(offset)
+      return nil
+   }
+
+   p.mutex.Lock()
+   defer p.mutex.Unlock()
+
+   switch op {
+   case "speed":
+      speed, err := strconv.ParseFloat(value, 64)
+      if err != nil || speed <= 0 {
+         return fmt.Errorf("invalid speed '%s'", value)
+      }
+
+      p.speed = speed
+   case "loop":
+      p.loop = value == "true"
+   case "pause":
+      p.paused = true
+   case "resume":
+      p.paused = false
+
+      // restart at end
+      if p.next >= len(p.rec.Samples) {
+         p.next = 0
+         p.reset = true
+      }
+   default:
+      return fmt.Errorf("unknown replay control '%s'", op)
+   }
+
+   // update controls of all clients
+   p.changed = true
+   return nil
+}
+
+// returns and clears pending client updates
+func (p *Player) pending() (reset, changed bool) {
+   p.mutex.Lock()
+   defer p.mutex.Unlock()
+
+   if p.next >= len(p.rec.Samples) && p.loop && !p.paused {
+      p.next = 0
+      p.reset = true
+   }
+
+   reset, changed = p.reset, p.changed
+   p.reset, p.changed = false, false
+
+   return
+}
+
+// averages the samples covering the selected interval, returning the time of the sample after
+func (p *Player) step(reset bool, interval time.Duration) (timestamp int64, values []int64, next int64, labels []Label, ok bool) {
+   p.mutex.Lock()
+   defer p.mutex.Unlock()
+
+   samples := p.rec.Samples
+
+   if p.paused || p.next >= len(samples) {
+      return
+   }
+
+   first := p.next
+   group := int(interval / time.Millisecond) / p.interval
+   if group < 1 {
+      group = 1
+   }
+
+   last := first + group - 1
+   if last >= len(samples) {
+      last = len(samples) - 1
+   }
+
+   values = make([]int64, len(samples[last].Values))
+   for i := first; i <= last; i++ {
+      for j, val := range samples[i].Values {
+         if j < len(values) {
+            values[j] += val
+         }
+      }
+   }
+
+   for j := range values {
+      values[j] /= int64(last - first + 1)
+   }
+
+   timestamp = samples[last].Timestamp
+   p.next = last + 1
+
+   // labels since previous sample, or all before it when reset
+   from := int64(-1 << 63)
+   if first > 0 && !reset {
+      from = samples[first-1].Timestamp
+   }
+
+   for _, label := range p.rec.Labels {
+      if label.Timestamp > from && label.Timestamp <= timestamp {
+         labels = append(labels, label)
+      }
+   }
+
+   next = timestamp + int64(p.interval) * 1e3
+   if p.next < len(samples) {
+      next = samples[p.next].Timestamp
+   }
+
+   next = timestamp + int64(float64(next - timestamp) / p.speed)
+   ok = true
+
+   if p.next >= len(samples) && !p.loop {
+      p.paused = true
+      p.changed = true
+   }
+
+   return
+}
+
+func (p *Player) play() {
+   var epochs [][]int64
+   var flushed time.Time
+
+   for {
+      reset, changed := p.pending()
+
+      if reset {
+         epochs = nil
+
+         for _, c := range clients() {
+            change(c)
+         }
+      } else if changed {
+         broadcastReplay(p.State())
+      }
+
+      timestamp, values, next, labels, ok := p.step(reset, currentInterval())
+
+      if !ok {
+         if len(epochs) > 0 {
+            broadcastData(epochs)
+            epochs = nil
+         }
+
+         time.Sleep(100 * time.Millisecond)
+         continue
+      }
+
+      for _, label := range labels {
+         broadcastLabel(label)
+      }
+
+      samples := []int64{timestamp}
+
+      for _, d := range p.sensors {
+         d.set(values)
+         samples = append(samples, d.Sample()...)
+      }
+
+      // coalesce by elapsed time, as timestamps are scaled by speed
+      if time.Since(flushed) < coalescing * time.Microsecond || len(epochs) == 0 {
+         epochs = append(epochs, samples)
+      } else {
+         broadcastData(epochs)
+         flushed = time.Now()
+         epochs = nil
+      }
+
+      time.Sleep(time.Duration(next - timestamp) * time.Microsecond)
+   }
+}
+
+func broadcastReplay(state *ReplayState) {
+   msg := ReplayMessage{
+      Op: "replay",
+      Timestamp: time.Now().UnixNano() / 1e3,
+      Replay: state,
+   }
+
+   for _, c := range clients() {
+      err := c.WriteJSON(&msg)
+      if err != nil && *debug {
+         fmt.Println("failed writing:", err)
+      }
+   }
+}
+
+func replay(args []string) {
+   if len(args) != 1 {
+      fmt.Println("syntax: replay <filename>")
+      os.Exit(1)
+   }
+
+   // as checked by Control, also catching NaN
+   if !(*speed > 0) {
+      fmt.Printf("invalid speed %g; must be above 0\n", *speed)
+      os.Exit(1)
+   }
+
+   rec, err := loadRecordingFrom(args[0], *replayFrom)
+   validate(err)
+
+   if len(rec.Samples) == 0 {
+      fmt.Println("no samples in", args[0])
+      os.Exit(1)
+   }
+
+   player = NewPlayer(rec)
+   player.speed = *speed
+   player.loop = *loop
+   *discrete = rec.Header.Discrete
+   *interval = player.interval
+
+   present = nil
+   for _, d := range player.sensors {
+      present = append(present, d)
+   }
+
+   Activate()
+   initweb(serveAddr())
+
+   // waits for a client before playing from start
+   for clientCount() == 0 {
+      time.Sleep(100 * time.Millisecond)
+   }
+
+   player.play()
+}
@@ -0,0 +1,74 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "testing"
+   "time"
+)
+
+func TestReplay(t *testing.T) {
+   p := NewPlayer(testRecording(1))
+   if p.interval != 1000 {
+      t.Fatalf("inferred interval %dms, expected 1000ms", p.interval)
+   }
+
+   d := p.sensors[0]
+   if d.Sources() != 2 || len(d.Events()) != 3 {
+      t.Fatalf("unexpected playback sensor %+v", d)
+   }
+
+   // average pairs of samples, summing sources
+   period := 2 * time.Second
+   p.speed = 2
+   d.Enable(false)
+
+   timestamp, values, next, labels, ok := p.step(true, period)
+   d.set(values)
+   samples := d.Sample()
+
+   if !ok || timestamp != 1000000 || next != 1500000 || len(labels) != 0 {
+      t.Errorf("unexpected step at %d, next %d, labels %v", timestamp, next, labels)
+   }
+
+   if len(samples) != 3 || samples[0] != 105 || samples[1] != 100 || samples[2] != 600 {
+      t.Errorf("unexpected samples %v", samples)
+   }
+
+   // label at 3s is passed after seeking to 2s
+   p.Seek(2)
+   d.Enable(true)
+   _, values, _, labels, _ = p.step(false, period)
+   d.set(values)
+
+   if len(labels) != 1 || labels[0].Text != "phase 1" || len(d.Sample()) != 6 {
+      t.Errorf("unexpected labels %v after seek", labels)
+   }
+
+   // ends paused unless looping
+   p.step(false, period)
+   if _, _, _, _, ok = p.step(false, period); ok || !p.State().Paused {
+      t.Error("expected pause at end")
+   }
+
+   p.Control("loop", "true")
+   p.Control("resume", "")
+   if reset, _ := p.pending(); !reset || p.State().Position != 0 {
+      t.Error("expected restart from beginning")
+   }
+}
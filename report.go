@@ -0,0 +1,375 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/csv"
+   "encoding/json"
+   "fmt"
+   "io"
+   "math"
+   "os"
+   "sort"
+   "strconv"
+   "strings"
+   "text/tabwriter"
+)
+
+// values of a heading, or summed across sources of an event; ratios are averaged
+type Series struct {
+   Name   string
+   Event  EventHeader
+   Source int // -1 for sum or average of all sources
+   Values []float64
+}
+
+// interval between consecutive labels
+type Phase struct {
+   Name  string
+   Start int64 // in us, inclusive
+   End   int64 // exclusive
+   Attrs map[string]string
+}
+
+type Stats struct {
+   Phase    string
+   Name     string
+   Mnemonic string
+   Kind     string
+   Unit     string
+   Samples  int
+   Duration float64 // in s
+   Total    float64 // of counters
+   Mean     float64 // rate of counters, value of gauges, percentage of ratios
+   Min      float64
+   Max      float64
+   P50      float64
+   P95      float64
+   P99      float64
+   Above    float64 // share of time above threshold
+}
+
+// per-heading series, plus sums across sources, with ratios as percentages
+// averaged rather than summed
+func seriesOf(rec *Recording) []Series {
+   var all []Series
+   column := 0
+
+   for i := range rec.Header.Sensors {
+      sensor := &rec.Header.Sensors[i]
+      var sums []Series
+      var counts []int // sources in each sum
+
+      for j, heading := range sensor.Headings {
+         event := sensor.HeadingEvent(j)
+         s := Series{Name: heading, Event: event, Source: -1}
+
+         // sources are suffixed with ':N'
+         if k := strings.LastIndex(heading, ":"); k != -1 {
+            if n, err := strconv.Atoi(heading[k+1:]); err == nil {
+               s.Source = n
+            }
+         }
+
+         scale := 1.0
+         if event.Kind == Ratio.String() && sensor.Rate > 0 {
+            scale = 100 / float64(sensor.Rate)
+         }
+
+         for _, sample := range rec.Samples {
+            val := 0.0
+            if column < len(sample.Values) {
+               val = float64(sample.Values[column]) * scale
+            }
+
+            s.Values = append(s.Values, val)
+         }
+
+         all = append(all, s)
+         column++
+
+         if s.Source == -1 {
+            continue
+         }
+
+         // accumulate sum of sources
+         name := event.Mnemonic
+         if name == "" {
+            name = heading[:strings.LastIndex(heading, ":")]
+         }
+
+         if len(sums) == 0 || sums[len(sums)-1].Name != name {
+            sums = append(sums, Series{Name: name, Event: event, Source: -1, Values: make([]float64, len(s.Values))})
+            counts = append(counts, 0)
+         }
+
+         sum := &sums[len(sums)-1]
+         for k, val := range s.Values {
+            sum.Values[k] += val
+         }
+         counts[len(sums)-1]++
+      }
+
+      for j := range sums {
+         if sums[j].Event.Kind != Ratio.String() {
+            continue
+         }
+
+         for k := range sums[j].Values {
+            sums[j].Values[k] /= float64(counts[j])
+         }
+      }
+
+      all = append(all, sums...)
+   }
+
+   return all
+}
+
+// splits recording at labels, followed by any spans; samples before the first label are in phase 'start'
+func phasesOf(rec *Recording) []Phase {
+   phases := []Phase{{Name: "start", Start: math.MinInt64}}
+
+   for _, label := range rec.Labels {
+      if label.Kind != "" {
+         continue
+      }
+
+      phases[len(phases)-1].End = label.Timestamp
+      phases = append(phases, Phase{Name: label.Text, Start: label.Timestamp, Attrs: label.Attrs})
+   }
+
+   phases[len(phases)-1].End = math.MaxInt64
+
+   // omit empty initial phase
+   if len(rec.Samples) > 0 && len(phases) > 1 && phases[0].End <= rec.Samples[0].Timestamp {
+      phases = phases[1:]
+   }
+
+   // spans overlap phases
+   spans := spansOf(rec)
+   sort.SliceStable(spans, func(i, j int) bool {
+      return spans[i].Start < spans[j].Start
+   })
+
+   return append(phases, spans...)
+}
+
+func percentile(sorted []float64, p float64) float64 {
+   if len(sorted) == 0 {
+      return 0
+   }
+
+   // nearest rank
+   rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+   if rank < 1 {
+      rank = 1
+   }
+
+   return sorted[rank-1]
+}
+
+// summarises series over a phase; the first sample covers an unknown interval so is skipped
+func summarise(rec *Recording, s *Series, phase Phase, threshold float64) Stats {
+   st := Stats{Phase: phase.Name, Name: s.Name, Mnemonic: s.Event.Mnemonic, Kind: s.Event.Kind, Unit: s.Event.Unit}
+   var values []float64
+   var weighted, above float64
+
+   for i := 1; i < len(rec.Samples); i++ {
+      ts := rec.Samples[i].Timestamp
+      if ts < phase.Start || ts >= phase.End {
+         continue
+      }
+
+      dt := float64(ts - rec.Samples[i-1].Timestamp) / 1e6
+      val := s.Values[i]
+
+      values = append(values, val)
+      st.Duration += dt
+      weighted += val * dt
+
+      if val > threshold {
+         above += dt
+      }
+   }
+
+   st.Samples = len(values)
+   if st.Samples == 0 {
+      return st
+   }
+
+   sort.Float64s(values)
+   st.Min = values[0]
+   st.Max = values[len(values)-1]
+   st.P50 = percentile(values, 50)
+   st.P95 = percentile(values, 95)
+   st.P99 = percentile(values, 99)
+
+   if st.Duration > 0 {
+      st.Mean = weighted / st.Duration
+      st.Above = above / st.Duration
+   }
+
+   // counters are rates, so integrate
+   if s.Event.Kind == Counter.String() {
+      st.Total = weighted
+   }
+
+   return st
+}
+
+// parses 'N' or 'event=N,...' where events may be mnemonics or headings
+func parseThresholds(spec string) (def float64, per map[string]float64, err error) {
+   def = math.Inf(1)
+   per = make(map[string]float64)
+
+   if spec == "" {
+      return
+   }
+
+   for _, elem := range strings.Split(spec, ",") {
+      fields := strings.SplitN(elem, "=", 2)
+      val, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+      if err != nil {
+         return def, per, fmt.Errorf("invalid threshold '%s'", elem)
+      }
+
+      if len(fields) == 2 {
+         per[fields[0]] = val
+      } else {
+         def = val
+      }
+   }
+
+   return
+}
+
+// statistics of all series over the whole recording and each phase, or only phases matching any selection
+func reportOf(rec *Recording, thresholds string, selection string) ([]Stats, error) {
+   def, per, err := parseThresholds(thresholds)
+   if err != nil {
+      return nil, err
+   }
+
+   series := seriesOf(rec)
+   phases := append([]Phase{{Name: "all", Start: math.MinInt64, End: math.MaxInt64}}, phasesOf(rec)...)
+
+   if selection != "" {
+      phases = selectPhases(phases[1:], selection)
+      if len(phases) == 0 {
+         return nil, fmt.Errorf("no spans or labels match '%s'", selection)
+      }
+   }
+   var stats []Stats
+
+   for _, phase := range phases {
+      for i := range series {
+         s := &series[i]
+         threshold := def
+
+         if val, ok := per[s.Event.Mnemonic]; ok {
+            threshold = val
+         }
+         if val, ok := per[s.Name]; ok {
+            threshold = val
+         }
+
+         stats = append(stats, summarise(rec, s, phase, threshold))
+      }
+   }
+
+   return stats, nil
+}
+
+func formatFloat(val float64) string {
+   return strconv.FormatFloat(val, 'g', 6, 64)
+}
+
+func writeReport(w io.Writer, stats []Stats, output string) error {
+   switch output {
+   case "json":
+      enc := json.NewEncoder(w)
+      enc.SetIndent("", "   ")
+      return enc.Encode(stats)
+   case "csv":
+      c := csv.NewWriter(w)
+      c.Write([]string{"phase", "name", "mnemonic", "kind", "unit", "samples", "duration", "total", "mean", "min", "max", "p50", "p95", "p99", "above"})
+
+      for _, st := range stats {
+         row := []string{st.Phase, st.Name, st.Mnemonic, st.Kind, st.Unit, strconv.Itoa(st.Samples)}
+         for _, val := range []float64{st.Duration, st.Total, st.Mean, st.Min, st.Max, st.P50, st.P95, st.P99, st.Above} {
+            row = append(row, formatFloat(val))
+         }
+
+         c.Write(row)
+      }
+
+      c.Flush()
+      return c.Error()
+   case "text":
+      tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+      phase := ""
+
+      for _, st := range stats {
+         if st.Phase != phase {
+            phase = st.Phase
+            tw.Flush()
+            fmt.Fprintf(w, "\nphase '%s'\n", phase)
+            fmt.Fprintln(tw, "event\ttotal\tmean\tmin\tmax\tp50\tp95\tp99\tabove\t")
+         }
+
+         total := "-"
+         if st.Kind == Counter.String() {
+            total = fmt.Sprintf("%.0f", st.Total)
+         }
+
+         unit := ""
+         switch st.Kind {
+         case Gauge.String():
+            unit = " "+st.Unit
+         case Ratio.String():
+            unit = "%"
+         default:
+            unit = "/s"
+         }
+
+         fmt.Fprintf(tw, "%s\t%s\t%.4g%s\t%.4g\t%.4g\t%.4g\t%.4g\t%.4g\t%.1f%%\t\n",
+            st.Name, total, st.Mean, unit, st.Min, st.Max, st.P50, st.P95, st.P99, st.Above * 100)
+      }
+
+      return tw.Flush()
+   }
+
+   return fmt.Errorf("unknown output '%s'", output)
+}
+
+func report(args []string) {
+   if len(args) != 1 {
+      fmt.Println("syntax: report <filename>")
+      os.Exit(1)
+   }
+
+   rec, err := loadRecording(args[0])
+   validate(err)
+
+   stats, err := reportOf(rec, *threshold, *selection)
+   validate(err)
+
+   err = writeReport(os.Stdout, stats, *outputFormat)
+   validate(err)
+}
@@ -0,0 +1,104 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bytes"
+   "strings"
+   "testing"
+)
+
+// single-source series aren't repeated as sums, and ratios aren't scaled
+func TestReportSingleSource(t *testing.T) {
+   stats, err := reportOf(singleSourceRecording(1), "", "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(stats) != 9 || stats[0].Name != "NUMA misses" || stats[0].Total != 150 {
+      t.Fatalf("unexpected stats %+v", stats)
+   }
+
+   if st := stats[2]; st.Name != "% busy" || st.Mean != 25 || st.Max != 25 {
+      t.Errorf("unexpected ratio %+v", st)
+   }
+
+   // the open span continues to the end
+   if st := stats[7]; st.Phase != "solve" || st.Samples != 4 || st.Mean != 103.5 || st.Unit != "" {
+      t.Errorf("unexpected unit-less gauge in open span %+v", st)
+   }
+
+   var buf bytes.Buffer
+   err = writeReport(&buf, stats, "text")
+   if err != nil || !strings.Contains(buf.String(), "dirty pages      -  103 ") {
+      t.Errorf("unexpected text output %s: %v", buf.String(), err)
+   }
+}
+
+func TestReport(t *testing.T) {
+   stats, err := reportOf(testRecording(1), "reads=25", "")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   find := func(phase, name string) Stats {
+      for _, st := range stats {
+         if st.Phase == phase && st.Name == name {
+            return st
+         }
+      }
+
+      t.Fatalf("missing %s in phase %s", name, phase)
+      return Stats{}
+   }
+
+   // rates 10..50 over 5s
+   st := find("all", "reads:0")
+   if st.Total != 150 || st.Mean != 30 || st.Min != 10 || st.Max != 50 || st.P50 != 30 || st.Above != 0.6 {
+      t.Errorf("unexpected reads:0 %+v", st)
+   }
+
+   st = find("all", "reads")
+   if st.Total != 650 {
+      t.Errorf("sum of sources total %v, expected 650", st.Total)
+   }
+
+   st = find("phase 1", "free:0")
+   if st.Total != 0 || st.Mean != 54 || st.Samples != 3 {
+      t.Errorf("unexpected gauge %+v", st)
+   }
+
+   st = find("start", "% busy:0")
+   if st.Mean != 50 {
+      t.Errorf("ratio mean %v%%, expected 50%%", st.Mean)
+   }
+
+   // ratios are averaged across sources, rather than summed
+   st = find("start", "busy")
+   if st.Mean != 30 {
+      t.Errorf("ratio of sources %v%%, expected 30%%", st.Mean)
+   }
+
+   for _, output := range []string{"text", "csv", "json"} {
+      var buf bytes.Buffer
+      err = writeReport(&buf, stats, output)
+      if err != nil || !strings.Contains(buf.String(), "phase 1") {
+         t.Errorf("%s output failed: %v", output, err)
+      }
+   }
+}
@@ -25,8 +25,9 @@ const radServerGroup = document.getElementById('serverGroup')
 const radPortGroup = document.getElementById('portGroup')
 const radUnitGroup = document.getElementById('unitGroup')
 const annotations = []
+const shapes = [] // shaded spans
+const openSpans = {} // span ID to shape, until ended
 const buttons = []
-let normalise // used to derive percentage
 let portGroup = true
 let unitGroup = true
 let socket
@@ -41,6 +42,14 @@ let interval = 100 // milliseconds
 let offline = false
 let filter
 let headings = []
+let metadata = {} // event description to kind and unit
+let gaugeAxes = {} // unit to axis
+let replaying = false
+let replayStart // first timestamp of replayed recording in us
+let speed = 1 // of replay, or zero when paused
+let controlling = false // may change what is sampled, rather than only view
+
+const spanColors = ['#2ca02c', '#9467bd', '#8c564b', '#e377c2', '#17becf']
 
 const defaultTraces = {
    NumaConnect2: '% wait cycles',
@@ -73,19 +82,89 @@ const layout = {
    legend: {
       orientation: 'v'
    },
-   annotations: []
+   annotations: [],
+   shapes: []
+}
+
+// gauges are plotted as absolute values on an axis per unit
+function axis(heading, kind, unit) {
+   if (kind === 'ratio' || (typeof kind === 'undefined' && heading[0] == '%'))
+      return 'y2'
+
+   if (kind !== 'gauge')
+      return 'y1'
+
+   if (!(unit in gaugeAxes)) {
+      const n = Object.keys(gaugeAxes).length
+      const name = 'yaxis'+(n+3)
+      gaugeAxes[unit] = 'y'+(n+3)
+
+      layout[name] = {
+         title: unit,
+         hoverformat: ',.3s',
+         overlaying: 'y',
+         side: 'left',
+         anchor: 'free',
+         position: n * 0.06,
+         showgrid: false,
+         rangemode: 'tozero'
+      }
+
+      layout.xaxis.domain = [(n+1) * 0.06, 1]
+   }
+
+   return gaugeAxes[unit]
+}
+
+function resetAxes() {
+   for (const unit in gaugeAxes)
+      delete layout['yaxis'+gaugeAxes[unit].substring(1)]
+
+   gaugeAxes = {}
+   delete layout.xaxis.domain
 }
 
-function connect() {
-   socket = new WebSocket('ws://'+location.host+'/monitor')
+// token from link, eg http://host/#token=..., or as entered
+function token() {
+   const match = location.hash.match(/token=([^&]+)/)
+
+   if (match) {
+      sessionStorage.setItem('token', decodeURIComponent(match[1]))
+
+      // avoid showing token in address bar
+      history.replaceState(null, '', location.pathname+location.search)
+   }
+
+   if (!sessionStorage.getItem('token'))
+      sessionStorage.setItem('token', prompt('Access token, as printed when numascope started') || '')
+
+   return sessionStorage.getItem('token')
+}
+
+// without a live server, as for the hosted resources, falls back to standalone mode
+function connect(initial) {
+   let opened = false
+   socket = new WebSocket((location.protocol == 'https:' ? 'wss://' : 'ws://')+location.host+'/monitor')
 
    socket.onmessage = receive
    socket.onopen = function(e) {
+      opened = true
       signedon = false
-      socket.send('463ba1974b06')
+      socket.send(token())
    }
 
    socket.onclose = function(e) {
+      if (initial === true && !opened) {
+         standalone('Standalone mode')
+         return
+      }
+
+      // policy violation when token is refused, so another is asked for when reconnecting
+      if (e.code == 1008) {
+         sessionStorage.removeItem('token')
+         document.getElementById('connecting').firstChild.data = 'Access token refused '
+      }
+
       $('#connecting').show()
    }
 }
@@ -119,17 +198,30 @@ function enabled(msg) {
    discrete = msg.Discrete
    radServerGroup.checked = !discrete
 
+   // replay was restarted or seeked
+   if (typeof msg.Replay !== 'undefined') {
+      annotations.length = 0
+      shapes.length = 0
+      for (const id in openSpans)
+         delete openSpans[id]
+      replayState(msg.Replay)
+   }
+
    for (let btn of buttons)
       btn.className = subset(msg.Enabled, btn.firstChild.nodeValue) ? 'btn btn-primary btn-sm m-1' : 'btn btn-light btn-sm m-1'
 
    let data = []
    let total = 0
+   resetAxes()
 
    for (const sensor in msg.Enabled)
       total += msg.Enabled[sensor].length * (discrete ? sources[sensor] : 1)
 
    for (const sensor in msg.Enabled) {
       for (const heading of msg.Enabled[sensor]) {
+         const meta = metadata[heading] || {}
+         const yaxis = axis(heading, meta.kind, meta.unit)
+
          if (discrete && sources[sensor] > 1) {
             for (let i = 0; i < sources[sensor]; i++) {
                data.push({
@@ -138,7 +230,7 @@ function enabled(msg) {
                   mode: 'lines',
                   hoverlabel: {namelength: 80},
                   x: [], y: [],
-                  yaxis: heading[0] == '%' ? 'y2' : 'y1',
+                  yaxis: yaxis,
 //                  visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
                })
             }
@@ -149,7 +241,7 @@ function enabled(msg) {
                mode: 'lines',
                hoverlabel: {namelength: 80},
                x: [], y: [],
-               yaxis: (heading[0] == '%') ? 'y2' : 'y1',
+               yaxis: yaxis,
 //               visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
             })
          }
@@ -166,17 +258,66 @@ function enabled(msg) {
    }
 }
 
-function label(elem) {
+// label text with any key=value attributes
+function labelText(text, attrs) {
+   for (const key of Object.keys(attrs || {}).sort())
+      text += ' '+key+'='+attrs[key]
+
+   return text
+}
+
+// adds point label as an arrow, or span as a shaded region; returns open span shape
+function annotate(annotations, shapes, spans, time, text, kind, span, attrs) {
+   if (kind === 'begin') {
+      const shape = {
+         type: 'rect',
+         xref: 'x',
+         yref: 'paper',
+         x0: time, x1: time,
+         y0: 0, y1: 1,
+         fillcolor: spanColors[shapes.length % spanColors.length],
+         opacity: 0.15,
+         layer: 'below',
+         line: {width: 0}
+      }
+
+      shapes.push(shape)
+      spans[span] = shape
+
+      annotations.push({
+         x: time,
+         xanchor: 'left',
+         y: 1,
+         yref: 'paper',
+         yanchor: 'top',
+         text: labelText(text, attrs),
+         showarrow: false
+      })
+
+      return shape
+   }
+
+   if (kind === 'end') {
+      // spans begun in an earlier segment aren't shown
+      if (span in spans)
+         spans[span].x1 = time
+      delete spans[span]
+      return
+   }
+
    annotations.push({
-      x: new Date(elem.Timestamp / 1e3),
+      x: time,
       y: 0,
-      text: elem.Label,
+      text: labelText(text, attrs),
       arrowhead: 3,
       ax: 0,
       ay: 40
    })
+}
 
-   Plotly.relayout(graph, {annotations: annotations})
+function label(elem) {
+   annotate(annotations, shapes, openSpans, new Date(elem.Timestamp / 1e3), elem.Label, elem.Kind, elem.Span, elem.Attrs)
+   Plotly.relayout(graph, {annotations: annotations, shapes: shapes})
 }
 
 function update(elem) {
@@ -192,6 +333,9 @@ function update(elem) {
 
    timestamp = elem[elem.length-1][0] / 1e3
 
+   if (replaying)
+      document.getElementById('replay-position').value = (timestamp * 1e3 - replayStart) / 1e6
+
    for (const update of elem) {
       const time = new Date(update[0] / 1e3)
 
@@ -202,13 +346,45 @@ function update(elem) {
    }
 
    Plotly.extendTraces(graph, {x: x, y: y}, indicies)
+
+   // open spans extend to the latest sample
+   if (Object.keys(openSpans).length) {
+      for (const id in openSpans)
+         openSpans[id].x1 = new Date(timestamp)
+      Plotly.relayout(graph, {shapes: shapes})
+   }
 }
 
 function scroller() {
    if (scrolling && listened)
       Plotly.relayout(graph, 'xaxis.range', [new Date(timestamp - 60e3), new Date(timestamp)])
 
-   timestamp += interval
+   timestamp += interval * speed
+}
+
+function replayState(state) {
+   replaying = true
+   replayStart = state.Start
+   speed = state.Paused ? 0 : state.Speed
+
+   $('#replay').show()
+   const position = document.getElementById('replay-position')
+   position.max = state.Duration / 1e6
+   position.value = state.Position / 1e6
+   document.getElementById('replay-speed').value = String(state.Speed)
+   document.getElementById('replay-loop').checked = state.Loop
+}
+
+function seek(control) {
+   socket.send(JSON.stringify({Op: 'seek', Value: String(control.value)}))
+}
+
+function speedChange(control) {
+   socket.send(JSON.stringify({Op: 'speed', Value: control.value}))
+}
+
+function loopChange(control) {
+   socket.send(JSON.stringify({Op: 'loop', Value: String(control.checked)}))
 }
 
 function select(info) {
@@ -225,6 +401,7 @@ function select(info) {
 function button(name, on) {
    let btn = document.createElement('button')
    btn.onclick = select
+   btn.disabled = !controlling
 
    let text = document.createTextNode(name)
    btn.appendChild(text)
@@ -312,10 +489,30 @@ function reduce(ents) {
    return out
 }
 
+// greys out controls changing what all clients see, unless allowed
+function controls() {
+   for (const id of ['data-interval', 'serverGroup', 'replay-position', 'replay-speed', 'replay-loop']) {
+      const elem = document.getElementById(id)
+      elem.disabled = !controlling
+      elem.title = controlling ? '' : 'Needs a controlling token'
+   }
+}
+
+// server refused a change, and resends its state
+function refused(msg) {
+   const elem = document.getElementById('loading')
+   elem.innerHTML = msg.Error
+   $('#loading').show()
+   setTimeout(() => $('#loading').hide(), 5000)
+}
+
 function signon(elem) {
    $('#connecting').hide()
    $('#loading').hide()
 
+   controlling = elem.Role == 'control'
+   controls()
+
    sources = elem.Sources
    reset()
 
@@ -324,6 +521,11 @@ function signon(elem) {
    for (const key in elem.Tree) {
       let elems = elem.Tree[key]
 
+      for (let i = 0; i < elems.length; i++) {
+         if (typeof elem.Kinds !== 'undefined')
+            metadata[elems[i]] = {kind: elem.Kinds[key][i], unit: elem.Units[key][i]}
+      }
+
       if (key == 'UNC')
          elems = filterUNC(elems)
 
@@ -356,6 +558,10 @@ function receive(e) {
       enabled(input)
    else if (input.Op == 'label')
       label(input)
+   else if (input.Op == 'replay')
+      replayState(input.Replay)
+   else if (input.Op == 'error')
+      refused(input)
    else
       update(input)
 }
@@ -366,6 +572,9 @@ function play() {
       stopped = false
    }
 
+   if (replaying && controlling)
+      socket.send(JSON.stringify({Op: 'resume'}))
+
    scrolling = true
 }
 
@@ -375,6 +584,9 @@ function pause() {
       stopped = false
    }
 
+   if (replaying && controlling)
+      socket.send(JSON.stringify({Op: 'pause'}))
+
    scrolling = false
 }
 
@@ -415,92 +627,193 @@ function reset() {
          container.removeChild(container.firstChild)
 }
 
-function parse(file) {
+// returns sensor descriptions and rows from any recording layout
+function layoutOf(json) {
+   // self-describing header object
+   if (!Array.isArray(json[0])) {
+      const header = json[0]
+      const sensors = []
+
+      for (const sensor of header.Sensors) {
+         const kinds = []
+         const units = []
+         const events = sensor.Events || []
+         const perEvent = Math.max(1, sensor.Headings.length / Math.max(1, events.length))
+
+         for (let i = 0; i < sensor.Headings.length; i++) {
+            const event = events[Math.floor(i / perEvent)] || {}
+            kinds.push(event.Kind)
+            units.push(event.Unit)
+         }
+
+         sensors.push({
+            name: sensor.Name,
+            sources: sensor.Sources,
+            rate: sensor.Rate,
+            kinds: kinds,
+            units: units,
+            headings: sensor.Headings
+         })
+      }
+
+      return {header: header, sensors: sensors, rows: json.slice(1)}
+   }
+
+   // workaround for legacy UNC3 file format
+   if (isNaN(json[0][1]) && !Array.isArray(json[0][0])) {
+      json[0].shift() // drop 'UNC' element
+      json.unshift(['UNC', 8, 850000000])
+   }
+
+   // single-sensor recordings have one description and headings row
+   const descs = Array.isArray(json[0][0]) ? json[0] : [json[0]]
+   const headingRows = Array.isArray(json[0][0]) ? json[1] : [json[1]]
+   const sensors = []
+
+   for (let i = 0; i < descs.length; i++) {
+      sensors.push({
+         name: descs[i][0],
+         sources: descs[i][1],
+         rate: descs[i][2],
+         kinds: descs[i][3] || [],
+         units: descs[i][4] || [],
+         headings: headingRows[i]
+      })
+   }
+
+   return {sensors: sensors, rows: json.slice(2)}
+}
+
+// accepts a JSON array or a value per line, where an interrupted recording may end part way through a line
+function decode(text) {
+   if (text.trimStart()[0] != '{')
+      return JSON.parse(text)
+
+   const json = []
+   const lines = text.split('\n')
+
+   for (let i = 0; i < lines.length; i++) {
+      if (lines[i].trim() == '')
+         continue
+
+      try {
+         json.push(JSON.parse(lines[i]))
+      } catch (e) {
+         if (i < lines.length-2)
+            throw e
+      }
+   }
+
+   return json
+}
+
+function parse(text) {
    let json
 
    // disable scrolling
    listened = false
 
    try {
-      json = JSON.parse(file.target.result)
+      json = decode(text)
    } catch (e) {
       alert('Input file is not well-formed JSON\n\n'+e)
       return
    }
 
+   render(layoutOf(json))
+}
+
+function render(trace) {
    const data = []
-   const total = json[0].length
 
-/*   const grouping = document.getElementById('grouping')
-   while (grouping.firstChild)
-      grouping.removeChild(grouping.firstChild) */
+   // per output heading
+   const kinds = []
+   const units = []
+   const norms = []
+   const technologies = []
+   const columns = [] // input column to output heading
 
-   // workaround for legacy UNC3 file format
-   if (isNaN(json[0][1])) {
-      json[0].shift() // drop 'UNC' element
-      json.unshift(['UNC', 8, 850000000])
-   }
+   headings = []
+   resetAxes()
+   reset()
 
-   let technology = json[0][0]
+   const container = document.querySelector('#events')
 
-   switch(technology) {
-   case 'NumaConnect2':
-      headings = filterNC2(json[1])
-      break
-   case 'UNC':
-      headings = filterUNC(json[1])
-//      grouping.appendChild(button('PE unit'))
-      break
-   }
+   for (const sensor of trace.sensors) {
+      filter = undefined
+      let sensorHeadings
+
+      switch(sensor.name) {
+      case 'NumaConnect2':
+         sensorHeadings = filterNC2(sensor.headings)
+         break
+      case 'UNC':
+         sensorHeadings = filterUNC(sensor.headings)
+         break
+      default:
+         sensorHeadings = sensor.headings
+      }
 
-   normalise = json[0][2] / 100
-   reset()
+      for (let i = 0; i < sensor.headings.length; i++) {
+         const dest = headings.length + ((typeof filter === 'undefined') ? i : filter[i])
+         columns.push(dest)
+         kinds[dest] = sensor.kinds[i]
+         units[dest] = sensor.units[i]
+         norms[dest] = sensor.rate / 100
+         technologies[dest] = sensor.name
+      }
+
+      headings = headings.concat(sensorHeadings)
+
+      const subtree = document.createElement('details')
+      const node = document.createElement('summary')
+      subtree.appendChild(node)
+      const text = document.createTextNode(sensor.name+' metrics')
+      node.appendChild(text)
+
+      // special button to activate all events
+      subtree.appendChild(button('all', false))
 
-   const subtree = document.createElement('details')
-   const node = document.createElement('summary')
-   subtree.appendChild(node)
-   const text = document.createTextNode(technology+' metrics')
-   node.appendChild(text)
+      for (const heading of sensorHeadings)
+         subtree.appendChild(button(heading, true))
 
-   // special button to activate all events
-   subtree.appendChild(button('all', false))
+      container.appendChild(subtree)
+   }
+
+   filter = columns
 
    const totals = []
+   let samples = 0
+   let first, last
+
+   for (let i = 0; i < headings.length; i++) {
+      const heading = headings[i]
 
-   for (const heading of headings) {
       data.push({
          name: heading,
          type: 'scatter',
          mode: 'lines',
          hoverlabel: {namelength: 80},
          x: [], y: [],
-         yaxis: (heading[0] == '%') ? 'y2' : 'y1',
-         visible: heading.includes(defaultTraces[technology]) ? 'true' : 'legendonly'
+         yaxis: axis(heading, kinds[i], units[i]),
+         visible: heading.includes(defaultTraces[technologies[i]]) ? 'true' : 'legendonly'
       })
 
-      subtree.appendChild(button(heading, true))
       totals.push(0)
    }
 
-   const container = document.querySelector('#events')
-   container.appendChild(subtree)
+   layout.annotations = []
+   layout.shapes = []
+   const spans = {}
 
-   const timeOffset = json[2][0]
-   for (let row = 2; row < json.length; row++) {
-      const val = json[row][0]
+   for (const row of trace.rows) {
+      const val = row[0]
 
       // handle general commands
       if (isNaN(val)) {
          switch(val) {
          case 'label':
-            layout.annotations.push({
-               x: (json[row][1] - timeOffset) / 1e6,
-               y: 0,
-               text: json[row][2],
-               arrowhead: 3,
-               ax: 0,
-               ay: 40
-            })
+            annotate(layout.annotations, layout.shapes, spans, new Date(row[1] / 1e3), row[2], (row[3] || {}).Kind, (row[3] || {}).Span, (row[3] || {}).Attrs)
             break;
          default:
             alert('unknown op '+val)
@@ -509,20 +822,41 @@ function parse(file) {
          continue
       }
 
+      if (typeof first === 'undefined')
+         first = val
+      last = val
+
       const time = new Date(val / 1e3)
-      const elems = reduce(json[row].slice(1, json[row].length))
+      const elems = reduce(row.slice(1, row.length))
 
       for (let elem = 0; elem < elems.length; elem++) {
+         const ratio = kinds[elem] === 'ratio' || (typeof kinds[elem] === 'undefined' && headings[elem][0] == '%')
+
          data[elem].x.push(time)
-         data[elem].y.push(
-            (headings[elem][0] == '%') ? (elems[elem] / normalise) : elems[elem])
+         data[elem].y.push(ratio ? (elems[elem] / norms[elem]) : elems[elem])
          totals[elem] += elems[elem]
       }
+
+      samples++
    }
 
+   // spans not ended continue to the end
+   for (const id in spans)
+      spans[id].x1 = new Date(last / 1e3)
+
    const totalsTable = document.getElementById('totals')
-   const interval = (json[json.length-1][0] - json[2][0]) / 1e6
-   document.getElementById('tableCaption').innerHTML = 'Total time '+interval.toFixed(2)+'s'
+   const interval = (last - first) / 1e6
+   let caption = 'Total time '+interval.toFixed(2)+'s'
+
+   if (typeof trace.header !== 'undefined') {
+      const h = trace.header
+      caption += ' on '+h.Hostname+' ('+h.CPU+', '+h.Topology.CPUs+' CPUs, '+(h.Topology.Nodes || []).length+' nodes, kernel '+h.Kernel+') at '+h.Interval+'ms interval'
+
+      if (h.Command && h.Command.length)
+         caption += ' running \''+h.Command.join(' ')+'\''
+   }
+
+   document.getElementById('tableCaption').innerText = caption
    let i = 0
 
    for (const heading of headings) {
@@ -530,8 +864,15 @@ function parse(file) {
       const cell = row.insertCell(-1)
 
       cell.innerHTML = heading
-      row.insertCell(-1).innerHTML = totals[i]
-      row.insertCell(-1).innerHTML = Math.round(totals[i]/interval)
+
+      // gauges have no meaningful total, so show mean value
+      if (kinds[i] === 'gauge') {
+         row.insertCell(-1).innerHTML = '-'
+         row.insertCell(-1).innerHTML = Math.round(totals[i]/samples)+' '+units[i]
+      } else {
+         row.insertCell(-1).innerHTML = totals[i]
+         row.insertCell(-1).innerHTML = Math.round(totals[i]/interval)
+      }
 
       i++
    }
@@ -550,19 +891,113 @@ function load(file) {
 
    halt()
 
-   const reader = new FileReader()
-   reader.onload = parse
-   reader.readAsText(file)
    document.title = file.name+' - numascope'
+   file.arrayBuffer().then(decompress).then(parse).catch(e => alert('Unable to load '+file.name+'\n\n'+e))
+}
+
+function startsWith(bytes, magic) {
+   return magic.every((val, i) => bytes[i] === val)
+}
+
+// decompresses gzip or zstd by content, keeping output up to where an interrupted recording ends
+async function decompress(buffer) {
+   const bytes = new Uint8Array(buffer)
+   let format
+
+   if (startsWith(bytes, [0x1f, 0x8b]))
+      format = 'gzip'
+   else if (startsWith(bytes, [0x28, 0xb5, 0x2f, 0xfd]))
+      format = 'zstd'
+   else if (startsWith(bytes, [0x4e, 0x53, 0x43, 0x4f, 0x50, 0x45]))
+      throw 'binary recordings need converting with \'numascope convert <input> <output.json>\''
+   else
+      return new TextDecoder().decode(bytes)
+
+   let stream
+
+   try {
+      stream = new Blob([bytes]).stream().pipeThrough(new DecompressionStream(format))
+   } catch (e) {
+      throw 'this browser cannot decompress '+format+'; use gzip or \'numascope convert\''
+   }
+
+   const reader = stream.getReader()
+   const decoder = new TextDecoder()
+   let text = ''
+
+   for (;;) {
+      let chunk
+
+      try {
+         chunk = await reader.read()
+      } catch (e) {
+         // truncated stream
+         break
+      }
+
+      if (chunk.done)
+         break
+
+      text += decoder.decode(chunk.value, {stream: true})
+   }
+
+   return text + decoder.decode()
+}
+
+// shows recordings served by 'numascope view', loading the first named one initially
+function browse(initial) {
+   return fetch('recordings').then(function(response) {
+      if (!response.ok)
+         throw response.statusText
+
+      return response.json()
+   }).then(function(entries) {
+      const container = document.getElementById('recordings')
+
+      while (container.firstChild)
+         container.removeChild(container.firstChild)
+
+      for (const entry of entries || []) {
+         const btn = document.createElement('button')
+         btn.className = 'btn btn-light btn-sm m-1'
+         btn.title = (entry.Size / 1e6).toFixed(1)+'MB, modified '+new Date(entry.Modified).toLocaleString()
+         btn.appendChild(document.createTextNode(entry.Name))
+         btn.onclick = function() { fetchRecording(entry.Name) }
+         container.appendChild(btn)
+      }
+
+      $('#browser').show()
+
+      if (initial && entries && entries.length && entries[0].Preload)
+         fetchRecording(entries[0].Name)
+   })
+}
+
+function fetchRecording(name) {
+   listened = false
+   document.title = name+' - numascope'
+
+   fetch('recording?name='+encodeURIComponent(name)).then(function(response) {
+      if (!response.ok)
+         return response.text().then(text => { throw text })
+
+      return response.text()
+   }).then(parse).catch(e => alert('Unable to load '+name+'\n\n'+e))
 }
 
-if (location.host == '' || location.protocol == 'https:') {
+function standalone(mode) {
    document.getElementById('btn-play').parentElement.className += ' disabled'
    document.getElementById('btn-pause').parentElement.className += ' disabled'
    document.getElementById('btn-stop').parentElement.className += ' disabled'
 //   radServerGroup.disabled = true
    document.getElementById('data-interval').disabled = true
-   document.getElementById('loading').innerHTML = 'Standalone mode'
+   document.getElementById('loading').innerHTML = mode
    offline = true
-} else
-   connect()
+}
+
+if (location.host == '')
+   standalone('Standalone mode')
+else {
+   // the viewer serves recordings rather than live data
+   browse(true).then(() => standalone('Viewer mode')).catch(() => connect(true))
+}
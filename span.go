@@ -0,0 +1,210 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "math"
+   "path"
+   "sort"
+   "strings"
+)
+
+// span and attributes of a label, recorded after its text when present
+type labelMeta struct {
+   Kind  string            `json:",omitempty"`
+   Span  string            `json:",omitempty"`
+   Attrs map[string]string `json:",omitempty"`
+}
+
+const (
+   spanBegin = "begin"
+   spanEnd   = "end"
+)
+
+func (l *Label) meta() *labelMeta {
+   if l.Kind == "" && l.Span == "" && len(l.Attrs) == 0 {
+      return nil
+   }
+
+   return &labelMeta{l.Kind, l.Span, l.Attrs}
+}
+
+// describes label in one line, eg "begin solve #2 iter=3"
+func (l Label) String() string {
+   s := l.Text
+
+   if l.Kind != "" {
+      s = fmt.Sprintf("%s %s #%s", l.Kind, l.Text, l.Span)
+   }
+
+   return s + formatAttrs(l.Attrs)
+}
+
+// formats attributes in key order, with a leading space
+func formatAttrs(attrs map[string]string) string {
+   keys := make([]string, 0, len(attrs))
+   for key := range attrs {
+      keys = append(keys, key)
+   }
+   sort.Strings(keys)
+
+   s := ""
+   for _, key := range keys {
+      s += " " + key + "=" + attrs[key]
+   }
+
+   return s
+}
+
+func isAttr(field string) bool {
+   i := strings.Index(field, "=")
+   return i > 0 && !strings.ContainsAny(field[:i], "\"'")
+}
+
+// splits trailing key=value fields from text
+func parseAttrs(line string) (string, map[string]string) {
+   fields := strings.Fields(line)
+   n := len(fields)
+
+   for n > 0 && isAttr(fields[n-1]) {
+      n--
+   }
+
+   if n == len(fields) {
+      return strings.TrimSpace(line), nil
+   }
+
+   attrs := make(map[string]string)
+   for _, field := range fields[n:] {
+      i := strings.Index(field, "=")
+      attrs[field[:i]] = field[i+1:]
+   }
+
+   return strings.Join(fields[:n], " "), attrs
+}
+
+// phases covered by spans; spans ending without beginning start at the
+// recording, eg after rotation, and those not ended continue to its end
+func spansOf(rec *Recording) []Phase {
+   var phases []Phase
+   open := make(map[string]int) // span to phase index
+
+   for _, label := range rec.Labels {
+      switch label.Kind {
+      case spanBegin:
+         open[label.Span] = len(phases)
+         phases = append(phases, Phase{Name: label.Text, Start: label.Timestamp, End: math.MaxInt64, Attrs: label.Attrs})
+      case spanEnd:
+         i, ok := open[label.Span]
+         if !ok {
+            phases = append(phases, Phase{Name: label.Text, Start: math.MinInt64, Attrs: label.Attrs})
+            i = len(phases)-1
+         }
+
+         delete(open, label.Span)
+         phases[i].End = label.Timestamp
+
+         // attributes may be added at the end
+         if len(label.Attrs) > 0 && ok {
+            attrs := make(map[string]string)
+            for key, val := range phases[i].Attrs {
+               attrs[key] = val
+            }
+            for key, val := range label.Attrs {
+               attrs[key] = val
+            }
+
+            phases[i].Attrs = attrs
+         }
+      }
+   }
+
+   return phases
+}
+
+// checks phase matches all comma-separated span or label names and
+// key=value attributes, each possibly with wildcards
+func (p *Phase) Matches(selection string) bool {
+   for _, term := range strings.Split(selection, ",") {
+      term = strings.TrimSpace(term)
+      var ok bool
+
+      if i := strings.Index(term, "="); i > 0 {
+         val, present := p.Attrs[term[:i]]
+         ok, _ = path.Match(term[i+1:], val)
+         ok = ok && present
+      } else {
+         ok, _ = path.Match(term, p.Name)
+      }
+
+      if !ok {
+         return false
+      }
+   }
+
+   return true
+}
+
+// phases matching selection
+func selectPhases(phases []Phase, selection string) []Phase {
+   var selected []Phase
+
+   for _, phase := range phases {
+      if phase.Matches(selection) {
+         selected = append(selected, phase)
+      }
+   }
+
+   return selected
+}
+
+// keeps only samples and labels within phases matching selection
+func selectRecording(rec *Recording, selection string) (*Recording, error) {
+   phases := selectPhases(phasesOf(rec), selection)
+   if len(phases) == 0 {
+      return nil, fmt.Errorf("no spans or labels match '%s'", selection)
+   }
+
+   within := func(timestamp int64) bool {
+      for _, phase := range phases {
+         if timestamp >= phase.Start && timestamp < phase.End {
+            return true
+         }
+      }
+
+      return false
+   }
+
+   selected := &Recording{Header: rec.Header}
+
+   for _, sample := range rec.Samples {
+      if within(sample.Timestamp) {
+         selected.Samples = append(selected.Samples, sample)
+      }
+   }
+
+   // span ends are at the exclusive end
+   for _, label := range rec.Labels {
+      if within(label.Timestamp) || (label.Kind == spanEnd && within(label.Timestamp - 1)) {
+         selected.Labels = append(selected.Labels, label)
+      }
+   }
+
+   return selected, nil
+}
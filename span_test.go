@@ -0,0 +1,143 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "fmt"
+   "io/ioutil"
+   "os"
+   "path/filepath"
+   "strconv"
+   "testing"
+)
+
+func TestSpans(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   rec := testRecording(1)
+   savedPresent, savedFile := present, *recordFile
+   defer func() { present, *recordFile = savedPresent, savedFile }()
+
+   present = []Sensor{NewPlayback(&rec.Header.Sensors[0], 0)}
+   *recordFile = filepath.Join(dir, "spans.nsb")
+
+   err = controlRecord("spans.nsb")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   solve, err := controlCommand("begin solve n=4096")
+   if err != nil || solve != strconv.Itoa(spanID) {
+      t.Fatalf("begin replied '%s': %v", solve, err)
+   }
+
+   // nested span is ended by name, outer by ID
+   for _, command := range []string{"begin iteration iter=1", "label converged residual=1e-9", "end iteration", "end "+solve+" result=ok"} {
+      _, err := controlCommand(command)
+      if err != nil {
+         t.Fatalf("'%s' failed: %v", command, err)
+      }
+   }
+
+   if _, err = controlCommand("end solve"); err == nil {
+      t.Error("expected ending closed span to fail")
+   }
+
+   controlStop()
+
+   loaded, err := loadRecording(*recordFile)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // spans survive conversion between formats
+   for _, name := range []string{"spans.json", "spans.jsonl.gz"} {
+      err = saveRecording(loaded, filepath.Join(dir, name))
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      out, err := loadRecording(filepath.Join(dir, name))
+      if err != nil {
+         t.Fatal(err)
+      }
+
+      if fmt.Sprint(out.Labels) != fmt.Sprint(loaded.Labels) {
+         t.Errorf("%s: labels %v, expected %v", name, out.Labels, loaded.Labels)
+      }
+   }
+
+   labels := loaded.Labels
+   if len(labels) != 5 || labels[0].Kind != spanBegin || labels[4].Span != labels[0].Span || labels[3].Span != labels[1].Span || labels[2].Attrs["residual"] != "1e-9" {
+      t.Fatalf("unexpected labels %v", labels)
+   }
+
+   if labels[4].String() != "end solve #"+labels[0].Span+" result=ok" {
+      t.Errorf("described as '%s'", labels[4])
+   }
+}
+
+func TestSelect(t *testing.T) {
+   text, attrs := parseAttrs("phase 1 run=a=b n=4096")
+   if text != "phase 1" || len(attrs) != 2 || attrs["run"] != "a=b" || attrs["n"] != "4096" {
+      t.Errorf("parsed '%s' %v", text, attrs)
+   }
+
+   // nested spans, the outer with an attribute added at the end
+   rec := testRecording(1)
+   rec.Labels = []Label{
+      {Timestamp: 1000000, Text: "solve", Kind: spanBegin, Span: "1", Attrs: map[string]string{"n": "4096"}},
+      {Timestamp: 2000000, Text: "iteration", Kind: spanBegin, Span: "2", Attrs: map[string]string{"iter": "1"}},
+      {Timestamp: 3000000, Text: "phase 1"},
+      {Timestamp: 3000000, Text: "iteration", Kind: spanEnd, Span: "2"},
+      {Timestamp: 5000000, Text: "solve", Kind: spanEnd, Span: "1", Attrs: map[string]string{"result": "ok"}},
+   }
+
+   phases := phasesOf(rec)
+   if len(phases) != 4 || phases[2].Name != "solve" || phases[2].End != 5000000 || phases[2].Attrs["result"] != "ok" || phases[3].Start != 2000000 {
+      t.Fatalf("unexpected phases %+v", phases)
+   }
+
+   stats, err := reportOf(rec, "", "n=4096,result=ok")
+   if err != nil || len(stats) == 0 || stats[0].Phase != "solve" {
+      t.Fatalf("unexpected selection %+v: %v", stats, err)
+   }
+
+   selected, err := selectRecording(rec, "iter*")
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // iteration covers 2s to 3s exclusive, keeping its end
+   if len(selected.Samples) != 1 || selected.Samples[0].Timestamp != 2000000 || len(selected.Labels) != 2 {
+      t.Errorf("selected %+v", selected)
+   }
+
+   if _, err = selectRecording(rec, "missing"); err == nil {
+      t.Error("expected empty selection to fail")
+   }
+
+   cmp, err := compare(rec, testRecording(2), "labels", "phase*")
+   if err != nil || len(cmp.Differences) == 0 || cmp.Differences[0].Phase != "all" || cmp.Differences[len(cmp.Differences)-1].Phase != "phase 1" {
+      t.Errorf("unexpected comparison %+v: %v", cmp, err)
+   }
+}
@@ -18,15 +18,29 @@
 package main
 
 import (
-   "bytes"
    "fmt"
    "os"
    "strings"
    "time"
-
-   "golang.org/x/sys/unix"
 )
 
+func statHeadings() [][]string {
+   headings := make([][]string, len(present))
+
+   for i, sensor := range present {
+      headings[i] = sensor.Headings(true)
+
+      // label gauges with their unit
+      for j, event := range headingEvents(sensor) {
+         if event.kind == Gauge && event.unit != "" {
+            headings[i][j] += "["+event.unit+"]"
+         }
+      }
+   }
+
+   return headings
+}
+
 func stat() {
    if *debug {
       fmt.Printf("detected %v\n", present)
@@ -37,32 +51,35 @@ func stat() {
          fmt.Printf("%s events:\n", sensor.Name())
 
          for _, val := range sensor.Events() {
-            fmt.Printf("%30s   %s\n", val.mnemonic, val.desc)
+            kind := val.kind.String()
+            if val.unit != "" && val.kind == Gauge {
+               kind += " "+val.unit
+            }
+
+            fmt.Printf("%30s   %-13s %s\n", val.mnemonic, kind, val.desc)
          }
       }
 
       os.Exit(0)
    }
 
-   delay := time.Duration(*interval) * time.Millisecond
    line := 0
-   headings := make([][]string, len(present))
-
-   for i, sensor := range present {
-      headings[i] = sensor.Headings(true)
-   }
-
-   labelBuf := make([]byte, 32)
+   var headings [][]string
+   current := -1
+   fifoBuf := make([]byte, 256)
+   last := time.Now()
 
    for {
-      time.Sleep(delay)
+      time.Sleep(currentInterval())
+      pollFifo(fifoBuf)
 
-      // print any label
-      n, err := unix.Read(fifo, labelBuf)
-      validateNonblock(err)
+      controlMutex.Lock()
 
-      if n > 0 {
-         fmt.Printf("- %s -\n", bytes.TrimSpace(labelBuf[:n]))
+      // events or mode changed
+      if generation != current {
+         current = generation
+         headings = statHeadings()
+         line = 0
       }
 
       // print column headings
@@ -74,14 +91,27 @@ func stat() {
       }
 
       line = (line + 1) % 25
+      now := time.Now()
+      timestamp := now.UnixNano() / 1e3
+      var values []int64
+      perSensor := make([][]int64, len(present))
 
       for i, sensor := range present {
          samples := sensor.Sample()
+         perSensor[i] = samples
+         values = append(values, samples...)
 
          for j, heading := range headings[i] {
             fmt.Printf("%*d ", len(heading), samples[j])
          }
       }
       fmt.Println()
+
+      writeSample(timestamp, values)
+      points := exportPoints(present, perSensor)
+      controlMutex.Unlock()
+
+      export(timestamp, now.Sub(last).Seconds(), points)
+      last = now
    }
 }
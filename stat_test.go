@@ -0,0 +1,46 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "testing"
+)
+
+// gauges are labelled with any unit
+func TestStatHeadings(t *testing.T) {
+   saved := present
+   defer func() { present = saved }()
+
+   multi, single := testRecording(1), singleSourceRecording(1)
+   present = nil
+
+   for _, rec := range []*Recording{multi, single} {
+      d := NewPlayback(&rec.Header.Sensors[0], 0)
+      for i := range d.events {
+         d.events[i].enabled = true
+      }
+
+      d.Enable(true)
+      present = append(present, d)
+   }
+
+   headings := statHeadings()
+   if len(headings) != 2 || headings[0][2] != "free:0[pages]" || headings[1][1] != "nr_dirty" || headings[1][2] != "busy" {
+      t.Errorf("unexpected headings %v", headings)
+   }
+}
@@ -0,0 +1,170 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "crypto/ecdsa"
+   "crypto/elliptic"
+   "crypto/rand"
+   "crypto/sha256"
+   "crypto/tls"
+   "crypto/x509"
+   "crypto/x509/pkix"
+   "encoding/pem"
+   "fmt"
+   "io/ioutil"
+   "math/big"
+   "net"
+   "os"
+   "path/filepath"
+   "strings"
+   "time"
+)
+
+const (
+   selfSignedCert = "/var/lib/numascope/tls.crt"
+   selfSignedKey  = "/var/lib/numascope/tls.key"
+   selfSignedDays = 825 // longest accepted by browsers
+)
+
+// checks if the web interface is served over TLS
+func tlsEnabled() bool {
+   return *tlsCert != "" || *selfSigned
+}
+
+// names and addresses the certificate is valid for
+func hostNames() (names []string, ips []net.IP) {
+   names = []string{"localhost"}
+   if hostname, err := os.Hostname(); err == nil {
+      names = append(names, hostname)
+   }
+
+   addrs, err := net.InterfaceAddrs()
+   if err == nil {
+      for _, addr := range addrs {
+         if ipnet, ok := addr.(*net.IPNet); ok {
+            ips = append(ips, ipnet.IP)
+         }
+      }
+   }
+
+   return
+}
+
+// writes a new self-signed certificate and key
+func generateCertificate(certFile, keyFile string) error {
+   key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+   if err != nil {
+      return err
+   }
+
+   serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+   if err != nil {
+      return err
+   }
+
+   names, ips := hostNames()
+   template := x509.Certificate{
+      SerialNumber: serial,
+      Subject: pkix.Name{Organization: []string{"numascope"}, CommonName: names[len(names)-1]},
+      NotBefore: time.Now().Add(-time.Hour),
+      NotAfter: time.Now().AddDate(0, 0, selfSignedDays),
+      KeyUsage: x509.KeyUsageDigitalSignature,
+      ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+      BasicConstraintsValid: true,
+      DNSNames: names,
+      IPAddresses: ips,
+   }
+
+   der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+   if err != nil {
+      return err
+   }
+
+   keyDER, err := x509.MarshalECPrivateKey(key)
+   if err != nil {
+      return err
+   }
+
+   for _, name := range []string{certFile, keyFile} {
+      err = os.MkdirAll(filepath.Dir(name), 0755)
+      if err != nil {
+         return err
+      }
+   }
+
+   // key is written first, so a certificate is never without one
+   err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+   if err != nil {
+      return err
+   }
+
+   return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// SHA-256 fingerprint, for checking a self-signed certificate in the browser
+func fingerprint(cert *tls.Certificate) string {
+   sum := sha256.Sum256(cert.Certificate[0])
+   hex := make([]string, len(sum))
+   for i, b := range sum {
+      hex[i] = fmt.Sprintf("%02X", b)
+   }
+
+   return strings.Join(hex, ":")
+}
+
+// loads certificate, generating a self-signed one on first start if requested
+func tlsConfig() (*tls.Config, error) {
+   certFile, keyFile := *tlsCert, *tlsKey
+
+   if *selfSigned {
+      if certFile == "" {
+         certFile = selfSignedCert
+      }
+      if keyFile == "" {
+         keyFile = selfSignedKey
+      }
+
+      if _, err := os.Stat(certFile); os.IsNotExist(err) {
+         err = generateCertificate(certFile, keyFile)
+         if err != nil {
+            return nil, err
+         }
+
+         fmt.Printf("generated self-signed certificate %s\n", certFile)
+      }
+   }
+
+   if keyFile == "" {
+      return nil, fmt.Errorf("-tlsCert needs -tlsKey")
+   }
+
+   cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+   if err != nil {
+      return nil, err
+   }
+
+   if *selfSigned {
+      fmt.Printf("certificate fingerprint %s\n", fingerprint(&cert))
+   }
+
+   return &tls.Config{
+      Certificates: []tls.Certificate{cert},
+      MinVersion: tls.VersionTLS12,
+   }, nil
+}
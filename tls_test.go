@@ -0,0 +1,87 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "crypto/tls"
+   "crypto/x509"
+   "io/ioutil"
+   "net/http"
+   "net/http/httptest"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+)
+
+func TestTLS(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   savedCert, savedKey, savedSigned := *tlsCert, *tlsKey, *selfSigned
+   defer func() { *tlsCert, *tlsKey, *selfSigned = savedCert, savedKey, savedSigned }()
+
+   *tlsCert = filepath.Join(dir, "tls", "cert.pem")
+   *tlsKey = filepath.Join(dir, "tls", "key.pem")
+   *selfSigned = true
+
+   config, err := tlsConfig()
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // generated only on first start
+   again, err := tlsConfig()
+   if err != nil || fingerprint(&again.Certificates[0]) != fingerprint(&config.Certificates[0]) {
+      t.Fatalf("certificate regenerated: %v", err)
+   }
+
+   if info, err := os.Stat(*tlsKey); err != nil || info.Mode().Perm() != 0600 {
+      t.Errorf("unexpected key file %v: %v", info, err)
+   }
+
+   server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      w.Write([]byte("ok"))
+   }))
+   server.TLS = config
+   server.StartTLS()
+   defer server.Close()
+
+   // trusted as issued for localhost
+   pem, err := ioutil.ReadFile(*tlsCert)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   pool := x509.NewCertPool()
+   pool.AppendCertsFromPEM(pem)
+   client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+   resp, err := client.Get(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+   if err != nil {
+      t.Fatal(err)
+   }
+   resp.Body.Close()
+
+   if resp.StatusCode != 200 || resp.TLS == nil {
+      t.Errorf("unexpected response %+v", resp)
+   }
+}
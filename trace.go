@@ -0,0 +1,526 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/json"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "os"
+   "path/filepath"
+   "runtime"
+   "strconv"
+   "strings"
+   "time"
+
+   "golang.org/x/sys/unix"
+)
+
+// recording format; legacy layouts without a header object are version 1
+const formatVersion = 2
+
+type Header struct {
+   Format    int
+   Version   string // of numascope
+   Hostname  string
+   Kernel    string
+   CPU       string
+   Topology  Topology
+   Cards     uint // NumaConnect2 cards
+   Interval  int  // in ms
+   Discrete  bool
+   Command   []string
+   Timestamp int64 // in us
+   Previous  string `json:",omitempty"` // segment this continues
+   Segment   int    `json:",omitempty"`
+   Sensors   []SensorHeader
+}
+
+type Topology struct {
+   CPUs  int
+   Nodes []NodeTopology
+}
+
+type NodeTopology struct {
+   Node int
+   CPUs string // eg "0-15,32-47"
+}
+
+type SensorHeader struct {
+   Name     string
+   Sources  uint
+   Rate     uint
+   Headings []string
+   Events   []EventHeader // enabled events, each having one or more headings
+}
+
+type EventHeader struct {
+   Mnemonic string
+   Desc     string
+   Kind     string
+   Unit     string
+}
+
+type Sample struct {
+   Timestamp int64 // in us
+   Values    []int64
+}
+
+type Label struct {
+   Timestamp int64
+   Text      string
+   Kind      string            `json:",omitempty"` // "begin" or "end" of a span, else a point
+   Span      string            `json:",omitempty"` // pairs begin and end
+   Attrs     map[string]string `json:",omitempty"`
+}
+
+// a loaded recording
+type Recording struct {
+   Header  Header
+   Samples []Sample
+   Labels  []Label
+}
+
+// event of a heading, as discrete events have a heading per source
+func (s *SensorHeader) HeadingEvent(i int) EventHeader {
+   if len(s.Events) == 0 {
+      return EventHeader{Desc: s.Headings[i], Kind: Counter.String()}
+   }
+
+   perEvent := len(s.Headings) / len(s.Events)
+   if perEvent == 0 {
+      perEvent = 1
+   }
+
+   return s.Events[i / perEvent]
+}
+
+// all headings across sensors, in sample order
+func (h *Header) Headings() (headings []string, events []EventHeader) {
+   for i := range h.Sensors {
+      sensor := &h.Sensors[i]
+
+      for j, heading := range sensor.Headings {
+         headings = append(headings, heading)
+         events = append(events, sensor.HeadingEvent(j))
+      }
+   }
+
+   return
+}
+
+func cpuModel() string {
+   f, err := os.Open("/proc/cpuinfo")
+   if err != nil {
+      return ""
+   }
+   defer f.Close()
+
+   scanner := bufio.NewScanner(f)
+   for scanner.Scan() {
+      fields := strings.SplitN(scanner.Text(), ":", 2)
+
+      if len(fields) == 2 && strings.TrimSpace(fields[0]) == "model name" {
+         return strings.TrimSpace(fields[1])
+      }
+   }
+
+   return ""
+}
+
+func topology() Topology {
+   topo := Topology{CPUs: runtime.NumCPU()}
+   dirs, _ := filepath.Glob("/sys/devices/system/node/node[0-9]*")
+
+   for _, dir := range dirs {
+      node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+      if err != nil {
+         continue
+      }
+
+      cpus, _ := ioutil.ReadFile(filepath.Join(dir, "cpulist"))
+      topo.Nodes = append(topo.Nodes, NodeTopology{node, strings.TrimSpace(string(cpus))})
+   }
+
+   return topo
+}
+
+// describes this host and the enabled events of present sensors
+func newHeader(command []string) Header {
+   h := Header{
+      Format: formatVersion,
+      Version: version,
+      CPU: cpuModel(),
+      Topology: topology(),
+      Interval: *interval,
+      Discrete: *discrete,
+      Command: command,
+      Timestamp: time.Now().UnixNano() / 1e3,
+   }
+
+   h.Hostname, _ = os.Hostname()
+
+   var uts unix.Utsname
+   if unix.Uname(&uts) == nil {
+      h.Kernel = string(bytes.TrimRight(uts.Release[:], "\x00"))
+   }
+
+   for _, sensor := range present {
+      if sensor.Name() == "NumaConnect2" {
+         h.Cards = sensor.Sources()
+      }
+
+      s := SensorHeader{
+         Name: sensor.Name(),
+         Sources: sensor.Sources(),
+         Rate: sensor.Rate(),
+         Headings: sensor.Headings(false),
+      }
+
+      for _, event := range sensor.Events() {
+         if event.enabled {
+            s.Events = append(s.Events, EventHeader{event.mnemonic, event.desc, event.kind.String(), event.unit})
+         }
+      }
+
+      h.Sensors = append(h.Sensors, s)
+   }
+
+   return h
+}
+
+// converts version 1 sensor rows, with optional kinds and units per heading
+func legacySensor(desc []interface{}, headings []string) (SensorHeader, error) {
+   s := SensorHeader{Headings: headings}
+
+   if len(desc) < 3 {
+      return s, fmt.Errorf("malformed sensor description %v", desc)
+   }
+
+   name, ok1 := desc[0].(string)
+   sources, ok2 := desc[1].(float64)
+   rate, ok3 := desc[2].(float64)
+   if !ok1 || !ok2 || !ok3 {
+      return s, fmt.Errorf("malformed sensor description %v", desc)
+   }
+
+   s.Name, s.Sources, s.Rate = name, uint(sources), uint(rate)
+
+   kinds, _ := json.Marshal(desc[3:])
+   var extra [][]string
+   json.Unmarshal(kinds, &extra)
+
+   // one event per heading, as events aren't described
+   for i, heading := range headings {
+      event := EventHeader{Desc: heading, Kind: Counter.String()}
+
+      if len(extra) > 0 && i < len(extra[0]) {
+         event.Kind = extra[0][i]
+      } else if strings.HasPrefix(heading, "%") {
+         event.Kind = Ratio.String()
+      }
+
+      if len(extra) > 1 && i < len(extra[1]) {
+         event.Unit = extra[1][i]
+      }
+
+      s.Events = append(s.Events, event)
+   }
+
+   return s, nil
+}
+
+// parses the header, returning the number of rows consumed
+func parseHeader(rows []json.RawMessage, h *Header) (int, error) {
+   if len(rows) == 0 {
+      return 0, fmt.Errorf("empty recording")
+   }
+
+   first := bytes.TrimSpace(rows[0])
+
+   if len(first) > 0 && first[0] == '{' {
+      err := json.Unmarshal(first, h)
+      if err == nil && h.Format > formatVersion {
+         err = fmt.Errorf("recording format %d is newer than supported %d", h.Format, formatVersion)
+      }
+
+      return 1, err
+   }
+
+   h.Format = 1
+
+   var desc []interface{}
+   err := json.Unmarshal(first, &desc)
+   if err != nil || len(desc) == 0 {
+      return 0, fmt.Errorf("unrecognised header: %v", err)
+   }
+
+   // UNC3 recordings start with headings
+   if name, ok := desc[0].(string); ok && len(desc) > 1 {
+      if _, ok := desc[1].(string); ok {
+         var headings []string
+         json.Unmarshal(first, &headings)
+
+         s, err := legacySensor([]interface{}{name, 8.0, 850000000.0}, headings[1:])
+         h.Sensors = []SensorHeader{s}
+         return 1, err
+      }
+   }
+
+   if len(rows) < 2 {
+      return 0, fmt.Errorf("missing headings")
+   }
+
+   // multiple sensors have nested descriptions and headings
+   if _, nested := desc[0].([]interface{}); nested {
+      var descs [][]interface{}
+      var headings [][]string
+
+      err := json.Unmarshal(first, &descs)
+      if err == nil {
+         err = json.Unmarshal(rows[1], &headings)
+      }
+      if err != nil {
+         return 0, err
+      }
+
+      if len(headings) != len(descs) {
+         return 0, fmt.Errorf("%d sensors with %d heading rows", len(descs), len(headings))
+      }
+
+      for i := range descs {
+         s, err := legacySensor(descs[i], headings[i])
+         if err != nil {
+            return 0, err
+         }
+
+         h.Sensors = append(h.Sensors, s)
+      }
+
+      return 2, nil
+   }
+
+   var headings []string
+   err = json.Unmarshal(rows[1], &headings)
+   if err != nil {
+      return 0, err
+   }
+
+   s, err := legacySensor(desc, headings)
+   h.Sensors = []SensorHeader{s}
+   return 2, err
+}
+
+// parses a sample or command row into the recording
+func (rec *Recording) parseRow(row json.RawMessage) error {
+   var elems []json.RawMessage
+
+   err := json.Unmarshal(row, &elems)
+   if err != nil {
+      return err
+   }
+
+   if len(elems) == 0 {
+      return fmt.Errorf("empty row")
+   }
+
+   var op string
+   if json.Unmarshal(elems[0], &op) == nil {
+      switch op {
+      case "label":
+         if len(elems) < 3 {
+            return fmt.Errorf("malformed label %s", row)
+         }
+
+         var label Label
+         err := json.Unmarshal(elems[1], &label.Timestamp)
+         if err == nil {
+            err = json.Unmarshal(elems[2], &label.Text)
+         }
+
+         // spans and attributes follow
+         if err == nil && len(elems) > 3 {
+            var meta labelMeta
+            err = json.Unmarshal(elems[3], &meta)
+            label.Kind, label.Span, label.Attrs = meta.Kind, meta.Span, meta.Attrs
+         }
+
+         rec.Labels = append(rec.Labels, label)
+         return err
+      default:
+         return fmt.Errorf("unknown op %q", op)
+      }
+   }
+
+   var values []int64
+   err = json.Unmarshal(row, &values)
+   if err != nil {
+      return err
+   }
+
+   rec.Samples = append(rec.Samples, Sample{values[0], values[1:]})
+   return nil
+}
+
+// loads current or legacy recording, as a JSON array, a value per line or binary, optionally compressed
+func readRecording(r io.Reader) (*Recording, error) {
+   var rows []json.RawMessage
+
+   reader, err := decompressed(bufio.NewReader(r))
+   if err != nil {
+      return nil, err
+   }
+
+   if isBinary(reader) {
+      return readBinary(reader)
+   }
+
+   if isCSV(reader) {
+      return readCSV(reader)
+   }
+
+   first, err := firstByte(reader)
+   if err != nil {
+      return nil, err
+   }
+
+   if first == '{' {
+      rows, err = readLines(reader)
+   } else {
+      err = json.NewDecoder(reader).Decode(&rows)
+   }
+
+   if err != nil {
+      return nil, err
+   }
+
+   rec := &Recording{}
+   n, err := parseHeader(rows, &rec.Header)
+   if err != nil {
+      return nil, err
+   }
+
+   for _, row := range rows[n:] {
+      err := rec.parseRow(row)
+      if err != nil {
+         return nil, err
+      }
+   }
+
+   return rec, nil
+}
+
+// peeks first non-whitespace byte
+func firstByte(reader *bufio.Reader) (byte, error) {
+   for i := 1; ; i++ {
+      b, err := reader.Peek(i)
+      if err != nil {
+         return 0, err
+      }
+
+      c := b[i-1]
+      if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+         return c, nil
+      }
+   }
+}
+
+func loadRecording(name string) (*Recording, error) {
+   f, err := os.Open(name)
+   if err != nil {
+      return nil, err
+   }
+   defer f.Close()
+
+   rec, err := readRecording(f)
+   if err != nil {
+      return nil, fmt.Errorf("%s: %v", name, err)
+   }
+
+   return rec, nil
+}
+
+// loads recording from a duration after its start, seeking with the index of
+// uncompressed binary recordings rather than reading earlier samples
+func loadRecordingFrom(name string, after time.Duration) (*Recording, error) {
+   if after <= 0 {
+      return loadRecording(name)
+   }
+
+   f, err := os.Open(name)
+   if err != nil {
+      return nil, err
+   }
+   defer f.Close()
+
+   info, err := f.Stat()
+   if err != nil {
+      return nil, err
+   }
+
+   rec, err := readBinaryFrom(f, info.Size(), after)
+   if err == nil {
+      return rec, nil
+   }
+
+   // without an index, eg compressed or interrupted
+   rec, err = loadRecording(name)
+   if err != nil {
+      return nil, err
+   }
+
+   if start, ok := rec.start(); ok {
+      rec.trim(start + int64(after / time.Microsecond))
+   }
+
+   return rec, nil
+}
+
+// time recording started, or of first sample or label if unrecorded
+func (rec *Recording) start() (int64, bool) {
+   switch {
+   case rec.Header.Timestamp != 0:
+      return rec.Header.Timestamp, true
+   case len(rec.Samples) == 0 && len(rec.Labels) == 0:
+      return 0, false
+   case len(rec.Labels) == 0:
+      return rec.Samples[0].Timestamp, true
+   case len(rec.Samples) == 0 || rec.Labels[0].Timestamp < rec.Samples[0].Timestamp:
+      return rec.Labels[0].Timestamp, true
+   }
+
+   return rec.Samples[0].Timestamp, true
+}
+
+// drops samples and labels before timestamp
+func (rec *Recording) trim(timestamp int64) {
+   i := 0
+   for i < len(rec.Samples) && rec.Samples[i].Timestamp < timestamp {
+      i++
+   }
+   rec.Samples = rec.Samples[i:]
+
+   i = 0
+   for i < len(rec.Labels) && rec.Labels[i].Timestamp < timestamp {
+      i++
+   }
+   rec.Labels = rec.Labels[i:]
+}
@@ -0,0 +1,537 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/binary"
+   "encoding/json"
+   "fmt"
+   "io"
+   "time"
+)
+
+// Layout:
+//   magic, uvarint header length, JSON header
+//   chunks: 'C', uvarint payload length, payload
+//      payload: varint first timestamp, uvarint records, records
+//      sample: 0, uvarint timestamp delta, uvarint count, zigzag varint value deltas
+//      label:  1, uvarint timestamp delta, uvarint length, text
+//      span:   2, as label, then uvarint length, JSON span and attributes
+//   index:  'I', uvarint chunks, per chunk uvarint offset and varint first timestamp
+//   trailer: uint64 index offset, little-endian
+//
+// Deltas restart in each chunk, so chunks decode independently and an
+// interrupted recording is readable up to the last complete chunk. The
+// index is written on closing, so only complete recordings can seek.
+
+const (
+   binaryMagic    = "NSCOPE\x00\x02"
+   chunkSamples   = 64
+   recordSample   = 0
+   recordLabel    = 1
+   recordSpan     = 2 // label followed by JSON span and attributes
+   markerChunk    = 'C'
+   markerIndex    = 'I'
+   trailerLength  = 8
+   maxLength      = 1 << 30 // of header or chunk, beyond which the recording is corrupt
+)
+
+type chunkIndex struct {
+   offset    int64
+   timestamp int64
+}
+
+type binaryWriter struct {
+   w         io.Writer
+   offset    int64
+   chunk     bytes.Buffer
+   records   int
+   samples   int
+   first     int64
+   last      int64
+   previous  []int64
+   index     []chunkIndex
+   scratch   [binary.MaxVarintLen64]byte
+}
+
+func newBinaryWriter(w io.Writer) *binaryWriter {
+   return &binaryWriter{w: w}
+}
+
+func (b *binaryWriter) write(buf []byte) error {
+   n, err := b.w.Write(buf)
+   b.offset += int64(n)
+   return err
+}
+
+func (b *binaryWriter) uvarint(buf *bytes.Buffer, val uint64) {
+   n := binary.PutUvarint(b.scratch[:], val)
+   buf.Write(b.scratch[:n])
+}
+
+func (b *binaryWriter) varint(buf *bytes.Buffer, val int64) {
+   n := binary.PutVarint(b.scratch[:], val)
+   buf.Write(b.scratch[:n])
+}
+
+func (b *binaryWriter) Header(h Header) error {
+   j, err := json.Marshal(h)
+   if err != nil {
+      return err
+   }
+
+   var buf bytes.Buffer
+   buf.WriteString(binaryMagic)
+   b.uvarint(&buf, uint64(len(j)))
+   buf.Write(j)
+
+   return b.write(buf.Bytes())
+}
+
+// starts a record, returning timestamp delta within chunk
+func (b *binaryWriter) record(kind byte, timestamp int64) uint64 {
+   if b.records == 0 {
+      b.first = timestamp
+      b.last = timestamp
+      b.previous = b.previous[:0]
+   }
+
+   // clocks can step backwards
+   if timestamp < b.last {
+      timestamp = b.last
+   }
+
+   delta := uint64(timestamp - b.last)
+   b.last = timestamp
+   b.records++
+
+   b.chunk.WriteByte(kind)
+   return delta
+}
+
+func (b *binaryWriter) Sample(timestamp int64, values []int64) error {
+   b.uvarint(&b.chunk, b.record(recordSample, timestamp))
+   b.uvarint(&b.chunk, uint64(len(values)))
+
+   for i, val := range values {
+      if i < len(b.previous) {
+         b.varint(&b.chunk, val - b.previous[i])
+         b.previous[i] = val
+      } else {
+         b.varint(&b.chunk, val)
+         b.previous = append(b.previous, val)
+      }
+   }
+
+   b.samples++
+   if b.samples >= chunkSamples {
+      return b.flush()
+   }
+
+   return nil
+}
+
+func (b *binaryWriter) Label(label Label) error {
+   meta := label.meta()
+   kind := byte(recordLabel)
+   if meta != nil {
+      kind = recordSpan
+   }
+
+   b.uvarint(&b.chunk, b.record(kind, label.Timestamp))
+   b.uvarint(&b.chunk, uint64(len(label.Text)))
+   b.chunk.WriteString(label.Text)
+
+   if meta != nil {
+      encoded, err := json.Marshal(meta)
+      if err != nil {
+         return err
+      }
+
+      b.uvarint(&b.chunk, uint64(len(encoded)))
+      b.chunk.Write(encoded)
+   }
+
+   // don't lose labels if interrupted
+   return b.flush()
+}
+
+// writes any pending chunk
+func (b *binaryWriter) flush() error {
+   if b.records == 0 {
+      return nil
+   }
+
+   var prefix bytes.Buffer
+   b.varint(&prefix, b.first)
+   b.uvarint(&prefix, uint64(b.records))
+
+   var head bytes.Buffer
+   head.WriteByte(markerChunk)
+   b.uvarint(&head, uint64(prefix.Len() + b.chunk.Len()))
+
+   b.index = append(b.index, chunkIndex{b.offset, b.first})
+
+   err := b.write(head.Bytes())
+   if err == nil {
+      err = b.write(prefix.Bytes())
+   }
+   if err == nil {
+      err = b.write(b.chunk.Bytes())
+   }
+
+   b.chunk.Reset()
+   b.records = 0
+   b.samples = 0
+   return err
+}
+
+func (b *binaryWriter) Close() error {
+   err := b.flush()
+   if err != nil {
+      return err
+   }
+
+   indexOffset := b.offset
+
+   var buf bytes.Buffer
+   buf.WriteByte(markerIndex)
+   b.uvarint(&buf, uint64(len(b.index)))
+
+   for _, chunk := range b.index {
+      b.uvarint(&buf, uint64(chunk.offset))
+      b.varint(&buf, chunk.timestamp)
+   }
+
+   var trailer [trailerLength]byte
+   binary.LittleEndian.PutUint64(trailer[:], uint64(indexOffset))
+   buf.Write(trailer[:])
+
+   return b.write(buf.Bytes())
+}
+
+func isBinary(reader *bufio.Reader) bool {
+   magic, err := reader.Peek(len(binaryMagic))
+   return err == nil && string(magic) == binaryMagic
+}
+
+func readString(r *bytes.Reader) (string, error) {
+   length, err := binary.ReadUvarint(r)
+   if err != nil {
+      return "", err
+   }
+
+   if length > uint64(r.Len()) {
+      return "", io.ErrUnexpectedEOF
+   }
+
+   buf := make([]byte, length)
+   _, err = io.ReadFull(r, buf)
+   return string(buf), err
+}
+
+// reads length bytes, growing the buffer only as they arrive, so a corrupt
+// length fails at the end of input rather than allocating it
+func readBytes(r io.Reader, length uint64) ([]byte, error) {
+   if length > maxLength {
+      return nil, fmt.Errorf("corrupt length %d", length)
+   }
+
+   var buf bytes.Buffer
+   _, err := io.CopyN(&buf, r, int64(length))
+   if err == io.EOF {
+      err = io.ErrUnexpectedEOF
+   }
+
+   return buf.Bytes(), err
+}
+
+// decodes a chunk payload into the recording
+func (rec *Recording) parseChunk(payload []byte) error {
+   r := bytes.NewReader(payload)
+
+   timestamp, err := binary.ReadVarint(r)
+   if err != nil {
+      return err
+   }
+
+   records, err := binary.ReadUvarint(r)
+   if err != nil {
+      return err
+   }
+
+   var previous []int64
+
+   for i := uint64(0); i < records; i++ {
+      kind, err := r.ReadByte()
+      if err != nil {
+         return err
+      }
+
+      delta, err := binary.ReadUvarint(r)
+      if err != nil {
+         return err
+      }
+
+      timestamp += int64(delta)
+
+      switch kind {
+      case recordSample:
+         count, err := binary.ReadUvarint(r)
+         if err != nil {
+            return err
+         }
+
+         // each value takes at least a byte
+         if count > uint64(r.Len()) {
+            return io.ErrUnexpectedEOF
+         }
+
+         values := make([]int64, count)
+
+         for j := range values {
+            val, err := binary.ReadVarint(r)
+            if err != nil {
+               return err
+            }
+
+            if j < len(previous) {
+               val += previous[j]
+               previous[j] = val
+            } else {
+               previous = append(previous, val)
+            }
+
+            values[j] = val
+         }
+
+         rec.Samples = append(rec.Samples, Sample{timestamp, values})
+      case recordLabel, recordSpan:
+         text, err := readString(r)
+         if err != nil {
+            return err
+         }
+
+         label := Label{Timestamp: timestamp, Text: text}
+
+         if kind == recordSpan {
+            encoded, err := readString(r)
+            if err != nil {
+               return err
+            }
+
+            var meta labelMeta
+            err = json.Unmarshal([]byte(encoded), &meta)
+            if err != nil {
+               return err
+            }
+
+            label.Kind, label.Span, label.Attrs = meta.Kind, meta.Span, meta.Attrs
+         }
+
+         rec.Labels = append(rec.Labels, label)
+      default:
+         return fmt.Errorf("unknown record type %d", kind)
+      }
+   }
+
+   return nil
+}
+
+func readBinaryHeader(reader *bufio.Reader) (*Recording, error) {
+   _, err := reader.Discard(len(binaryMagic))
+   if err != nil {
+      return nil, err
+   }
+
+   length, err := binary.ReadUvarint(reader)
+   if err != nil {
+      return nil, err
+   }
+
+   j, err := readBytes(reader, length)
+   if err != nil {
+      return nil, err
+   }
+
+   rec := &Recording{}
+   err = json.Unmarshal(j, &rec.Header)
+   if err != nil {
+      return nil, err
+   }
+
+   return rec, nil
+}
+
+// reads chunks sequentially, stopping at the index or an incomplete chunk
+func readBinary(reader *bufio.Reader) (*Recording, error) {
+   rec, err := readBinaryHeader(reader)
+   if err != nil {
+      return nil, err
+   }
+
+   err = rec.readChunks(reader)
+   if err != nil {
+      return nil, err
+   }
+
+   return rec, nil
+}
+
+func (rec *Recording) readChunks(reader *bufio.Reader) error {
+   for {
+      marker, err := reader.ReadByte()
+      if err == io.EOF || marker == markerIndex {
+         break
+      }
+
+      if err != nil {
+         return err
+      }
+
+      if marker != markerChunk {
+         return fmt.Errorf("unexpected marker %#x", marker)
+      }
+
+      length, err := binary.ReadUvarint(reader)
+      if err != nil {
+         break
+      }
+
+      payload, err := readBytes(reader, length)
+      if err == io.ErrUnexpectedEOF {
+         // interrupted while writing chunk
+         break
+      }
+
+      if err != nil {
+         return err
+      }
+
+      err = rec.parseChunk(payload)
+      if err != nil {
+         return err
+      }
+   }
+
+   return nil
+}
+
+// reads the index of a complete recording of size bytes
+func readIndex(r io.ReaderAt, size int64) ([]chunkIndex, error) {
+   var trailer [trailerLength]byte
+   if size < int64(len(binaryMagic) + trailerLength) {
+      return nil, fmt.Errorf("no index")
+   }
+
+   _, err := r.ReadAt(trailer[:], size - trailerLength)
+   if err != nil {
+      return nil, err
+   }
+
+   offset := int64(binary.LittleEndian.Uint64(trailer[:]))
+   if offset < int64(len(binaryMagic)) || offset >= size - trailerLength {
+      return nil, fmt.Errorf("no index")
+   }
+
+   reader := bufio.NewReader(io.NewSectionReader(r, offset, size - trailerLength - offset))
+   marker, err := reader.ReadByte()
+   if err != nil || marker != markerIndex {
+      return nil, fmt.Errorf("no index")
+   }
+
+   count, err := binary.ReadUvarint(reader)
+   if err != nil {
+      return nil, err
+   }
+
+   // each entry takes at least two bytes
+   if count > uint64(size - offset) / 2 {
+      return nil, fmt.Errorf("corrupt index of %d chunks", count)
+   }
+
+   index := make([]chunkIndex, count)
+
+   for i := range index {
+      chunkOffset, err := binary.ReadUvarint(reader)
+      if err != nil {
+         return nil, err
+      }
+
+      if chunkOffset >= uint64(offset) {
+         return nil, fmt.Errorf("corrupt index offset %d", chunkOffset)
+      }
+
+      index[i].offset = int64(chunkOffset)
+      index[i].timestamp, err = binary.ReadVarint(reader)
+      if err != nil {
+         return nil, err
+      }
+   }
+
+   return index, nil
+}
+
+// reads the header, then uses the index to read only chunks from the last
+// starting at or before the time after the recording started
+func readBinaryFrom(r io.ReaderAt, size int64, after time.Duration) (*Recording, error) {
+   magic := make([]byte, len(binaryMagic))
+   _, err := r.ReadAt(magic, 0)
+   if err != nil || string(magic) != binaryMagic {
+      return nil, fmt.Errorf("not a binary recording")
+   }
+
+   index, err := readIndex(r, size)
+   if err != nil {
+      return nil, err
+   }
+
+   rec, err := readBinaryHeader(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+   if err != nil {
+      return nil, err
+   }
+
+   if len(index) == 0 {
+      return rec, nil
+   }
+
+   // as Recording.start, before reading any samples
+   start := rec.Header.Timestamp
+   if start == 0 {
+      start = index[0].timestamp
+   }
+
+   timestamp := start + int64(after / time.Microsecond)
+   first := 0
+   for i := range index {
+      if index[i].timestamp <= timestamp {
+         first = i
+      }
+   }
+
+   offset := index[first].offset
+   err = rec.readChunks(bufio.NewReader(io.NewSectionReader(r, offset, size - offset)))
+   if err != nil {
+      return nil, err
+   }
+
+   rec.trim(timestamp)
+   return rec, nil
+}
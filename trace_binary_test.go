@@ -0,0 +1,199 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/binary"
+   "fmt"
+   "io/ioutil"
+   "os"
+   "strings"
+   "testing"
+   "time"
+)
+
+func TestRecordingBinary(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   name := recordSynthetic(t, dir, 150)
+   rec, err := loadRecording(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   var buf strings.Builder
+   err = writeRecording(rec, newBinaryWriter(&buf))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   binary := buf.String()
+   out, err := readRecording(strings.NewReader(binary))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if fmt.Sprint(out.Samples) != fmt.Sprint(rec.Samples) || fmt.Sprint(out.Labels) != fmt.Sprint(rec.Labels) {
+      t.Error("binary round trip differs")
+   }
+
+   if out.Header.Sensors[0].Events[1].Kind != "ratio" {
+      t.Errorf("header not preserved: %+v", out.Header)
+   }
+
+   // interrupted in last chunk keeps complete chunks
+   out, err = readRecording(strings.NewReader(binary[:len(binary)-200]))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(out.Samples) != 2 * chunkSamples {
+      t.Errorf("%d samples from truncated recording", len(out.Samples))
+   }
+
+   // corrupt lengths fail rather than allocating them
+   header := binary[:strings.Index(binary, string(markerChunk))]
+   for _, corrupt := range []string{binaryMagic + "\xff\xff\xff\xff\xff\xff\xff\xff\x7f", header + "C\xff\xff\xff\xff\x0f"} {
+      _, err = readRecording(strings.NewReader(corrupt))
+      if err == nil {
+         t.Errorf("corrupt recording %q read", corrupt[len(corrupt)-6:])
+      }
+   }
+
+   var csv strings.Builder
+   err = writeRecording(rec, newCSVWriter(&csv))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+   if len(lines) != 152 || !strings.HasPrefix(lines[0], "timestamp,remote cacheline reads:0,") {
+      t.Errorf("unexpected CSV with %d lines, starting %q", len(lines), lines[0])
+   }
+
+   // read back as counters of one sensor
+   out, err = readRecording(strings.NewReader(csv.String()))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if fmt.Sprint(out.Samples) != fmt.Sprint(rec.Samples) || fmt.Sprint(out.Labels) != fmt.Sprint(rec.Labels) {
+      t.Error("CSV round trip differs")
+   }
+
+   if headings, events := out.Header.Headings(); len(headings) != len(rec.Samples[0].Values) || headings[0] != "remote cacheline reads:0" || events[0].Kind != "counter" {
+      t.Errorf("unexpected CSV header %+v", out.Header)
+   }
+}
+
+func TestRecordingIndex(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   name := recordSynthetic(t, dir, 150)
+   rec, err := loadRecording(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   var buf strings.Builder
+   err = writeRecording(rec, newBinaryWriter(&buf))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   binary := buf.String()
+   r := strings.NewReader(binary)
+
+   index, err := readIndex(r, r.Size())
+   if err != nil || len(index) < 3 || binary[index[0].offset] != markerChunk || index[1].timestamp != rec.Samples[0].Timestamp {
+      t.Fatalf("unexpected index %+v: %v", index, err)
+   }
+
+   // starting in the third chunk, after the label and a chunk of samples, reads only from it
+   after := time.Duration(index[2].timestamp - rec.Header.Timestamp + 1) * time.Microsecond
+   out, err := readBinaryFrom(r, r.Size(), after)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(out.Samples) != len(rec.Samples) - chunkSamples - 1 || len(out.Labels) != 0 || out.Samples[len(out.Samples)-1].Timestamp != rec.Samples[len(rec.Samples)-1].Timestamp {
+      t.Errorf("unexpected samples from %v", after)
+   }
+
+   // falls back to reading all of recordings without an index
+   full, err := loadRecordingFrom(name, after)
+   if err != nil || fmt.Sprint(full.Samples) != fmt.Sprint(out.Samples) {
+      t.Errorf("unexpected samples from %v without index: %v", after, err)
+   }
+
+   if _, err = readBinaryFrom(strings.NewReader(binary[:len(binary)-4]), int64(len(binary)-4), after); err == nil {
+      t.Error("truncated recording read from index")
+   }
+
+   corrupt := binary[:len(binary)-trailerLength] + "\xff\xff\xff\xff\x00\x00\x00\x00"
+   if _, err = readBinaryFrom(strings.NewReader(corrupt), int64(len(corrupt)), after); err == nil {
+      t.Error("corrupt index offset read")
+   }
+}
+
+// every truncation reads the complete chunks before it, or fails in the header
+func TestRecordingBinaryTruncated(t *testing.T) {
+   rec := singleSourceRecording(1)
+
+   var buf strings.Builder
+   err := writeRecording(rec, newBinaryWriter(&buf))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   data := buf.String()
+   out, err := readRecording(strings.NewReader(data))
+   if err != nil || fmt.Sprint(out.Samples) != fmt.Sprint(rec.Samples) || fmt.Sprint(out.Labels) != fmt.Sprint(rec.Labels) {
+      t.Fatalf("binary round trip differs %+v: %v", out, err)
+   }
+
+   length, n := binary.Uvarint([]byte(data[len(binaryMagic):]))
+   chunk := len(binaryMagic) + n + int(length)
+
+   for n := len(binaryMagic); n < len(data); n++ {
+      out, err := readRecording(strings.NewReader(data[:n]))
+      if n < chunk {
+         if err == nil {
+            t.Errorf("header truncated at %d read", n)
+         }
+         continue
+      }
+
+      if err != nil || len(out.Samples) > len(rec.Samples) || fmt.Sprint(out.Samples) != fmt.Sprint(rec.Samples[:len(out.Samples)]) {
+         t.Errorf("truncated at %d read %+v: %v", n, out, err)
+      }
+   }
+
+   // the index follows the last chunk
+   if _, err = readRecording(strings.NewReader(data[:chunk] + "X")); err == nil {
+      t.Error("unknown marker read")
+   }
+}
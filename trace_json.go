@@ -0,0 +1,185 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "bufio"
+   "bytes"
+   "encoding/json"
+   "fmt"
+   "io"
+   "time"
+)
+
+// writes recordings in a particular format
+type TraceWriter interface {
+   Header(h Header) error
+   Sample(timestamp int64, values []int64) error
+   Label(label Label) error
+   // completes the recording, without closing the underlying file
+   Close() error
+}
+
+// JSON array, only valid once closed
+type jsonWriter struct {
+   w io.Writer
+}
+
+// a JSON value per line, each loadable even if recording is interrupted
+type linesWriter struct {
+   w        io.Writer
+   lastSync time.Time
+}
+
+type syncer interface {
+   Sync() error
+}
+
+const syncInterval = time.Second
+
+func newJSONWriter(w io.Writer) *jsonWriter {
+   return &jsonWriter{w: w}
+}
+
+func (j *jsonWriter) row(prefix string, val interface{}) error {
+   b, err := json.Marshal(val)
+   if err != nil {
+      return err
+   }
+
+   _, err = j.w.Write(append([]byte(prefix), b...))
+   return err
+}
+
+func (j *jsonWriter) Header(h Header) error {
+   return j.row("[", h)
+}
+
+func (j *jsonWriter) Sample(timestamp int64, values []int64) error {
+   return j.row(",\n", append([]int64{timestamp}, values...))
+}
+
+// spans and attributes follow text, so earlier readers ignore them
+func labelRow(label Label) []interface{} {
+   row := []interface{}{"label", label.Timestamp, label.Text}
+
+   if meta := label.meta(); meta != nil {
+      row = append(row, meta)
+   }
+
+   return row
+}
+
+func (j *jsonWriter) Label(label Label) error {
+   return j.row(",\n", labelRow(label))
+}
+
+func (j *jsonWriter) Close() error {
+   _, err := io.WriteString(j.w, "\n]\n")
+   return err
+}
+
+func newLinesWriter(w io.Writer) *linesWriter {
+   return &linesWriter{w: w, lastSync: time.Now()}
+}
+
+// writes a complete line, periodically syncing to storage
+func (l *linesWriter) row(val interface{}) error {
+   b, err := json.Marshal(val)
+   if err != nil {
+      return err
+   }
+
+   _, err = l.w.Write(append(b, '\n'))
+   if err != nil {
+      return err
+   }
+
+   if s, ok := l.w.(syncer); ok && time.Since(l.lastSync) > syncInterval {
+      l.lastSync = time.Now()
+      return s.Sync()
+   }
+
+   return nil
+}
+
+func (l *linesWriter) Header(h Header) error {
+   return l.row(h)
+}
+
+func (l *linesWriter) Sample(timestamp int64, values []int64) error {
+   return l.row(append([]int64{timestamp}, values...))
+}
+
+func (l *linesWriter) Label(label Label) error {
+   err := l.row(labelRow(label))
+
+   // labels are rare and valuable
+   if s, ok := l.w.(syncer); ok && err == nil {
+      err = s.Sync()
+   }
+
+   return err
+}
+
+func (l *linesWriter) Close() error {
+   if s, ok := l.w.(syncer); ok {
+      return s.Sync()
+   }
+
+   return nil
+}
+
+// splits into complete lines, discarding any incomplete or unparseable last line
+func readLines(r io.Reader) ([]json.RawMessage, error) {
+   var rows []json.RawMessage
+   reader := bufio.NewReader(r)
+
+   for n := 1; ; n++ {
+      line, err := reader.ReadBytes('\n')
+      line = bytes.TrimSpace(line)
+
+      if len(line) > 0 {
+         if !json.Valid(line) {
+            // an interrupted recording ends part way through a line
+            if err == io.EOF {
+               break
+            }
+
+            _, err2 := reader.Peek(1)
+            if err2 == io.EOF {
+               break
+            }
+
+            return nil, fmt.Errorf("malformed line %d", n)
+         }
+
+         rows = append(rows, json.RawMessage(line))
+      }
+
+      if err == io.EOF {
+         break
+      }
+
+      if err != nil {
+         return nil, err
+      }
+   }
+
+   return rows, nil
+}
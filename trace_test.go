@@ -0,0 +1,150 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "io/ioutil"
+   "os"
+   "strings"
+   "testing"
+)
+
+// two sources of a counter and a gauge, sampled each second with a label at 3s
+func testRecording(scale int64) *Recording {
+   rec := &Recording{
+      Header: Header{
+         Format: formatVersion,
+         Sensors: []SensorHeader{{
+            Name: "test",
+            Sources: 2,
+            Rate: 1000,
+            Headings: []string{"reads:0", "reads:1", "free:0", "free:1", "% busy:0", "% busy:1"},
+            Events: []EventHeader{
+               {"reads", "reads", "counter", ""},
+               {"free", "free", "gauge", "pages"},
+               {"busy", "% busy", "ratio", "%"},
+            },
+         }},
+      },
+      Labels: []Label{{Timestamp: 3000000, Text: "phase 1"}},
+   }
+
+   for i := int64(0); i <= 5; i++ {
+      rec.Samples = append(rec.Samples, Sample{i * 1000000, []int64{i * 10 * scale, 100, 50 + i, 50, 500, 100}})
+   }
+
+   return rec
+}
+
+// one source, as the kernel sensor, so headings are descriptions; with a
+// unit-less gauge, a ratio and a span left open at the end
+func singleSourceRecording(scale int64) *Recording {
+   rec := &Recording{
+      Header: Header{
+         Format: formatVersion,
+         Sensors: []SensorHeader{{
+            Name: "Kernel",
+            Sources: 1,
+            Rate: 1000,
+            Headings: []string{"NUMA misses", "dirty pages", "% busy"},
+            Events: []EventHeader{
+               {"numa_miss", "NUMA misses", "counter", ""},
+               {"nr_dirty", "dirty pages", "gauge", ""},
+               {"busy", "% busy", "ratio", "%"},
+            },
+         }},
+      },
+      Labels: []Label{{Timestamp: 2000000, Text: "solve", Kind: spanBegin, Span: "1", Attrs: map[string]string{"n": "4096"}}},
+   }
+
+   for i := int64(0); i <= 5; i++ {
+      rec.Samples = append(rec.Samples, Sample{i * 1000000, []int64{i * 10 * scale, 100 + i, 250}})
+   }
+
+   return rec
+}
+
+func TestRecordingLegacy(t *testing.T) {
+   single := `[["NumaConnect2",2,200000000],
+["% wait cycles:0","% wait cycles:1","reads:0","reads:1"],
+[1000,1,2,3,4],
+["label",1500,"start"],
+[2000,5,6,7,8]
+]`
+
+   rec, err := readRecording(strings.NewReader(single))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   s := rec.Header.Sensors[0]
+   if rec.Header.Format != 1 || s.Name != "NumaConnect2" || s.Sources != 2 || s.Rate != 200000000 {
+      t.Errorf("unexpected sensor %+v", s)
+   }
+
+   if s.HeadingEvent(0).Kind != "ratio" || s.HeadingEvent(2).Kind != "counter" {
+      t.Errorf("unexpected kinds %+v", s.Events)
+   }
+
+   if len(rec.Samples) != 2 || rec.Samples[1].Values[3] != 8 || len(rec.Labels) != 1 {
+      t.Errorf("unexpected rows %+v %+v", rec.Samples, rec.Labels)
+   }
+
+   multi := `[[["NumaConnect2",1,200000000,["counter"],[""]],["kernel VMstat",1,0,["gauge"],["pages"]]],
+[["reads"],["unallocated pages"]],
+[1000,1,2]
+]`
+
+   rec, err = readRecording(strings.NewReader(multi))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   headings, events := rec.Header.Headings()
+   if len(headings) != 2 || events[1].Kind != "gauge" || events[1].Unit != "pages" {
+      t.Errorf("unexpected headings %v %+v", headings, events)
+   }
+}
+
+func TestRecordingLines(t *testing.T) {
+   dir, err := ioutil.TempDir("", "record")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   *format = "lines"
+   defer func() { *format = "" }()
+
+   name := recordSynthetic(t, dir, 3)
+   content, err := ioutil.ReadFile(name)
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   // interrupted part way through the last sample
+   truncated := content[:len(content)-5]
+   rec, err := readRecording(strings.NewReader(string(truncated)))
+   if err != nil {
+      t.Fatal(err)
+   }
+
+   if len(rec.Samples) != 2 || len(rec.Labels) != 1 {
+      t.Errorf("%d samples and %d labels, expected 2 and 1", len(rec.Samples), len(rec.Labels))
+   }
+}
@@ -0,0 +1,152 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "encoding/json"
+   "fmt"
+   "io/ioutil"
+   "net/http"
+   "os"
+   "path"
+   "path/filepath"
+   "sort"
+   "strings"
+   "time"
+)
+
+type RecordingEntry struct {
+   Name     string // path as served
+   Size     int64
+   Modified time.Time
+   Preload  bool   // named on command line
+}
+
+// files and directories of recordings being served
+type Viewer struct {
+   paths []string
+}
+
+// checks if name has the extension of a readable recording
+func isRecording(name string) bool {
+   switch path.Ext(strings.TrimSuffix(name, compression(name))) {
+   case ".json", ".jsonl", ".ndjson", ".nsb":
+      return true
+   }
+
+   return false
+}
+
+// lists named files and recordings in named directories, rescanning to find new recordings
+func (v *Viewer) Entries() []RecordingEntry {
+   var entries []RecordingEntry
+
+   for _, name := range v.paths {
+      info, err := os.Stat(name)
+      if err != nil {
+         continue
+      }
+
+      if !info.IsDir() {
+         entries = append(entries, RecordingEntry{name, info.Size(), info.ModTime(), true})
+         continue
+      }
+
+      files, err := ioutil.ReadDir(name)
+      if err != nil {
+         continue
+      }
+
+      for _, file := range files {
+         if file.IsDir() || !isRecording(file.Name()) {
+            continue
+         }
+
+         entries = append(entries, RecordingEntry{filepath.Join(name, file.Name()), file.Size(), file.ModTime(), false})
+      }
+   }
+
+   // newest first, after those named
+   sort.SliceStable(entries, func(i, j int) bool {
+      if entries[i].Preload != entries[j].Preload {
+         return entries[i].Preload
+      }
+
+      return !entries[i].Preload && entries[i].Modified.After(entries[j].Modified)
+   })
+
+   return entries
+}
+
+func (v *Viewer) list(w http.ResponseWriter, r *http.Request) {
+   w.Header().Set("Content-Type", "application/json")
+
+   err := json.NewEncoder(w).Encode(v.Entries())
+   if err != nil && *debug {
+      fmt.Println("failed writing:", err)
+   }
+}
+
+// serves any readable recording as JSON; only listed recordings are accessible
+func (v *Viewer) recording(w http.ResponseWriter, r *http.Request) {
+   name := r.URL.Query().Get("name")
+   found := false
+
+   for _, entry := range v.Entries() {
+      found = found || entry.Name == name
+   }
+
+   if !found {
+      http.NotFound(w, r)
+      return
+   }
+
+   rec, err := loadRecording(name)
+   if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+   }
+
+   w.Header().Set("Content-Type", "application/json")
+
+   err = writeRecording(rec, newJSONWriter(w))
+   if err != nil && *debug {
+      fmt.Println("failed writing:", err)
+   }
+}
+
+func view(args []string) {
+   if len(args) == 0 {
+      args = []string{"."}
+   }
+
+   for _, name := range args {
+      _, err := os.Stat(name)
+      validate(err)
+   }
+
+   v := &Viewer{paths: args}
+
+   http.Handle("/", http.FileServer(http.Dir(resourcePath())))
+   http.HandleFunc("/recordings", v.list)
+   http.HandleFunc("/recording", v.recording)
+
+   listen(serveAddr())
+
+   select {}
+}
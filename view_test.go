@@ -0,0 +1,67 @@
+/*  Copyright (C) 2019 Daniel J Blueman
+    This file is part of Numascope.
+
+    Numascope is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    Numascope is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with Numascope.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+   "io/ioutil"
+   "net/http/httptest"
+   "net/url"
+   "os"
+   "path/filepath"
+   "strings"
+   "testing"
+)
+
+func TestViewer(t *testing.T) {
+   dir, err := ioutil.TempDir("", "numascope")
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer os.RemoveAll(dir)
+
+   named := filepath.Join(dir, "named.json")
+   for _, name := range []string{named, filepath.Join(dir, "run.jsonl.gz"), filepath.Join(dir, "run.nsb")} {
+      err = saveRecording(testRecording(1), name)
+      if err != nil {
+         t.Fatal(err)
+      }
+   }
+
+   ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("unrelated"), 0644)
+
+   v := &Viewer{paths: []string{named, dir}}
+   entries := v.Entries()
+
+   if len(entries) != 4 || entries[0].Name != named || !entries[0].Preload || entries[1].Preload {
+      t.Fatalf("unexpected entries %+v", entries)
+   }
+
+   for _, name := range []string{filepath.Join(dir, "run.nsb"), filepath.Join(dir, "notes.txt"), "/etc/passwd"} {
+      w := httptest.NewRecorder()
+      v.recording(w, httptest.NewRequest("GET", "/recording?name="+url.QueryEscape(name), nil))
+
+      listed := strings.HasSuffix(name, ".nsb")
+      if listed && (w.Code != 200 || !strings.Contains(w.Body.String(), "phase 1")) {
+         t.Errorf("failed serving %s: %d %s", name, w.Code, w.Body.String())
+      }
+
+      if !listed && w.Code != 404 {
+         t.Errorf("served unlisted %s", name)
+      }
+   }
+}